@@ -83,25 +83,9 @@ func runTestPushSeriesForQuerierRemoteRead(t *testing.T, c *e2emimir.Client, que
 	matcher, err := labels.NewMatcher(labels.MatchEqual, "__name__", seriesName)
 	require.NoError(t, err)
 
-	startMs := now.Add(-1*time.Minute).Unix() * 1000
-	endMs := now.Add(time.Minute).Unix() * 1000
-
-	q, err := remote.ToQuery(startMs, endMs, []*labels.Matcher{matcher}, &storage.SelectHints{
-		Step:  1,
-		Start: startMs,
-		End:   endMs,
-	})
+	compressed, err := buildRemoteReadRequest([]*labels.Matcher{matcher}, now.Add(-1*time.Minute).Truncate(time.Second), now.Add(time.Minute).Truncate(time.Second))
 	require.NoError(t, err)
 
-	req := &prompb.ReadRequest{
-		Queries:               []*prompb.Query{q},
-		AcceptedResponseTypes: []prompb.ReadRequest_ResponseType{prompb.ReadRequest_SAMPLES},
-	}
-
-	data, err := proto.Marshal(req)
-	require.NoError(t, err)
-	compressed := snappy.Encode(nil, data)
-
 	// Call the remote read API endpoint with a timeout.
 	httpReqCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
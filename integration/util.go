@@ -8,23 +8,51 @@ package integration
 
 import (
 	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
 	"math"
 	"math/rand"
+	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
 	"time"
 
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
 	"github.com/grafana/e2e"
 	"github.com/pkg/errors"
+	promv1 "github.com/prometheus/client_golang/api/prometheus/v1"
 	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/histogram"
 	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/prometheus/prometheus/storage"
 	"github.com/prometheus/prometheus/storage/remote"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/exp/slices"
 
+	"github.com/grafana/mimir/integration/e2emimir"
+	"github.com/grafana/mimir/pkg/mimirpb"
 	"github.com/grafana/mimir/pkg/util/test"
 )
 
+// These are the default labels the distributor HA tracker uses to identify the Prometheus HA cluster
+// and replica of a series.
+const (
+	haClusterLabel = "cluster"
+	haReplicaLabel = "__replica__"
+)
+
 var (
 	// Expose some utilities from the framework so that we don't have to prefix them
 	// with the package name in tests.
@@ -73,6 +101,1026 @@ func generateAlternatingSeries(i int) generateSeriesFunc {
 	}
 }
 
+// GenerateCrossTenantConflictSeries generates a series with the same labels for each of the input tenants,
+// with a different sample type and value in each tenant, to test how conflicting series are merged when
+// querying multiple tenants. It returns the series to push for each tenant and the expected vector when
+// querying all the tenants through tenant federation.
+func GenerateCrossTenantConflictSeries(name string, ts time.Time, tenants []string) (seriesPerTenant map[string][]prompb.TimeSeries, federatedVector model.Vector) {
+	seriesPerTenant = make(map[string][]prompb.TimeSeries, len(tenants))
+	vectorPerTenant := make([]model.Vector, 0, len(tenants))
+
+	for i, tenantID := range tenants {
+		series, vector, _ := generateAlternatingSeries(i)(name, ts)
+		seriesPerTenant[tenantID] = series
+		vectorPerTenant = append(vectorPerTenant, vector)
+	}
+
+	return seriesPerTenant, mergeResults(tenants, vectorPerTenant)
+}
+
+// GenerateGappySeries generates a float series with a sample only at the step indices in presentSteps,
+// leaving gaps in between, along with the expected matrix when querying it. The sample at step index i
+// has timestamp start + i*step and value i.
+func GenerateGappySeries(name string, start time.Time, step time.Duration, presentSteps []int, additionalLabels ...prompb.Label) (series []prompb.TimeSeries, matrix model.Matrix) {
+	steps := slices.Clone(presentSteps)
+	slices.Sort(steps)
+	steps = slices.Compact(steps)
+
+	lbls := append(
+		[]prompb.Label{
+			{Name: labels.MetricName, Value: name},
+		},
+		additionalLabels...,
+	)
+
+	metric := model.Metric{}
+	for _, lbl := range lbls {
+		metric[model.LabelName(lbl.Name)] = model.LabelValue(lbl.Value)
+	}
+
+	samples := make([]prompb.Sample, 0, len(steps))
+	values := make([]model.SamplePair, 0, len(steps))
+	for _, i := range steps {
+		tsMillis := e2e.TimeToMilliseconds(start.Add(time.Duration(i) * step))
+
+		samples = append(samples, prompb.Sample{Value: float64(i), Timestamp: tsMillis})
+		values = append(values, model.SamplePair{Value: model.SampleValue(i), Timestamp: model.Time(tsMillis)})
+	}
+
+	series = append(series, prompb.TimeSeries{Labels: lbls, Samples: samples})
+	matrix = append(matrix, &model.SampleStream{Metric: metric, Values: values})
+
+	return
+}
+
+// GenerateSeriesForChunkCut generates a float series with numSamples consecutive samples, the sample
+// at index i having timestamp start + i*step and value i, along with the expected matrix when querying
+// it. Ingesters cut a new chunk about every 120 samples, so tests can push enough samples to span
+// multiple chunks.
+func GenerateSeriesForChunkCut(name string, start time.Time, step time.Duration, numSamples int, additionalLabels ...prompb.Label) (series []prompb.TimeSeries, matrix model.Matrix) {
+	steps := make([]int, 0, numSamples)
+	for i := 0; i < numSamples; i++ {
+		steps = append(steps, i)
+	}
+
+	return GenerateGappySeries(name, start, step, steps, additionalLabels...)
+}
+
+// GenerateWALReplayFixture generates a float series with numSamples consecutive samples, as done by
+// GenerateSeriesForChunkCut, along with the expected matrix when querying it and the checksum of the
+// matrix, as computed by matrixChecksum. Tests can push the series, restart the ingester, and compare
+// the checksum of the queried matrix to assert the data replayed from the WAL matches the pushed one.
+func GenerateWALReplayFixture(name string, start time.Time, step time.Duration, numSamples int) (series []prompb.TimeSeries, matrix model.Matrix, checksum uint64) {
+	series, matrix = GenerateSeriesForChunkCut(name, start, step, numSamples)
+	return series, matrix, matrixChecksum(matrix)
+}
+
+// matrixChecksum returns the FNV-1a checksum of the metrics and float samples of the input matrix.
+// The checksum depends on the order of the series and samples.
+func matrixChecksum(matrix model.Matrix) uint64 {
+	h := fnv.New64a()
+	buf := make([]byte, 8)
+
+	for _, stream := range matrix {
+		binary.BigEndian.PutUint64(buf, uint64(stream.Metric.Fingerprint()))
+		_, _ = h.Write(buf)
+
+		for _, v := range stream.Values {
+			binary.BigEndian.PutUint64(buf, uint64(v.Timestamp))
+			_, _ = h.Write(buf)
+			binary.BigEndian.PutUint64(buf, math.Float64bits(float64(v.Value)))
+			_, _ = h.Write(buf)
+		}
+	}
+
+	return h.Sum64()
+}
+
+// GenerateSeriesForRemoteRead generates a float series with a sample at each step between start and end,
+// both included, along with the expected matrix when reading it back. The value of the sample at step
+// index i is i. Use buildRemoteReadRequest to build the remote read request for the series.
+func GenerateSeriesForRemoteRead(name string, start, end time.Time, step time.Duration) (series []prompb.TimeSeries, matrix model.Matrix) {
+	return GenerateSeriesForChunkCut(name, start, step, int(end.Sub(start)/step)+1)
+}
+
+// buildRemoteReadRequest returns the snappy-compressed protobuf remote read request querying the
+// float samples of the series matching the input matchers between start and end, as expected by
+// the remote read API endpoint.
+func buildRemoteReadRequest(matchers []*labels.Matcher, start, end time.Time) ([]byte, error) {
+	startMs, endMs := e2e.TimeToMilliseconds(start), e2e.TimeToMilliseconds(end)
+
+	q, err := remote.ToQuery(startMs, endMs, matchers, &storage.SelectHints{
+		Step:  1,
+		Start: startMs,
+		End:   endMs,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	req := &prompb.ReadRequest{
+		Queries:               []*prompb.Query{q},
+		AcceptedResponseTypes: []prompb.ReadRequest_ResponseType{prompb.ReadRequest_SAMPLES},
+	}
+
+	data, err := proto.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	return snappy.Encode(nil, data), nil
+}
+
+// GenerateSeriesAcrossDST generates a float series with a sample at each step covering both the UTC
+// and the loc calendar days of dstDate, along with the expected matrices when querying the UTC day and
+// the loc day, both as half-open [midnight, next midnight) ranges. If dstDate is the day of a DST
+// transition in loc, the loc day lasts 23 or 25 hours, while the UTC day always lasts 24 hours.
+// The value of the sample at step index i is i.
+func GenerateSeriesAcrossDST(name string, loc *time.Location, dstDate time.Time, step time.Duration) (series []prompb.TimeSeries, utcMatrix, localMatrix model.Matrix) {
+	year, month, day := dstDate.In(loc).Date()
+	localStart := time.Date(year, month, day, 0, 0, 0, 0, loc)
+	localEnd := time.Date(year, month, day+1, 0, 0, 0, 0, loc)
+	utcStart := time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+	utcEnd := time.Date(year, month, day+1, 0, 0, 0, 0, time.UTC)
+
+	start, end := localStart, localEnd
+	if utcStart.Before(start) {
+		start = utcStart
+	}
+	if utcEnd.After(end) {
+		end = utcEnd
+	}
+
+	numSamples := int((end.Sub(start) + step - 1) / step)
+	series, matrix := GenerateSeriesForChunkCut(name, start, step, numSamples)
+
+	withinRange := func(from, to time.Time) model.Matrix {
+		values := make([]model.SamplePair, 0, len(matrix[0].Values))
+		for _, v := range matrix[0].Values {
+			if !v.Timestamp.Time().Before(from) && v.Timestamp.Time().Before(to) {
+				values = append(values, v)
+			}
+		}
+		return model.Matrix{{Metric: matrix[0].Metric, Values: values}}
+	}
+
+	return series, withinRange(utcStart, utcEnd), withinRange(localStart, localEnd)
+}
+
+// GenerateJitteredSeries generates a float series with numSamples samples, the sample at index i having
+// value i and timestamp start + i*step plus a random jitter between -maxJitter and +maxJitter, along with
+// the expected matrix when querying it. The jitter is deterministic given the input seed. Samples are out
+// of order if maxJitter is greater than half the step. A negative maxJitter is treated as no jitter.
+func GenerateJitteredSeries(name string, start time.Time, step, maxJitter time.Duration, numSamples int, seed int64) (series []prompb.TimeSeries, matrix model.Matrix) {
+	rnd := rand.New(rand.NewSource(seed))
+	if maxJitter < 0 {
+		maxJitter = 0
+	}
+
+	samples := make([]prompb.Sample, 0, numSamples)
+	values := make([]model.SamplePair, 0, numSamples)
+	for i := 0; i < numSamples; i++ {
+		jitter := time.Duration(rnd.Int63n(2*maxJitter.Milliseconds()+1)-maxJitter.Milliseconds()) * time.Millisecond
+		tsMillis := e2e.TimeToMilliseconds(start.Add(time.Duration(i)*step + jitter))
+
+		samples = append(samples, prompb.Sample{Value: float64(i), Timestamp: tsMillis})
+		values = append(values, model.SamplePair{Value: model.SampleValue(i), Timestamp: model.Time(tsMillis)})
+	}
+
+	series = append(series, prompb.TimeSeries{
+		Labels:  []prompb.Label{{Name: labels.MetricName, Value: name}},
+		Samples: samples,
+	})
+	matrix = append(matrix, &model.SampleStream{
+		Metric: model.Metric{labels.MetricName: model.LabelValue(name)},
+		Values: values,
+	})
+
+	return
+}
+
+// GenerateTimestampValueSeries generates a float series with numSamples samples, the sample at index i
+// having timestamp start + i*step and, as value, its own timestamp in seconds, along with the expected
+// matrix when querying it. This makes it simple to assert on the output of timestamp() and on monotonicity.
+func GenerateTimestampValueSeries(name string, start time.Time, step time.Duration, numSamples int) (series []prompb.TimeSeries, matrix model.Matrix) {
+	samples := make([]prompb.Sample, 0, numSamples)
+	values := make([]model.SamplePair, 0, numSamples)
+	for i := 0; i < numSamples; i++ {
+		ts := start.Add(time.Duration(i) * step)
+		tsMillis := e2e.TimeToMilliseconds(ts)
+		value := float64(tsMillis) / 1000
+
+		samples = append(samples, prompb.Sample{Value: value, Timestamp: tsMillis})
+		values = append(values, model.SamplePair{Value: model.SampleValue(value), Timestamp: model.Time(tsMillis)})
+	}
+
+	series = append(series, prompb.TimeSeries{
+		Labels:  []prompb.Label{{Name: labels.MetricName, Value: name}},
+		Samples: samples,
+	})
+	matrix = append(matrix, &model.SampleStream{
+		Metric: model.Metric{labels.MetricName: model.LabelValue(name)},
+		Values: values,
+	})
+
+	return
+}
+
+// GenerateSeriesWithLabelSets generates a float series for each of the input label sets, all with the
+// input metric name, along with the expected sorted and deduplicated label names and the expected sorted
+// and deduplicated values of each label name, as returned by the labels API endpoints.
+func GenerateSeriesWithLabelSets(name string, ts time.Time, labelSets []map[string]string) (series []prompb.TimeSeries, labelNames []string, labelValues map[string][]string) {
+	tsMillis := e2e.TimeToMilliseconds(ts)
+	labelValues = map[string][]string{labels.MetricName: {name}}
+
+	for _, labelSet := range labelSets {
+		lbls := []prompb.Label{{Name: labels.MetricName, Value: name}}
+		for labelName, labelValue := range labelSet {
+			lbls = append(lbls, prompb.Label{Name: labelName, Value: labelValue})
+			labelValues[labelName] = append(labelValues[labelName], labelValue)
+		}
+		slices.SortFunc(lbls, func(a, b prompb.Label) bool { return a.Name < b.Name })
+
+		series = append(series, prompb.TimeSeries{
+			Labels:  lbls,
+			Samples: []prompb.Sample{{Value: rand.Float64(), Timestamp: tsMillis}},
+		})
+	}
+
+	for labelName, values := range labelValues {
+		slices.Sort(values)
+		labelValues[labelName] = slices.Compact(values)
+		labelNames = append(labelNames, labelName)
+	}
+	slices.Sort(labelNames)
+
+	return
+}
+
+// GenerateSeriesForLabelNamesAPI generates float series, all with the input metric name, carrying each
+// of the input label names, along with the expected sorted and deduplicated label names and the expected
+// number of values of each label name, as returned by the cardinality label names API endpoint. Label
+// names get a distinct number of values, so that the API response ordering by values count is deterministic:
+// the i-th label name, in sorted order, has i+1 values.
+func GenerateSeriesForLabelNamesAPI(name string, ts time.Time, labelNames []string) (series []prompb.TimeSeries, expectedLabelNames []string, valuesCount map[string]int) {
+	sortedLabelNames := slices.Clone(labelNames)
+	slices.Sort(sortedLabelNames)
+	sortedLabelNames = slices.Compact(sortedLabelNames)
+
+	var labelSets []map[string]string
+	for i, labelName := range sortedLabelNames {
+		for j := 0; j <= i; j++ {
+			labelSets = append(labelSets, map[string]string{labelName: fmt.Sprintf("value-%d", j)})
+		}
+	}
+
+	series, expectedLabelNames, labelValues := GenerateSeriesWithLabelSets(name, ts, labelSets)
+
+	valuesCount = make(map[string]int, len(labelValues))
+	for labelName, values := range labelValues {
+		valuesCount[labelName] = len(values)
+	}
+
+	return
+}
+
+// SeriesAPIProbe is a time window to query the series API with, along with whether the series
+// generated by GenerateSeriesForSeriesAPI is expected to be returned for it.
+type SeriesAPIProbe struct {
+	Start, End time.Time
+	Included   bool
+}
+
+// GenerateSeriesForSeriesAPI generates a float series with a sample at activeStart and one at activeEnd,
+// so that the series is only present within [activeStart, activeEnd], along with probe windows to
+// validate the start and end filtering of the /series API. The series is expected to be returned for
+// windows overlapping [activeStart, activeEnd], even by a single millisecond, and not for windows
+// ending before activeStart or starting after activeEnd.
+func GenerateSeriesForSeriesAPI(name string, activeStart, activeEnd time.Time) (series []prompb.TimeSeries, probes []SeriesAPIProbe) {
+	series = append(series, prompb.TimeSeries{
+		Labels: []prompb.Label{{Name: labels.MetricName, Value: name}},
+		Samples: []prompb.Sample{
+			{Value: 1, Timestamp: e2e.TimeToMilliseconds(activeStart)},
+			{Value: 2, Timestamp: e2e.TimeToMilliseconds(activeEnd)},
+		},
+	})
+
+	probes = []SeriesAPIProbe{
+		{Start: activeStart.Add(-time.Hour), End: activeStart.Add(-time.Millisecond), Included: false},
+		{Start: activeStart.Add(-time.Hour), End: activeStart, Included: true},
+		{Start: activeStart.Add(-time.Hour), End: activeEnd.Add(time.Hour), Included: true},
+		{Start: activeEnd, End: activeEnd.Add(time.Hour), Included: true},
+		{Start: activeEnd.Add(time.Millisecond), End: activeEnd.Add(time.Hour), Included: false},
+	}
+
+	return
+}
+
+// GenerateSchemaChangingHistogramSeries generates a native histogram series with one histogram per step
+// starting at tsStart, where the histogram at step i has the schema schemas[i], along with the expected
+// matrix when querying it. This allows to test schema changes within a series.
+func GenerateSchemaChangingHistogramSeries(name string, tsStart time.Time, step time.Duration, schemas []int32) (series []prompb.TimeSeries, matrix model.Matrix) {
+	lbls := []prompb.Label{{Name: labels.MetricName, Value: name}}
+	metric := model.Metric{labels.MetricName: model.LabelValue(name)}
+
+	histograms := make([]prompb.Histogram, 0, len(schemas))
+	expected := make([]model.SampleHistogramPair, 0, len(schemas))
+	for i, schema := range schemas {
+		tsMillis := e2e.TimeToMilliseconds(tsStart.Add(time.Duration(i) * step))
+
+		h := generateTestHistogram(i)
+		h.Schema = schema
+
+		histograms = append(histograms, remote.HistogramToHistogramProto(tsMillis, h))
+		expected = append(expected, model.SampleHistogramPair{
+			Timestamp: model.Time(tsMillis),
+			Histogram: mimirpb.FromHistogramToPromHistogram(h),
+		})
+	}
+
+	series = append(series, prompb.TimeSeries{Labels: lbls, Histograms: histograms})
+	matrix = append(matrix, &model.SampleStream{Metric: metric, Histograms: expected})
+
+	return
+}
+
+// GenerateNegativeBucketHistogramSeries generates an histogram series with a single sample, whose
+// observations are all negative, so that only the negative buckets are populated, along with the
+// expected vector and matrix when querying it.
+func GenerateNegativeBucketHistogramSeries(name string, ts time.Time) (series []prompb.TimeSeries, vector model.Vector, matrix model.Matrix) {
+	tsMillis := e2e.TimeToMilliseconds(ts)
+	metric := model.Metric{labels.MetricName: model.LabelValue(name)}
+
+	// Buckets [-1, -0.5), [-2, -1) and [-4, -2) with 1, 2 and 3 observations respectively.
+	h := &histogram.Histogram{
+		Schema:          0,
+		Count:           6,
+		Sum:             -12,
+		NegativeSpans:   []histogram.Span{{Offset: 0, Length: 3}},
+		NegativeBuckets: []int64{1, 1, 1},
+	}
+
+	series = append(series, prompb.TimeSeries{
+		Labels:     []prompb.Label{{Name: labels.MetricName, Value: name}},
+		Histograms: []prompb.Histogram{remote.HistogramToHistogramProto(tsMillis, h)},
+	})
+	vector = append(vector, &model.Sample{
+		Metric:    metric,
+		Timestamp: model.Time(tsMillis),
+		Histogram: mimirpb.FromHistogramToPromHistogram(h),
+	})
+	matrix = append(matrix, &model.SampleStream{
+		Metric:     metric,
+		Histograms: []model.SampleHistogramPair{{Timestamp: model.Time(tsMillis), Histogram: mimirpb.FromHistogramToPromHistogram(h)}},
+	})
+
+	return
+}
+
+// GenerateMetadataOnly generates a remote write request with one metadata entry of the input type for
+// each of the input metric names, and no series, along with the expected response of the /api/v1/metadata
+// API, by metric name. The help of each metric mentions the metric name, and the unit is empty.
+func GenerateMetadataOnly(metricNames []string, metricType prompb.MetricMetadata_MetricType) (req *prompb.WriteRequest, expected map[string][]promv1.Metadata) {
+	req = &prompb.WriteRequest{Metadata: make([]prompb.MetricMetadata, 0, len(metricNames))}
+	expected = make(map[string][]promv1.Metadata, len(metricNames))
+
+	for _, name := range metricNames {
+		help := fmt.Sprintf("Help of %s.", name)
+
+		req.Metadata = append(req.Metadata, prompb.MetricMetadata{
+			Type:             metricType,
+			MetricFamilyName: name,
+			Help:             help,
+		})
+		expected[name] = []promv1.Metadata{{
+			Type: promv1.MetricType(strings.ToLower(metricType.String())),
+			Help: help,
+		}}
+	}
+
+	return
+}
+
+// GenerateReservedLabelSeries generates a float series with a single sample at ts, with the input
+// metric name and the input reservedLabel set to the value "reserved". The reserved label is meant to
+// be a label name reserved for internal use, like one starting with "__" other than "__name__". The
+// label is set on the series as is: the distributor only validates the syntax of label names, which
+// reserved names comply with, so pushing the series doesn't fail because of it.
+func GenerateReservedLabelSeries(name string, ts time.Time, reservedLabel string) []prompb.TimeSeries {
+	series, _, _ := generateFloatSeries(name, ts, prompb.Label{Name: reservedLabel, Value: "reserved"})
+	return series
+}
+
+// GenerateSeriesAtAcceptanceBoundary generates two float series, each with a single sample, at exactly
+// the boundaries of the time range ingestion accepts samples in: futureSeries has a sample at
+// now + futureTolerance and pastSeries has a sample at now - pastTolerance. The series differ by the
+// "boundary" label, so they can be pushed and asserted independently of each other. Both the
+// -validation.create-grace-period and the out-of-bounds checks only reject samples strictly beyond
+// the boundary, so both samples are expected to be accepted, while moving either of them by one more
+// millisecond away from now is expected to get it rejected. The input now is truncated to milliseconds,
+// like sample timestamps are, so that truncating the timestamps doesn't move the samples off the boundaries.
+func GenerateSeriesAtAcceptanceBoundary(name string, now time.Time, futureTolerance, pastTolerance time.Duration) (futureSeries, pastSeries []prompb.TimeSeries) {
+	now = now.Truncate(time.Millisecond)
+	futureSeries, _, _ = generateFloatSeries(name, now.Add(futureTolerance), prompb.Label{Name: "boundary", Value: "future"})
+	pastSeries, _, _ = generateFloatSeries(name, now.Add(-pastTolerance), prompb.Label{Name: "boundary", Value: "past"})
+	return
+}
+
+// GenerateThresholdCrossingSeries generates a float series with the sample at step index i having
+// timestamp start + i*step and value values[i], along with the step indices whose value is above
+// threshold. This allows to test comparison queries, like the ones used by alerting rules.
+func GenerateThresholdCrossingSeries(name string, start time.Time, step time.Duration, values []float64, threshold float64) (series []prompb.TimeSeries, aboveThresholdSteps []int) {
+	samples := make([]prompb.Sample, 0, len(values))
+	for i, value := range values {
+		samples = append(samples, prompb.Sample{
+			Value:     value,
+			Timestamp: e2e.TimeToMilliseconds(start.Add(time.Duration(i) * step)),
+		})
+
+		if value > threshold {
+			aboveThresholdSteps = append(aboveThresholdSteps, i)
+		}
+	}
+
+	series = append(series, prompb.TimeSeries{
+		Labels:  []prompb.Label{{Name: labels.MetricName, Value: name}},
+		Samples: samples,
+	})
+
+	return
+}
+
+// GenerateSeriesForAvgOverTime generates a float series with the sample at step index i having
+// timestamp start + i*step and value values[i], along with the expected result of
+// avg_over_time(name[len(values)*step]) evaluated at the timestamp of the last sample, whose
+// range covers all the samples. The metric name is dropped from the expected result, as PromQL does.
+func GenerateSeriesForAvgOverTime(name string, start time.Time, step time.Duration, values []float64) (series []prompb.TimeSeries, expected model.Vector) {
+	if len(values) == 0 {
+		return nil, model.Vector{}
+	}
+
+	samples := make([]prompb.Sample, 0, len(values))
+	sum := 0.0
+	for i, value := range values {
+		samples = append(samples, prompb.Sample{
+			Value:     value,
+			Timestamp: e2e.TimeToMilliseconds(start.Add(time.Duration(i) * step)),
+		})
+		sum += value
+	}
+
+	series = append(series, prompb.TimeSeries{
+		Labels:  []prompb.Label{{Name: labels.MetricName, Value: name}},
+		Samples: samples,
+	})
+	expected = append(expected, &model.Sample{
+		Metric:    model.Metric{},
+		Value:     model.SampleValue(sum / float64(len(values))),
+		Timestamp: model.Time(samples[len(samples)-1].Timestamp),
+	})
+
+	return
+}
+
+// ExpectedDelta returns the expected result of delta(<series>[rangeSeconds]) for each of the float
+// gauge series in the input matrix, evaluated at the timestamp of the last sample of the series.
+// It mimics Prometheus, which considers the samples in the closed range, including the sample at
+// exactly the start of the range, and extrapolates the difference between the first and last samples to the boundaries of the range, unless they're
+// further than 1.1 times the average interval between samples, in which case the extrapolation is
+// limited to half of the average interval. Series with less than two samples in the range are
+// skipped. The metric name is dropped from the expected result, as PromQL does.
+func ExpectedDelta(matrix model.Matrix, rangeSeconds float64) model.Vector {
+	vector := model.Vector{}
+
+	for _, stream := range matrix {
+		if len(stream.Values) == 0 {
+			continue
+		}
+
+		rangeEnd := stream.Values[len(stream.Values)-1].Timestamp
+		rangeStart := rangeEnd.Add(-time.Duration(rangeSeconds * float64(time.Second)))
+
+		var samples []model.SamplePair
+		for _, sample := range stream.Values {
+			if sample.Timestamp >= rangeStart {
+				samples = append(samples, sample)
+			}
+		}
+		if len(samples) < 2 {
+			continue
+		}
+
+		first, last := samples[0], samples[len(samples)-1]
+		durationToStart := float64(first.Timestamp-rangeStart) / 1000
+		durationToEnd := float64(rangeEnd-last.Timestamp) / 1000
+		sampledInterval := float64(last.Timestamp-first.Timestamp) / 1000
+		averageDurationBetweenSamples := sampledInterval / float64(len(samples)-1)
+
+		extrapolationThreshold := averageDurationBetweenSamples * 1.1
+		extrapolateToInterval := sampledInterval
+		if durationToStart < extrapolationThreshold {
+			extrapolateToInterval += durationToStart
+		} else {
+			extrapolateToInterval += averageDurationBetweenSamples / 2
+		}
+		if durationToEnd < extrapolationThreshold {
+			extrapolateToInterval += durationToEnd
+		} else {
+			extrapolateToInterval += averageDurationBetweenSamples / 2
+		}
+
+		metric := stream.Metric.Clone()
+		delete(metric, labels.MetricName)
+
+		vector = append(vector, &model.Sample{
+			Metric:    metric,
+			Value:     (last.Value - first.Value) * model.SampleValue(extrapolateToInterval/sampledInterval),
+			Timestamp: rangeEnd,
+		})
+	}
+
+	return vector
+}
+
+// GenerateOverflowCounterSeries generates a float counter series whose samples, at timestamp
+// start + i*step, approach the uint64 boundary and then wrap past it, like a uint64 counter
+// overflowing in the instrumented application. It also returns the step indices at which the
+// value decreases, where rate() and similar functions should detect a counter reset.
+func GenerateOverflowCounterSeries(name string, start time.Time, step time.Duration) (series []prompb.TimeSeries, resetSteps []int) {
+	const (
+		numSamples = 10
+		increment  = uint64(1e15)
+	)
+
+	// Start so that the counter overflows midway. The uint64 arithmetic wraps around on overflow.
+	value := math.MaxUint64 - (numSamples/2)*increment + increment/2
+
+	samples := make([]prompb.Sample, 0, numSamples)
+	for i := 0; i < numSamples; i++ {
+		samples = append(samples, prompb.Sample{
+			Value:     float64(value),
+			Timestamp: e2e.TimeToMilliseconds(start.Add(time.Duration(i) * step)),
+		})
+
+		if i > 0 && samples[i].Value < samples[i-1].Value {
+			resetSteps = append(resetSteps, i)
+		}
+		value += increment
+	}
+
+	series = append(series, prompb.TimeSeries{
+		Labels:  []prompb.Label{{Name: labels.MetricName, Value: name}},
+		Samples: samples,
+	})
+
+	return
+}
+
+// GenerateFloatSeriesWithExemplarBurst generates a float series with a single sample and n exemplars,
+// all at the sample timestamp and each one with a distinct trace ID. Exemplars are stored in a per-tenant
+// circular buffer, whose size is set by -ingester.max-global-exemplars-per-user, so Mimir may drop the
+// oldest exemplars once n exceeds it.
+func GenerateFloatSeriesWithExemplarBurst(name string, ts time.Time, n int) []prompb.TimeSeries {
+	tsMillis := e2e.TimeToMilliseconds(ts)
+
+	exemplars := make([]prompb.Exemplar, 0, n)
+	for i := 0; i < n; i++ {
+		exemplars = append(exemplars, prompb.Exemplar{
+			Value:     float64(i),
+			Timestamp: tsMillis,
+			Labels:    []prompb.Label{{Name: "trace_id", Value: DeterministicTraceID(int64(i))}},
+		})
+	}
+
+	return []prompb.TimeSeries{{
+		Labels:    []prompb.Label{{Name: labels.MetricName, Value: name}},
+		Samples:   []prompb.Sample{{Value: rand.Float64(), Timestamp: tsMillis}},
+		Exemplars: exemplars,
+	}}
+}
+
+// GenerateUpSeries generates the up series of a scrape target which is up for upSteps steps and then
+// down for the following downSteps steps, along with the expected matrix when querying it. Like Prometheus
+// does when a scrape fails, the samples are 1 while the target is up and 0 once it's down. The sample at
+// step index i has timestamp start + i*step.
+func GenerateUpSeries(job, instance string, start time.Time, step time.Duration, upSteps, downSteps int) (series []prompb.TimeSeries, matrix model.Matrix) {
+	samples := make([]prompb.Sample, 0, upSteps+downSteps)
+	values := make([]model.SamplePair, 0, upSteps+downSteps)
+	for i := 0; i < upSteps+downSteps; i++ {
+		tsMillis := e2e.TimeToMilliseconds(start.Add(time.Duration(i) * step))
+
+		value := 1.0
+		if i >= upSteps {
+			value = 0
+		}
+
+		samples = append(samples, prompb.Sample{Value: value, Timestamp: tsMillis})
+		values = append(values, model.SamplePair{Value: model.SampleValue(value), Timestamp: model.Time(tsMillis)})
+	}
+
+	series = append(series, prompb.TimeSeries{
+		Labels: []prompb.Label{
+			{Name: labels.MetricName, Value: "up"},
+			{Name: "instance", Value: instance},
+			{Name: "job", Value: job},
+		},
+		Samples: samples,
+	})
+	matrix = append(matrix, &model.SampleStream{
+		Metric: model.Metric{labels.MetricName: "up", "instance": model.LabelValue(instance), "job": model.LabelValue(job)},
+		Values: values,
+	})
+
+	return
+}
+
+// GenerateSeriesForAllShards generates float series, all with the input metric name and a distinct
+// series_id label, until each of the totalShards query shards owns at least one of them. A series is
+// owned by the shard whose index is the stable hash of its labels modulo totalShards, as done by
+// queriers and store-gateways when running sharded queries. The series are returned by shard index.
+func GenerateSeriesForAllShards(name string, ts time.Time, totalShards int) map[int][]prompb.TimeSeries {
+	seriesPerShard := make(map[int][]prompb.TimeSeries, totalShards)
+
+	for i := 0; len(seriesPerShard) < totalShards; i++ {
+		lbls := labels.FromStrings(labels.MetricName, name, "series_id", fmt.Sprintf("%d", i))
+		shard := int(labels.StableHash(lbls) % uint64(totalShards))
+
+		series, _, _ := generateFloatSeries(name, ts, prompb.Label{Name: "series_id", Value: fmt.Sprintf("%d", i)})
+		seriesPerShard[shard] = append(seriesPerShard[shard], series...)
+	}
+
+	return seriesPerShard
+}
+
+// GenerateShardedExpectation generates float series, all with the input metric name, owned by each of
+// the totalShards query shards as done by GenerateSeriesForAllShards, and returns the expected result
+// of sum(name) computed by each shard, indexed by shard, together with the expected merged result.
+// The merged result is computed over all the series, so that tests can validate merging the partials.
+func GenerateShardedExpectation(name string, ts time.Time, totalShards int) (series []prompb.TimeSeries, partials []model.Vector, merged model.Vector) {
+	tsMillis := e2e.TimeToMilliseconds(ts)
+	seriesPerShard := GenerateSeriesForAllShards(name, ts, totalShards)
+	partials = make([]model.Vector, 0, totalShards)
+
+	for shard := 0; shard < totalShards; shard++ {
+		sum := 0.0
+		for _, s := range seriesPerShard[shard] {
+			sum += s.Samples[0].Value
+		}
+
+		series = append(series, seriesPerShard[shard]...)
+		partials = append(partials, model.Vector{{
+			Metric:    model.Metric{},
+			Value:     model.SampleValue(sum),
+			Timestamp: model.Time(tsMillis),
+		}})
+	}
+
+	sum := 0.0
+	for _, s := range series {
+		sum += s.Samples[0].Value
+	}
+	merged = model.Vector{{
+		Metric:    model.Metric{},
+		Value:     model.SampleValue(sum),
+		Timestamp: model.Time(tsMillis),
+	}}
+
+	return
+}
+
+// GenerateHashmodColliders generates count float series, all with the input metric name and a
+// distinct instance label, whose instance label value hashes to target under modulus, as computed
+// by the hashmod relabel action. The candidate values are searched in a deterministic order, and
+// an error is returned if not enough colliding values are found within a bounded number of attempts.
+func GenerateHashmodColliders(name string, ts time.Time, modulus, target, count int) ([]prompb.TimeSeries, error) {
+	if modulus <= 0 || target < 0 || target >= modulus {
+		return nil, errors.Errorf("invalid hashmod target %d for modulus %d", target, modulus)
+	}
+
+	maxAttempts := 100 * modulus * count
+	series := make([]prompb.TimeSeries, 0, count)
+
+	for i := 0; i < maxAttempts && len(series) < count; i++ {
+		instance := fmt.Sprintf("instance-%d", i)
+
+		// Same hashing done by the hashmod relabel action on a single source label.
+		hash := md5.Sum([]byte(instance))
+		if binary.BigEndian.Uint64(hash[8:])%uint64(modulus) != uint64(target) {
+			continue
+		}
+
+		s, _, _ := generateFloatSeries(name, ts, prompb.Label{Name: "instance", Value: instance})
+		series = append(series, s...)
+	}
+
+	if len(series) < count {
+		return nil, errors.Errorf("found only %d out of %d series hashing to %d under modulus %d after %d attempts", len(series), count, target, modulus, maxAttempts)
+	}
+	return series, nil
+}
+
+// DeterministicTraceID returns a 32 hex characters trace ID derived from the input seed, so that
+// tests linking exemplars to traces can assert on specific trace IDs.
+func DeterministicTraceID(seed int64) string {
+	id := make([]byte, 16)
+	_, _ = rand.New(rand.NewSource(seed)).Read(id)
+	return hex.EncodeToString(id)
+}
+
+// DeterministicFloatHistogram returns a float native histogram with schema 0, positive, negative and
+// zero buckets, whose observation counts and sum are derived from the input seed, so that generators and
+// assertions can share the same histogram. The count is consistent with the bucket counts.
+func DeterministicFloatHistogram(seed int64) *histogram.FloatHistogram {
+	r := rand.New(rand.NewSource(seed))
+
+	h := &histogram.FloatHistogram{
+		Schema:          0,
+		ZeroThreshold:   0.001,
+		ZeroCount:       float64(r.Intn(10)),
+		Sum:             r.Float64() * 100,
+		PositiveSpans:   []histogram.Span{{Offset: 0, Length: 2}, {Offset: 1, Length: 2}},
+		PositiveBuckets: make([]float64, 4),
+		NegativeSpans:   []histogram.Span{{Offset: 0, Length: 2}},
+		NegativeBuckets: make([]float64, 2),
+	}
+
+	h.Count = h.ZeroCount
+	for i := range h.PositiveBuckets {
+		h.PositiveBuckets[i] = float64(1 + r.Intn(10))
+		h.Count += h.PositiveBuckets[i]
+	}
+	for i := range h.NegativeBuckets {
+		h.NegativeBuckets[i] = float64(1 + r.Intn(10))
+		h.Count += h.NegativeBuckets[i]
+	}
+
+	return h
+}
+
+// GenerateMixedBatch generates count series named after namePrefix, alternating float samples and all
+// the kinds of native histograms, along with the expected vector when querying them. Use count >= 5 to
+// generate at least one series of each kind.
+func GenerateMixedBatch(namePrefix string, ts time.Time, count int) (series []prompb.TimeSeries, vector model.Vector) {
+	for i := 0; i < count; i++ {
+		s, v, _ := generateAlternatingSeries(i)(fmt.Sprintf("%s_%d", namePrefix, i), ts)
+		series = append(series, s...)
+		vector = append(vector, v...)
+	}
+	return
+}
+
+// GenerateSeriesToHitLimit generates limit+1 distinct float series named after namePrefix, for
+// negative-path tests of the per-tenant series limit. When pushed to a tenant configured with
+// -ingester.max-global-series-per-user equal to limit, the last series is expected to be rejected.
+func GenerateSeriesToHitLimit(namePrefix string, ts time.Time, limit int) []prompb.TimeSeries {
+	series := make([]prompb.TimeSeries, 0, limit+1)
+	for i := 0; i <= limit; i++ {
+		s, _, _ := generateFloatSeries(fmt.Sprintf("%s_%d", namePrefix, i), ts)
+		series = append(series, s...)
+	}
+	return series
+}
+
+// GenerateActiveSeries generates count float series named after namePrefix, with the labels set by the
+// equality matchers of the input series selector, like {job="test"}, along with the number of active
+// series the cardinality active series API is expected to return when queried with the same selector.
+// The expected count is computed by applying all the matchers of the selector to the generated series,
+// so it's lower than count if the selector has other matchers that the series don't match, like one on
+// the metric name. An error is returned if the selector can't be parsed.
+func GenerateActiveSeries(namePrefix string, ts time.Time, count int, matcher string) (series []prompb.TimeSeries, expectedCount int, err error) {
+	matchers, err := parser.ParseMetricSelector(matcher)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var additionalLabels []prompb.Label
+	for _, m := range matchers {
+		if m.Type == labels.MatchEqual && m.Name != labels.MetricName {
+			additionalLabels = append(additionalLabels, prompb.Label{Name: m.Name, Value: m.Value})
+		}
+	}
+	slices.SortFunc(additionalLabels, func(a, b prompb.Label) bool { return a.Name < b.Name })
+
+	for i := 0; i < count; i++ {
+		s, _, _ := generateFloatSeries(fmt.Sprintf("%s_%d", namePrefix, i), ts, additionalLabels...)
+		series = append(series, s...)
+	}
+
+	for _, s := range series {
+		if seriesMatchesAll(s, matchers) {
+			expectedCount++
+		}
+	}
+
+	return series, expectedCount, nil
+}
+
+// seriesMatchesAll returns whether the labels of the input series match all the input matchers.
+// A label missing from the series matches as the empty string, like in PromQL.
+func seriesMatchesAll(series prompb.TimeSeries, matchers []*labels.Matcher) bool {
+	values := make(map[string]string, len(series.Labels))
+	for _, lbl := range series.Labels {
+		values[lbl.Name] = lbl.Value
+	}
+
+	for _, m := range matchers {
+		if !m.Matches(values[m.Name]) {
+			return false
+		}
+	}
+	return true
+}
+
+// GenerateHighCardinalityLabelSeries generates cardinality float series with the input metric name,
+// differing only in the value of the input label, for tests of the limits on the cardinality of a label.
+func GenerateHighCardinalityLabelSeries(name string, ts time.Time, labelName string, cardinality int) []prompb.TimeSeries {
+	series := make([]prompb.TimeSeries, 0, cardinality)
+	for i := 0; i < cardinality; i++ {
+		s, _, _ := generateFloatSeries(name, ts, prompb.Label{Name: labelName, Value: fmt.Sprintf("value-%d", i)})
+		series = append(series, s...)
+	}
+	return series
+}
+
+// GenerateLongLabelValueSeries generates a float series with the input metric name and a value of the
+// input label made of valueLen characters, for tests of the limit on the length of label values. The
+// distributor rejects the series if valueLen is greater than -validation.max-length-label-value, and
+// accepts it if valueLen is equal to the limit.
+func GenerateLongLabelValueSeries(name string, ts time.Time, labelName string, valueLen int) []prompb.TimeSeries {
+	series, _, _ := generateFloatSeries(name, ts, prompb.Label{Name: labelName, Value: strings.Repeat("a", valueLen)})
+	return series
+}
+
+// GenerateHASeries generates a float series sent by the input replica of the input Prometheus HA cluster,
+// identified by the default labels used by the distributor HA tracker (-distributor.ha-tracker.cluster and
+// -distributor.ha-tracker.replica), along with the expected vector and matrix when querying it. The HA
+// tracker removes the replica label from accepted series, so it's not part of the expected results.
+func GenerateHASeries(name string, ts time.Time, cluster, replica string, additionalLabels ...prompb.Label) (series []prompb.TimeSeries, vector model.Vector, matrix model.Matrix) {
+	series, vector, matrix = generateFloatSeries(name, ts, append([]prompb.Label{{Name: haClusterLabel, Value: cluster}}, additionalLabels...)...)
+
+	for i := range series {
+		series[i].Labels = append(series[i].Labels, prompb.Label{Name: haReplicaLabel, Value: replica})
+	}
+
+	return
+}
+
+// GenerateHASeriesForReplicas generates the same float series, with the same samples, sent by two
+// replicas of the input Prometheus HA cluster, along with the expected vector and matrix when querying
+// it after the HA tracker deduplicated the series.
+func GenerateHASeriesForReplicas(name string, ts time.Time, cluster, firstReplica, secondReplica string, additionalLabels ...prompb.Label) (firstSeries, secondSeries []prompb.TimeSeries, vector model.Vector, matrix model.Matrix) {
+	firstSeries, vector, matrix = GenerateHASeries(name, ts, cluster, firstReplica, additionalLabels...)
+
+	for _, s := range firstSeries {
+		lbls := make([]prompb.Label, 0, len(s.Labels))
+		for _, lbl := range s.Labels {
+			if lbl.Name == haReplicaLabel {
+				lbl.Value = secondReplica
+			}
+			lbls = append(lbls, lbl)
+		}
+
+		s.Labels = lbls
+		secondSeries = append(secondSeries, s)
+	}
+
+	return
+}
+
+// GenerateSeriesForRelabel generates a float series with both the labels to keep, with their values,
+// and the labels to drop, along with the expected metric once relabeling rules dropping labelsToDrop
+// have been applied to the series.
+func GenerateSeriesForRelabel(name string, ts time.Time, labelsToDrop []string, labelsToKeep map[string]string) (series []prompb.TimeSeries, expectedMetric model.Metric) {
+	expectedMetric = model.Metric{labels.MetricName: model.LabelValue(name)}
+	lbls := []prompb.Label{{Name: labels.MetricName, Value: name}}
+
+	for labelName, labelValue := range labelsToKeep {
+		expectedMetric[model.LabelName(labelName)] = model.LabelValue(labelValue)
+		lbls = append(lbls, prompb.Label{Name: labelName, Value: labelValue})
+	}
+	for _, labelName := range labelsToDrop {
+		lbls = append(lbls, prompb.Label{Name: labelName, Value: "drop"})
+	}
+
+	// Sort the labels, so that the generated series doesn't depend on the map iteration order.
+	slices.SortFunc(lbls, func(a, b prompb.Label) bool { return a.Name < b.Name })
+
+	series = append(series, prompb.TimeSeries{
+		Labels: lbls,
+		Samples: []prompb.Sample{{
+			Value:     rand.Float64(),
+			Timestamp: e2e.TimeToMilliseconds(ts),
+		}},
+	})
+
+	return
+}
+
+// GenerateSeriesDroppedByRelabel generates a float series carrying a label with the value dropLabelValue,
+// along with that label, so that tests can configure a metric relabeling rule with the drop action on it,
+// with the label name as source label and the label value as regex, and confirm the series never
+// appears. The regex of relabeling rules is fully anchored, so dropLabelValue should be quoted with
+// regexp.QuoteMeta in the rule if it contains regexp metacharacters.
+func GenerateSeriesDroppedByRelabel(name string, ts time.Time, dropLabelValue string) (series []prompb.TimeSeries, dropLabel prompb.Label) {
+	dropLabel = prompb.Label{Name: "relabel_drop", Value: dropLabelValue}
+	series, _, _ = generateFloatSeries(name, ts, dropLabel)
+	return
+}
+
+// maxPushRate is the max number of push requests per second sent by pushAtRate, above which the
+// interval between push requests would be rounded down to zero.
+const maxPushRate = int(time.Second)
+
+// pushSeriesAtRate pushes the input series to the distributor service on behalf of the input tenant,
+// sending perSecond push requests per second for the input duration, and returns the number of push
+// requests accepted and rejected, like the ones rejected by the distributor rate limiters. The
+// distributor must be ready in the scenario before the first push request is sent.
+func pushSeriesAtRate(s *e2e.Scenario, distributor *e2e.HTTPService, tenant string, series []prompb.TimeSeries, perSecond int, duration time.Duration) (accepted, rejected int, err error) {
+	if err := s.WaitReady(distributor); err != nil {
+		return 0, 0, err
+	}
+
+	client, err := e2emimir.NewClient(distributor.HTTPEndpoint(), "", "", "", tenant)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return pushAtRate(client, series, perSecond, duration)
+}
+
+// pushAtRate pushes the input series with the client at the pace of perSecond push requests per
+// second for the input duration, and returns the number of push requests accepted and rejected.
+// The rate must be between 1 and maxPushRate push requests per second.
+func pushAtRate(client *e2emimir.Client, series []prompb.TimeSeries, perSecond int, duration time.Duration) (accepted, rejected int, err error) {
+	if perSecond <= 0 || perSecond > maxPushRate {
+		return 0, 0, errors.Errorf("invalid push rate %d per second: it must be between 1 and %d", perSecond, maxPushRate)
+	}
+
+	total := int(duration.Seconds() * float64(perSecond))
+
+	ticker := time.NewTicker(time.Second / time.Duration(perSecond))
+	defer ticker.Stop()
+
+	for i := 0; i < total; i++ {
+		// The first push request is sent immediately.
+		if i > 0 {
+			<-ticker.C
+		}
+
+		res, err := client.Push(series)
+		if err != nil {
+			return accepted, rejected, err
+		}
+
+		if res.StatusCode/100 == 2 {
+			accepted++
+		} else {
+			rejected++
+		}
+	}
+
+	return accepted, rejected, nil
+}
+
+// updateGoldenFilesEnv is the environment variable which, set to true, makes runGoldenQuery regenerate
+// the golden files instead of comparing against them.
+const updateGoldenFilesEnv = "MIMIR_UPDATE_GOLDEN_FILES"
+
+// shouldUpdateGoldenFiles returns whether the golden files should be regenerated, based on updateGoldenFilesEnv.
+func shouldUpdateGoldenFiles() bool {
+	update, _ := strconv.ParseBool(os.Getenv(updateGoldenFilesEnv))
+	return update
+}
+
+// runGoldenQuery runs the input instant query against the querier API of the input service, and compares
+// its JSON response against the content of the golden file. If updateGoldenFilesEnv is set to true,
+// the golden file is overwritten with the JSON response instead.
+func runGoldenQuery(t *testing.T, svc *e2e.HTTPService, query string, goldenPath string) {
+	client, err := e2emimir.NewClient("", svc.HTTPEndpoint(), "", "", userID)
+	require.NoError(t, err)
+
+	runGoldenQueryWithClient(t, client, query, goldenPath)
+}
+
+// runGoldenQueryWithClient runs the input instant query with the client, and compares its JSON
+// response against the content of the golden file, or regenerates it if updateGoldenFilesEnv is set to true.
+func runGoldenQueryWithClient(t *testing.T, client *e2emimir.Client, query string, goldenPath string) {
+	res, body, err := client.QueryRaw(query)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, res.StatusCode, "response body: %s", string(body))
+
+	if shouldUpdateGoldenFiles() {
+		var indented bytes.Buffer
+		require.NoError(t, json.Indent(&indented, body, "", "  "))
+		require.NoError(t, os.MkdirAll(filepath.Dir(goldenPath), os.ModePerm))
+		require.NoError(t, os.WriteFile(goldenPath, append(indented.Bytes(), '\n'), 0o644))
+		return
+	}
+
+	expected, err := os.ReadFile(goldenPath)
+	require.NoError(t, err, "run the test with %s=true to generate the golden file", updateGoldenFilesEnv)
+	assert.JSONEq(t, string(expected), string(body))
+}
+
 // generateNSeriesFunc defines what kind of n * series (and expected vectors) to generate - float samples or native histograms
 type generateNSeriesFunc func(nSeries, nExemplars int, name func() string, ts time.Time, additionalLabels func() []prompb.Label) (series []prompb.TimeSeries, vector model.Vector)
 
@@ -177,6 +1225,22 @@ func GenerateGaugeFloatHistogramSeries(name string, ts time.Time, additionalLabe
 	}, name, ts, additionalLabels...)
 }
 
+// GenerateNaNSumHistogramSeries generates a float histogram series whose sum is NaN, as it happens
+// after observing a NaN value, along with the expected vector and matrix when querying it.
+func GenerateNaNSumHistogramSeries(name string, ts time.Time, additionalLabels ...prompb.Label) (series []prompb.TimeSeries, vector model.Vector, matrix model.Matrix) {
+	series, vector, matrix = generateHistogramSeriesWrapper(func(tsMillis int64, value int) prompb.Histogram {
+		h := generateTestFloatHistogram(value)
+		h.Sum = math.NaN()
+		return remote.FloatHistogramToHistogramProto(tsMillis, h)
+	}, name, ts, additionalLabels...)
+
+	// Only the sum differs from the expected histograms generated by the wrapper.
+	vector[0].Histogram.Sum = model.FloatString(math.NaN())
+	matrix[0].Histograms[0].Histogram.Sum = model.FloatString(math.NaN())
+
+	return
+}
+
 func generateHistogramSeriesWrapper(generateHistogram generateHistogramFunc, name string, ts time.Time, additionalLabels ...prompb.Label) (series []prompb.TimeSeries, vector model.Vector, matrix model.Matrix) {
 	tsMillis := e2e.TimeToMilliseconds(ts)
 
@@ -194,7 +1258,7 @@ func generateHistogramSeriesWrapper(generateHistogram generateHistogramFunc, nam
 		Labels: lbls,
 		Exemplars: []prompb.Exemplar{
 			{Value: float64(value), Timestamp: tsMillis, Labels: []prompb.Label{
-				{Name: "trace_id", Value: "1234"},
+				{Name: "trace_id", Value: DeterministicTraceID(int64(value))},
 			}},
 		},
 		Histograms: []prompb.Histogram{generateHistogram(tsMillis, value)},
@@ -226,6 +1290,191 @@ func generateHistogramSeriesWrapper(generateHistogram generateHistogramFunc, nam
 	return
 }
 
+// GenerateHistogramSeriesOverRange generates a native histogram series with one histogram and one exemplar
+// per step between start and end (both inclusive), along with the expected matrix when querying it and the
+// expected exemplars when querying them over the same range.
+func GenerateHistogramSeriesOverRange(name string, start, end time.Time, step time.Duration, additionalLabels ...prompb.Label) (series []prompb.TimeSeries, matrix model.Matrix, exemplars []promv1.ExemplarQueryResult) {
+	lbls := append(
+		[]prompb.Label{
+			{Name: labels.MetricName, Value: name},
+		},
+		additionalLabels...,
+	)
+
+	metric := model.Metric{}
+	for _, lbl := range lbls {
+		metric[model.LabelName(lbl.Name)] = model.LabelValue(lbl.Value)
+	}
+
+	var (
+		histograms         []prompb.Histogram
+		exemplarsProto     []prompb.Exemplar
+		expectedHistograms []model.SampleHistogramPair
+		expectedExemplars  []promv1.Exemplar
+	)
+	for i, ts := 0, start; !ts.After(end); i, ts = i+1, ts.Add(step) {
+		tsMillis := e2e.TimeToMilliseconds(ts)
+		traceID := DeterministicTraceID(int64(i))
+
+		histograms = append(histograms, remote.HistogramToHistogramProto(tsMillis, generateTestHistogram(i)))
+		exemplarsProto = append(exemplarsProto, prompb.Exemplar{Value: float64(i), Timestamp: tsMillis, Labels: []prompb.Label{
+			{Name: "trace_id", Value: traceID},
+		}})
+
+		expectedHistograms = append(expectedHistograms, model.SampleHistogramPair{
+			Timestamp: model.Time(tsMillis),
+			Histogram: generateTestSampleHistogram(i),
+		})
+		expectedExemplars = append(expectedExemplars, promv1.Exemplar{
+			Labels:    model.LabelSet{"trace_id": model.LabelValue(traceID)},
+			Value:     model.SampleValue(i),
+			Timestamp: model.Time(tsMillis),
+		})
+	}
+
+	series = append(series, prompb.TimeSeries{Labels: lbls, Histograms: histograms, Exemplars: exemplarsProto})
+	matrix = append(matrix, &model.SampleStream{Metric: metric, Histograms: expectedHistograms})
+	exemplars = append(exemplars, promv1.ExemplarQueryResult{SeriesLabels: model.LabelSet(metric), Exemplars: expectedExemplars})
+
+	return
+}
+
+// GenerateSeriesWithExemplarsOverRange generates a float series with one sample and one exemplar per
+// step between start and end (both inclusive), along with the expected exemplars when querying them
+// over the same range. The sample and exemplar at step index i have value i, and the exemplar has the
+// trace ID returned by DeterministicTraceID(i).
+func GenerateSeriesWithExemplarsOverRange(name string, start, end time.Time, step time.Duration) (series []prompb.TimeSeries, exemplars []promv1.ExemplarQueryResult) {
+	var (
+		samples        []prompb.Sample
+		exemplarsProto []prompb.Exemplar
+	)
+	for i, ts := 0, start; !ts.After(end); i, ts = i+1, ts.Add(step) {
+		tsMillis := e2e.TimeToMilliseconds(ts)
+
+		samples = append(samples, prompb.Sample{Value: float64(i), Timestamp: tsMillis})
+		exemplarsProto = append(exemplarsProto, prompb.Exemplar{Value: float64(i), Timestamp: tsMillis, Labels: []prompb.Label{
+			{Name: "trace_id", Value: DeterministicTraceID(int64(i))},
+		}})
+	}
+
+	series = append(series, prompb.TimeSeries{
+		Labels:    []prompb.Label{{Name: labels.MetricName, Value: name}},
+		Samples:   samples,
+		Exemplars: exemplarsProto,
+	})
+
+	return series, ExpectedExemplarResponse(series)
+}
+
+// ExpectedExemplarResponse returns the expected response when querying the exemplars of the input
+// series, once pushed. Series without exemplars are not part of the response.
+func ExpectedExemplarResponse(series []prompb.TimeSeries) []promv1.ExemplarQueryResult {
+	var results []promv1.ExemplarQueryResult
+
+	for _, s := range series {
+		if len(s.Exemplars) == 0 {
+			continue
+		}
+
+		seriesLabels := model.LabelSet{}
+		for _, lbl := range s.Labels {
+			seriesLabels[model.LabelName(lbl.Name)] = model.LabelValue(lbl.Value)
+		}
+
+		exemplars := make([]promv1.Exemplar, 0, len(s.Exemplars))
+		for _, e := range s.Exemplars {
+			exemplarLabels := model.LabelSet{}
+			for _, lbl := range e.Labels {
+				exemplarLabels[model.LabelName(lbl.Name)] = model.LabelValue(lbl.Value)
+			}
+
+			exemplars = append(exemplars, promv1.Exemplar{
+				Labels:    exemplarLabels,
+				Value:     model.SampleValue(e.Value),
+				Timestamp: model.Time(e.Timestamp),
+			})
+		}
+
+		results = append(results, promv1.ExemplarQueryResult{SeriesLabels: seriesLabels, Exemplars: exemplars})
+	}
+
+	return results
+}
+
+// FormatQueryCase is a PromQL query along with its canonical format, as returned by the format query API.
+type FormatQueryCase struct {
+	Query     string
+	Formatted string
+}
+
+// FormatQueryCases returns PromQL queries along with their canonical format, as computed by
+// parser.ParseExpr(query).Pretty(0), for tests of the /prometheus/api/v1/format_query API. The cases
+// cover moving the aggregation grouping, sorting the matchers, trimming whitespaces and splitting long
+// binary expressions over multiple lines.
+func FormatQueryCases() []FormatQueryCase {
+	return []FormatQueryCase{
+		{
+			Query:     `sum(rate(http_requests_total{job="api"}[5m])) by (instance)`,
+			Formatted: `sum by (instance) (rate(http_requests_total{job="api"}[5m]))`,
+		},
+		{
+			Query:     `up{job="api",instance="a"}`,
+			Formatted: `up{instance="a",job="api"}`,
+		},
+		{
+			Query:     `  up   ==   1  `,
+			Formatted: `up == 1`,
+		},
+		{
+			Query:     `sum by (job) (rate(http_requests_total{job="api",status=~"5.."}[5m])) / sum by (job) (rate(http_requests_total{job="api"}[5m]))`,
+			Formatted: "  sum by (job) (rate(http_requests_total{job=\"api\",status=~\"5..\"}[5m]))\n/\n  sum by (job) (rate(http_requests_total{job=\"api\"}[5m]))",
+		},
+	}
+}
+
+// GenerateMixedOOOSeries generates a single series with float samples at baseTS + floatOffsets and
+// histogram samples at baseTS + histOffsets, in the order given, along with the expected matrix when
+// querying it, which has the samples sorted by timestamp. Offsets are expected to not overlap between
+// floats and histograms, because a series can't have both a float and an histogram at the same timestamp.
+func GenerateMixedOOOSeries(name string, baseTS time.Time, floatOffsets, histOffsets []time.Duration) (series []prompb.TimeSeries, matrix model.Matrix) {
+	var (
+		samples            []prompb.Sample
+		histograms         []prompb.Histogram
+		expectedValues     []model.SamplePair
+		expectedHistograms []model.SampleHistogramPair
+	)
+
+	for i, offset := range floatOffsets {
+		tsMillis := e2e.TimeToMilliseconds(baseTS.Add(offset))
+
+		samples = append(samples, prompb.Sample{Value: float64(i), Timestamp: tsMillis})
+		expectedValues = append(expectedValues, model.SamplePair{Timestamp: model.Time(tsMillis), Value: model.SampleValue(i)})
+	}
+
+	for i, offset := range histOffsets {
+		tsMillis := e2e.TimeToMilliseconds(baseTS.Add(offset))
+
+		histograms = append(histograms, remote.HistogramToHistogramProto(tsMillis, generateTestHistogram(i)))
+		expectedHistograms = append(expectedHistograms, model.SampleHistogramPair{Timestamp: model.Time(tsMillis), Histogram: generateTestSampleHistogram(i)})
+	}
+
+	slices.SortFunc(expectedValues, func(a, b model.SamplePair) bool { return a.Timestamp < b.Timestamp })
+	slices.SortFunc(expectedHistograms, func(a, b model.SampleHistogramPair) bool { return a.Timestamp < b.Timestamp })
+
+	series = append(series, prompb.TimeSeries{
+		Labels:     []prompb.Label{{Name: labels.MetricName, Value: name}},
+		Samples:    samples,
+		Histograms: histograms,
+	})
+	matrix = append(matrix, &model.SampleStream{
+		Metric:     model.Metric{labels.MetricName: model.LabelValue(name)},
+		Values:     expectedValues,
+		Histograms: expectedHistograms,
+	})
+
+	return
+}
+
 func GenerateNHistogramSeries(nSeries, nExemplars int, name func() string, ts time.Time, additionalLabels func() []prompb.Label) (series []prompb.TimeSeries, vector model.Vector) {
 	tsMillis := e2e.TimeToMilliseconds(ts)
 
@@ -241,7 +1490,7 @@ func GenerateNHistogramSeries(nSeries, nExemplars int, name func() string, ts ti
 		exemplars := []prompb.Exemplar{}
 		if i < nExemplars {
 			exemplars = []prompb.Exemplar{
-				{Value: float64(i), Timestamp: tsMillis, Labels: []prompb.Label{{Name: "trace_id", Value: "1234"}}},
+				{Value: float64(i), Timestamp: tsMillis, Labels: []prompb.Label{{Name: "trace_id", Value: DeterministicTraceID(int64(i))}}},
 			}
 		}
 
@@ -267,3 +1516,174 @@ func GenerateNHistogramSeries(nSeries, nExemplars int, name func() string, ts ti
 	}
 	return
 }
+
+// ExpectedCountOverTime returns the result Prometheus computes for count_over_time() with the
+// input range duration, evaluated by a range query between start and end with the input step.
+// Both float and histogram samples are counted, and steps without samples in range are omitted.
+func ExpectedCountOverTime(matrix model.Matrix, start, end time.Time, step, rangeDur time.Duration) model.Matrix {
+	result := model.Matrix{}
+
+	for _, stream := range matrix {
+		metric := stream.Metric.Clone()
+		delete(metric, model.MetricNameLabel)
+
+		var values []model.SamplePair
+		for ts := start; !ts.After(end); ts = ts.Add(step) {
+			// The range selector includes both the samples at the start and end of the range.
+			mint, maxt := model.TimeFromUnixNano(ts.Add(-rangeDur).UnixNano()), model.TimeFromUnixNano(ts.UnixNano())
+
+			count := 0
+			for _, v := range stream.Values {
+				if v.Timestamp >= mint && v.Timestamp <= maxt {
+					count++
+				}
+			}
+			for _, h := range stream.Histograms {
+				if h.Timestamp >= mint && h.Timestamp <= maxt {
+					count++
+				}
+			}
+
+			if count > 0 {
+				values = append(values, model.SamplePair{Timestamp: maxt, Value: model.SampleValue(count)})
+			}
+		}
+
+		if len(values) > 0 {
+			result = append(result, &model.SampleStream{Metric: metric, Values: values})
+		}
+	}
+
+	return result
+}
+
+// ExpectedHistogramCountSum returns the values Prometheus computes for histogram_count(h) and
+// histogram_sum(h) on a native histogram.
+func ExpectedHistogramCountSum(h *histogram.FloatHistogram) (count, sum float64) {
+	return h.Count, h.Sum
+}
+
+// ExpectedHistogramQuantile returns the value Prometheus computes for histogram_quantile(q, h)
+// on a native histogram. The implementation mirrors histogramQuantile() in the promql package,
+// which is not exported.
+func ExpectedHistogramQuantile(h *histogram.FloatHistogram, q float64) float64 {
+	if q < 0 {
+		return math.Inf(-1)
+	}
+	if q > 1 {
+		return math.Inf(+1)
+	}
+
+	if h.Count == 0 || math.IsNaN(q) {
+		return math.NaN()
+	}
+
+	var (
+		bucket histogram.Bucket[float64]
+		count  float64
+		it     = h.AllBucketIterator()
+		rank   = q * h.Count
+	)
+	for it.Next() {
+		bucket = it.At()
+		count += bucket.Count
+		if count >= rank {
+			break
+		}
+	}
+	if bucket.Lower < 0 && bucket.Upper > 0 {
+		if len(h.NegativeBuckets) == 0 && len(h.PositiveBuckets) > 0 {
+			// The result is in the zero bucket and the histogram has only
+			// positive buckets. So we consider 0 to be the lower bound.
+			bucket.Lower = 0
+		} else if len(h.PositiveBuckets) == 0 && len(h.NegativeBuckets) > 0 {
+			// The result is in the zero bucket and the histogram has only
+			// negative buckets. So we consider 0 to be the upper bound.
+			bucket.Upper = 0
+		}
+	}
+	// Due to numerical inaccuracies, we could end up with a higher count
+	// than h.Count. Thus, make sure count is never higher than h.Count.
+	if count > h.Count {
+		count = h.Count
+	}
+	// We could have hit the highest bucket without even reaching the rank
+	// (this should only happen if the histogram contains observations of
+	// the value NaN), in which case we simply return the upper limit of the
+	// highest explicit bucket.
+	if count < rank {
+		return bucket.Upper
+	}
+
+	rank -= count - bucket.Count
+	return bucket.Lower + (bucket.Upper-bucket.Lower)*(rank/bucket.Count)
+}
+
+// sampleHistogramTolerance is the max difference between the counts and sum of native histogram
+// samples compared by assertSampleHistogramsEqual, to account for floating point inaccuracies.
+const sampleHistogramTolerance = 1e-9
+
+// assertSampleHistogramsEqual asserts that the two native histogram samples have the same buckets,
+// and that their count, sum and bucket counts differ by at most sampleHistogramTolerance. Unlike
+// comparing the whole samples, the failure message reports which field or bucket differs.
+func assertSampleHistogramsEqual(t assert.TestingT, expected, actual *model.SampleHistogram) bool {
+	if h, ok := t.(interface{ Helper() }); ok {
+		h.Helper()
+	}
+
+	if expected == nil || actual == nil {
+		return assert.Equal(t, expected, actual, "histogram samples")
+	}
+
+	if !assert.InDelta(t, float64(expected.Count), float64(actual.Count), sampleHistogramTolerance, "histogram count") ||
+		!assert.InDelta(t, float64(expected.Sum), float64(actual.Sum), sampleHistogramTolerance, "histogram sum") ||
+		!assert.Len(t, actual.Buckets, len(expected.Buckets), "number of histogram buckets") {
+		return false
+	}
+
+	for i, expectedBucket := range expected.Buckets {
+		actualBucket := actual.Buckets[i]
+
+		if !assert.Equal(t, expectedBucket.Boundaries, actualBucket.Boundaries, "boundaries of histogram bucket %d", i) ||
+			!assert.Equal(t, expectedBucket.Lower, actualBucket.Lower, "lower bound of histogram bucket %d", i) ||
+			!assert.Equal(t, expectedBucket.Upper, actualBucket.Upper, "upper bound of histogram bucket %d", i) ||
+			!assert.InDelta(t, float64(expectedBucket.Count), float64(actualBucket.Count), sampleHistogramTolerance, "count of histogram bucket %d (%s)", i, expectedBucket) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// assertMatricesAlmostEqual asserts that the two matrices have the same series and timestamps, and
+// that float sample values differ by at most tolerance. Histogram samples are compared exactly.
+func assertMatricesAlmostEqual(t assert.TestingT, expected, actual model.Matrix, tolerance float64) bool {
+	if h, ok := t.(interface{ Helper() }); ok {
+		h.Helper()
+	}
+
+	if !assert.Len(t, actual, len(expected), "number of series") {
+		return false
+	}
+
+	for i, expectedSeries := range expected {
+		actualSeries := actual[i]
+
+		if !assert.Equal(t, expectedSeries.Metric, actualSeries.Metric) ||
+			!assert.Len(t, actualSeries.Values, len(expectedSeries.Values), "number of float samples of series %s", expectedSeries.Metric) ||
+			!assert.Equal(t, expectedSeries.Histograms, actualSeries.Histograms, "histogram samples of series %s", expectedSeries.Metric) {
+			return false
+		}
+
+		for j, expectedSample := range expectedSeries.Values {
+			actualSample := actualSeries.Values[j]
+
+			if !assert.Equal(t, expectedSample.Timestamp, actualSample.Timestamp, "timestamp of float sample %d of series %s", j, expectedSeries.Metric) ||
+				!assert.InDelta(t, float64(expectedSample.Value), float64(actualSample.Value), tolerance, "value of float sample %d of series %s", j, expectedSeries.Metric) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,1186 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+//go:build requires_docker
+
+package integration
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	promv1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/histogram"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/relabel"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/atomic"
+
+	"github.com/grafana/mimir/integration/e2emimir"
+)
+
+func TestExpectedHistogramCountSum(t *testing.T) {
+	// The expected values are the ones of the explicitly decoded version of the test histogram.
+	expected := generateTestSampleHistogram(3)
+
+	count, sum := ExpectedHistogramCountSum(generateTestFloatHistogram(3))
+	assert.Equal(t, float64(expected.Count), count)
+	assert.InDelta(t, float64(expected.Sum), sum, 1e-9)
+}
+
+func TestExpectedHistogramQuantile(t *testing.T) {
+	// Buckets (0.5, 1], (1, 2], (2, 4] and (4, 8] with 1, 2, 3 and 4 observations respectively.
+	h := &histogram.FloatHistogram{
+		Schema:          0,
+		ZeroThreshold:   0.001,
+		Count:           10,
+		Sum:             42,
+		PositiveSpans:   []histogram.Span{{Offset: 0, Length: 4}},
+		PositiveBuckets: []float64{1, 2, 3, 4},
+	}
+
+	// The rank of the median is 5, which falls in the (2, 4] bucket after 3 observations,
+	// so the quantile is linearly interpolated 2 observations into that bucket.
+	assert.InDelta(t, 2+2*(2.0/3.0), ExpectedHistogramQuantile(h, 0.5), 1e-9)
+	assert.Equal(t, 8.0, ExpectedHistogramQuantile(h, 1))
+	assert.Equal(t, 0.5, ExpectedHistogramQuantile(h, 0))
+}
+
+func TestDeterministicFloatHistogram(t *testing.T) {
+	h := DeterministicFloatHistogram(42)
+
+	assert.Equal(t, h, DeterministicFloatHistogram(42))
+	assert.NotEqual(t, h, DeterministicFloatHistogram(43))
+
+	count := h.ZeroCount
+	for _, c := range h.PositiveBuckets {
+		count += c
+	}
+	for _, c := range h.NegativeBuckets {
+		count += c
+	}
+	assert.Equal(t, count, h.Count)
+}
+
+func TestExpectedCountOverTime(t *testing.T) {
+	start := time.Unix(1000, 0)
+
+	// A densely sampled series, with a sample every 5s for 10m.
+	_, matrix := GenerateSeriesForChunkCut("test", start, 5*time.Second, 120, prompb.Label{Name: "job", Value: "test"})
+
+	actual := ExpectedCountOverTime(matrix, start, start.Add(10*time.Minute), 2*time.Minute, time.Minute)
+
+	require.Len(t, actual, 1)
+	assert.Equal(t, model.Metric{"job": "test"}, actual[0].Metric)
+	assert.Equal(t, []model.SamplePair{
+		{Timestamp: 1000_000, Value: 1},
+		{Timestamp: 1120_000, Value: 13},
+		{Timestamp: 1240_000, Value: 13},
+		{Timestamp: 1360_000, Value: 13},
+		{Timestamp: 1480_000, Value: 13},
+		{Timestamp: 1600_000, Value: 12},
+	}, actual[0].Values)
+}
+
+func TestGenerateNaNSumHistogramSeries(t *testing.T) {
+	series, vector, matrix := GenerateNaNSumHistogramSeries("test", time.Now())
+
+	require.Len(t, series, 1)
+	require.Len(t, series[0].Histograms, 1)
+	assert.IsType(t, &prompb.Histogram_CountFloat{}, series[0].Histograms[0].GetCount())
+	assert.True(t, math.IsNaN(series[0].Histograms[0].Sum))
+
+	require.Len(t, vector, 1)
+	assert.True(t, math.IsNaN(float64(vector[0].Histogram.Sum)))
+
+	require.Len(t, matrix, 1)
+	require.Len(t, matrix[0].Histograms, 1)
+	assert.True(t, math.IsNaN(float64(matrix[0].Histograms[0].Histogram.Sum)))
+
+	// The rest of the histogram is left untouched.
+	assert.Equal(t, vector[0].Histogram.Count, matrix[0].Histograms[0].Histogram.Count)
+	assert.Equal(t, series[0].Histograms[0].GetCountFloat(), float64(vector[0].Histogram.Count))
+}
+
+func TestGenerateCrossTenantConflictSeries(t *testing.T) {
+	tenants := []string{"tenant-1", "tenant-2", "tenant-3"}
+	seriesPerTenant, federatedVector := GenerateCrossTenantConflictSeries("test", time.Now(), tenants)
+
+	// The same label set is generated for all tenants.
+	require.Len(t, seriesPerTenant, len(tenants))
+	for _, tenantID := range tenants {
+		require.Len(t, seriesPerTenant[tenantID], 1)
+		assert.Equal(t, seriesPerTenant[tenants[0]][0].Labels, seriesPerTenant[tenantID][0].Labels)
+	}
+
+	// Samples of different types are generated for each tenant.
+	assert.Len(t, seriesPerTenant[tenants[0]][0].Samples, 1)
+	assert.Len(t, seriesPerTenant[tenants[1]][0].Histograms, 1)
+
+	// The federated vector contains a sample for each tenant, identified by the tenant label.
+	require.Len(t, federatedVector, len(tenants))
+	for i, tenantID := range tenants {
+		assert.Equal(t, model.Metric{"__name__": "test", "__tenant_id__": model.LabelValue(tenantID)}, federatedVector[i].Metric)
+	}
+	assert.Nil(t, federatedVector[0].Histogram)
+	assert.NotNil(t, federatedVector[1].Histogram)
+}
+
+func TestAssertMatricesAlmostEqual(t *testing.T) {
+	matrixWithValue := func(v float64) model.Matrix {
+		return model.Matrix{{
+			Metric: model.Metric{"__name__": "test"},
+			Values: []model.SamplePair{{Timestamp: 1000, Value: 1}, {Timestamp: 2000, Value: model.SampleValue(v)}},
+		}}
+	}
+
+	expected := matrixWithValue(0.5)
+
+	t.Run("should pass for values within the tolerance", func(t *testing.T) {
+		mockT := &testingTMock{}
+		assert.True(t, assertMatricesAlmostEqual(mockT, expected, matrixWithValue(0.5009), 0.001))
+		assert.False(t, mockT.failed)
+	})
+
+	t.Run("should fail for values just outside the tolerance", func(t *testing.T) {
+		mockT := &testingTMock{}
+		assert.False(t, assertMatricesAlmostEqual(mockT, expected, matrixWithValue(0.5011), 0.001))
+		assert.True(t, mockT.failed)
+	})
+
+	t.Run("should fail for different series", func(t *testing.T) {
+		mockT := &testingTMock{}
+		assert.False(t, assertMatricesAlmostEqual(mockT, expected, model.Matrix{}, 0.001))
+		assert.True(t, mockT.failed)
+	})
+}
+
+// testingTMock records whether an assertion failed, without failing the test.
+type testingTMock struct {
+	failed bool
+}
+
+func (m *testingTMock) Errorf(string, ...interface{}) {
+	m.failed = true
+}
+
+func TestAssertSampleHistogramsEqual(t *testing.T) {
+	histogramWithBucketCount := func(c float64) *model.SampleHistogram {
+		return &model.SampleHistogram{
+			Count: model.FloatString(3 + c),
+			Sum:   10,
+			Buckets: model.HistogramBuckets{
+				{Boundaries: 0, Lower: 0, Upper: 1, Count: 3},
+				{Boundaries: 0, Lower: 1, Upper: 2, Count: model.FloatString(c)},
+			},
+		}
+	}
+
+	t.Run("should pass for equal histograms", func(t *testing.T) {
+		mockT := &testingTMock{}
+		assert.True(t, assertSampleHistogramsEqual(mockT, histogramWithBucketCount(2), histogramWithBucketCount(2)))
+		assert.False(t, mockT.failed)
+	})
+
+	t.Run("should fail for a differing bucket count", func(t *testing.T) {
+		expected := histogramWithBucketCount(2)
+		actual := histogramWithBucketCount(2)
+		actual.Buckets[1].Count = 3
+
+		mockT := &testingTMock{}
+		assert.False(t, assertSampleHistogramsEqual(mockT, expected, actual))
+		assert.True(t, mockT.failed)
+	})
+
+	t.Run("should fail for differing bucket boundaries", func(t *testing.T) {
+		expected := histogramWithBucketCount(2)
+		actual := histogramWithBucketCount(2)
+		actual.Buckets[1].Upper = 4
+
+		mockT := &testingTMock{}
+		assert.False(t, assertSampleHistogramsEqual(mockT, expected, actual))
+		assert.True(t, mockT.failed)
+	})
+}
+
+func TestPushAtRate(t *testing.T) {
+	const acceptedLimit = 6
+
+	// A stub distributor rejecting the push requests exceeding the limit.
+	var requests atomic.Int64
+	var firstRequest, lastRequest atomic.Time
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/v1/push", r.URL.Path)
+		assert.Equal(t, "user-1", r.Header.Get("X-Scope-OrgID"))
+
+		now := time.Now()
+		if requests.Inc() == 1 {
+			firstRequest.Store(now)
+		}
+		lastRequest.Store(now)
+
+		if requests.Load() > acceptedLimit {
+			w.WriteHeader(http.StatusTooManyRequests)
+		}
+	}))
+	t.Cleanup(stub.Close)
+
+	client, err := e2emimir.NewClient(strings.TrimPrefix(stub.URL, "http://"), "", "", "", "user-1")
+	require.NoError(t, err)
+
+	series, _, _ := generateFloatSeries("test", time.Now())
+	accepted, rejected, err := pushAtRate(client, series, 20, 500*time.Millisecond)
+	require.NoError(t, err)
+
+	assert.Equal(t, acceptedLimit, accepted)
+	assert.Equal(t, 10-acceptedLimit, rejected)
+	assert.Equal(t, int64(10), requests.Load())
+
+	// 10 push requests at 20 per second are sent over 450ms.
+	assert.GreaterOrEqual(t, lastRequest.Load().Sub(firstRequest.Load()), 400*time.Millisecond)
+}
+
+func TestPushAtRate_InvalidRate(t *testing.T) {
+	// The client is never used, because the rate is checked before sending any push request.
+	client, err := e2emimir.NewClient("localhost:0", "", "", "", "user-1")
+	require.NoError(t, err)
+
+	series, _, _ := generateFloatSeries("test", time.Now())
+	for _, perSecond := range []int{-1, 0, maxPushRate + 1} {
+		accepted, rejected, err := pushAtRate(client, series, perSecond, time.Second)
+		require.Error(t, err, "rate: %d", perSecond)
+		assert.Zero(t, accepted)
+		assert.Zero(t, rejected)
+	}
+}
+
+func TestRunGoldenQuery(t *testing.T) {
+	const response = `{"status":"success","data":{"resultType":"vector","result":[{"metric":{"__name__":"up"},"value":[1000,"1"]}]}}`
+
+	// A stub querier returning the same response to any query.
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/prometheus/api/v1/query", r.URL.Path)
+		assert.Equal(t, "up", r.URL.Query().Get("query"))
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(response))
+	}))
+	t.Cleanup(stub.Close)
+
+	client, err := e2emimir.NewClient("", strings.TrimPrefix(stub.URL, "http://"), "", "", "user-1")
+	require.NoError(t, err)
+
+	goldenPath := filepath.Join(t.TempDir(), "testdata", "up.golden.json")
+
+	// Generate the golden file.
+	t.Setenv(updateGoldenFilesEnv, "true")
+	runGoldenQueryWithClient(t, client, "up", goldenPath)
+
+	golden, err := os.ReadFile(goldenPath)
+	require.NoError(t, err)
+	assert.JSONEq(t, response, string(golden))
+
+	// Compare the response against the golden file.
+	t.Setenv(updateGoldenFilesEnv, "false")
+	runGoldenQueryWithClient(t, client, "up", goldenPath)
+}
+
+func TestGenerateGappySeries(t *testing.T) {
+	start := time.Unix(1000, 0)
+	step := 30 * time.Second
+
+	series, matrix := GenerateGappySeries("test", start, step, []int{5, 0, 2, 2}, prompb.Label{Name: "job", Value: "test"})
+
+	require.Len(t, series, 1)
+	assert.Equal(t, []prompb.Label{{Name: "__name__", Value: "test"}, {Name: "job", Value: "test"}}, series[0].Labels)
+	assert.Equal(t, []prompb.Sample{
+		{Timestamp: 1000_000, Value: 0},
+		{Timestamp: 1060_000, Value: 2},
+		{Timestamp: 1150_000, Value: 5},
+	}, series[0].Samples)
+
+	require.Len(t, matrix, 1)
+	assert.Equal(t, model.Metric{"__name__": "test", "job": "test"}, matrix[0].Metric)
+	assert.Equal(t, []model.SamplePair{
+		{Timestamp: 1000_000, Value: 0},
+		{Timestamp: 1060_000, Value: 2},
+		{Timestamp: 1150_000, Value: 5},
+	}, matrix[0].Values)
+}
+
+func TestGenerateSeriesForChunkCut(t *testing.T) {
+	start := time.Unix(1000, 0)
+
+	series, matrix := GenerateSeriesForChunkCut("test", start, 15*time.Second, 250, prompb.Label{Name: "job", Value: "test"})
+
+	require.Len(t, series, 1)
+	require.Len(t, series[0].Samples, 250)
+	assert.Equal(t, start.UnixMilli(), series[0].Samples[0].Timestamp)
+	assert.Equal(t, start.Add(249*15*time.Second).UnixMilli(), series[0].Samples[249].Timestamp)
+
+	require.Len(t, matrix, 1)
+	assert.Equal(t, model.Metric{"__name__": "test", "job": "test"}, matrix[0].Metric)
+	require.Len(t, matrix[0].Values, 250)
+	assert.Equal(t, model.SampleValue(249), matrix[0].Values[249].Value)
+}
+
+func TestGenerateWALReplayFixture(t *testing.T) {
+	start := time.Unix(1000, 0)
+
+	series, matrix, checksum := GenerateWALReplayFixture("test", start, 15*time.Second, 200)
+	require.Len(t, series, 1)
+	require.Len(t, series[0].Samples, 200)
+	require.Len(t, matrix, 1)
+	require.Len(t, matrix[0].Values, 200)
+
+	// The checksum is stable for fixed inputs.
+	_, _, sameChecksum := GenerateWALReplayFixture("test", start, 15*time.Second, 200)
+	assert.Equal(t, checksum, sameChecksum)
+	assert.Equal(t, checksum, matrixChecksum(matrix))
+
+	// The checksum changes if any sample differs.
+	matrix[0].Values[100].Value++
+	assert.NotEqual(t, checksum, matrixChecksum(matrix))
+
+	_, _, otherChecksum := GenerateWALReplayFixture("other", start, 15*time.Second, 200)
+	assert.NotEqual(t, checksum, otherChecksum)
+}
+
+func TestGenerateSeriesForRemoteRead(t *testing.T) {
+	start := time.Unix(1000, 0)
+
+	series, matrix := GenerateSeriesForRemoteRead("test", start, start.Add(5*time.Minute), time.Minute)
+
+	require.Len(t, series, 1)
+	require.Len(t, series[0].Samples, 6)
+	assert.Equal(t, prompb.Sample{Timestamp: 1300_000, Value: 5}, series[0].Samples[5])
+
+	require.Len(t, matrix, 1)
+	assert.Equal(t, model.Metric{"__name__": "test"}, matrix[0].Metric)
+	require.Len(t, matrix[0].Values, 6)
+}
+
+func TestBuildRemoteReadRequest(t *testing.T) {
+	start := time.Unix(1000, 0)
+	end := start.Add(time.Hour)
+
+	matchers := []*labels.Matcher{
+		labels.MustNewMatcher(labels.MatchEqual, labels.MetricName, "test"),
+		labels.MustNewMatcher(labels.MatchRegexp, "job", "api|db"),
+	}
+
+	compressed, err := buildRemoteReadRequest(matchers, start, end)
+	require.NoError(t, err)
+
+	data, err := snappy.Decode(nil, compressed)
+	require.NoError(t, err)
+
+	var req prompb.ReadRequest
+	require.NoError(t, proto.Unmarshal(data, &req))
+
+	require.Len(t, req.Queries, 1)
+	assert.Equal(t, start.UnixMilli(), req.Queries[0].StartTimestampMs)
+	assert.Equal(t, end.UnixMilli(), req.Queries[0].EndTimestampMs)
+	assert.Equal(t, []prompb.ReadRequest_ResponseType{prompb.ReadRequest_SAMPLES}, req.AcceptedResponseTypes)
+	assert.Equal(t, []*prompb.LabelMatcher{
+		{Type: prompb.LabelMatcher_EQ, Name: labels.MetricName, Value: "test"},
+		{Type: prompb.LabelMatcher_RE, Name: "job", Value: "api|db"},
+	}, req.Queries[0].Matchers)
+}
+
+func TestGenerateSeriesAcrossDST(t *testing.T) {
+	loc, err := time.LoadLocation("Europe/Berlin")
+	require.NoError(t, err)
+
+	tests := map[string]struct {
+		dstDate              time.Time
+		expectedLocalSamples int
+	}{
+		"spring forward": {
+			dstDate:              time.Date(2023, time.March, 26, 12, 0, 0, 0, loc),
+			expectedLocalSamples: 23,
+		},
+		"fall back": {
+			dstDate:              time.Date(2023, time.October, 29, 12, 0, 0, 0, loc),
+			expectedLocalSamples: 25,
+		},
+		"no DST transition": {
+			dstDate:              time.Date(2023, time.June, 15, 12, 0, 0, 0, loc),
+			expectedLocalSamples: 24,
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			series, utcMatrix, localMatrix := GenerateSeriesAcrossDST("test", loc, testData.dstDate, time.Hour)
+			require.Len(t, series, 1)
+			require.Len(t, utcMatrix, 1)
+			require.Len(t, localMatrix, 1)
+
+			assert.Len(t, utcMatrix[0].Values, 24)
+			assert.Len(t, localMatrix[0].Values, testData.expectedLocalSamples)
+
+			year, month, day := testData.dstDate.Date()
+			assert.Equal(t, time.Date(year, month, day, 0, 0, 0, 0, time.UTC), utcMatrix[0].Values[0].Timestamp.Time().UTC())
+			assert.Equal(t, time.Date(year, month, day, 0, 0, 0, 0, loc), localMatrix[0].Values[0].Timestamp.Time().In(loc))
+			assert.Equal(t, time.Date(year, month, day+1, 0, 0, 0, 0, loc).Add(-time.Hour), localMatrix[0].Values[testData.expectedLocalSamples-1].Timestamp.Time().In(loc))
+		})
+	}
+}
+
+func TestGenerateJitteredSeries(t *testing.T) {
+	start := time.Unix(1000, 0)
+	const (
+		step      = 15 * time.Second
+		maxJitter = 500 * time.Millisecond
+	)
+
+	series, matrix := GenerateJitteredSeries("test", start, step, maxJitter, 100, 1)
+
+	require.Len(t, series, 1)
+	require.Len(t, series[0].Samples, 100)
+	require.Len(t, matrix, 1)
+	require.Len(t, matrix[0].Values, 100)
+
+	jittered := 0
+	for i, sample := range series[0].Samples {
+		ideal := start.Add(time.Duration(i) * step).UnixMilli()
+		assert.LessOrEqual(t, sample.Timestamp, ideal+maxJitter.Milliseconds())
+		assert.GreaterOrEqual(t, sample.Timestamp, ideal-maxJitter.Milliseconds())
+		assert.Equal(t, model.Time(sample.Timestamp), matrix[0].Values[i].Timestamp)
+
+		if sample.Timestamp != ideal {
+			jittered++
+		}
+	}
+	assert.Greater(t, jittered, 0)
+
+	// The same seed generates the same timestamps.
+	sameSeries, _ := GenerateJitteredSeries("test", start, step, maxJitter, 100, 1)
+	assert.Equal(t, series, sameSeries)
+}
+
+func TestGenerateJitteredSeries_NegativeMaxJitter(t *testing.T) {
+	start := time.Unix(1000, 0)
+	const step = 15 * time.Second
+
+	series, matrix := GenerateJitteredSeries("test", start, step, -time.Second, 10, 1)
+
+	require.Len(t, series, 1)
+	require.Len(t, series[0].Samples, 10)
+	for i, sample := range series[0].Samples {
+		assert.Equal(t, start.Add(time.Duration(i)*step).UnixMilli(), sample.Timestamp)
+		assert.Equal(t, model.Time(sample.Timestamp), matrix[0].Values[i].Timestamp)
+	}
+}
+
+func TestGenerateTimestampValueSeries(t *testing.T) {
+	start := time.UnixMilli(1000_500)
+
+	series, matrix := GenerateTimestampValueSeries("test", start, 15*time.Second, 10)
+
+	require.Len(t, series, 1)
+	require.Len(t, series[0].Samples, 10)
+	for i, sample := range series[0].Samples {
+		assert.Equal(t, start.Add(time.Duration(i)*15*time.Second).UnixMilli(), sample.Timestamp)
+		assert.Equal(t, float64(sample.Timestamp)/1000, sample.Value)
+	}
+
+	require.Len(t, matrix, 1)
+	require.Len(t, matrix[0].Values, 10)
+	for _, value := range matrix[0].Values {
+		assert.Equal(t, value.Timestamp.Unix(), int64(value.Value))
+		assert.Equal(t, float64(value.Timestamp)/1000, float64(value.Value))
+	}
+}
+
+func TestGenerateSeriesWithLabelSets(t *testing.T) {
+	series, labelNames, labelValues := GenerateSeriesWithLabelSets("test", time.Now(), []map[string]string{
+		{"job": "b", "pod": "1"},
+		{"job": "a", "instance": "x"},
+		{"job": "b", "pod": "2"},
+	})
+
+	require.Len(t, series, 3)
+	assert.Equal(t, []prompb.Label{{Name: "__name__", Value: "test"}, {Name: "job", Value: "b"}, {Name: "pod", Value: "1"}}, series[0].Labels)
+
+	assert.Equal(t, []string{"__name__", "instance", "job", "pod"}, labelNames)
+	assert.Equal(t, map[string][]string{
+		"__name__": {"test"},
+		"instance": {"x"},
+		"job":      {"a", "b"},
+		"pod":      {"1", "2"},
+	}, labelValues)
+}
+
+func TestGenerateSeriesForLabelNamesAPI(t *testing.T) {
+	series, labelNames, valuesCount := GenerateSeriesForLabelNamesAPI("test", time.Now(), []string{"pod", "job", "instance", "job"})
+
+	require.Len(t, series, 6)
+	assert.Equal(t, []string{"__name__", "instance", "job", "pod"}, labelNames)
+	assert.Equal(t, map[string]int{
+		"__name__": 1,
+		"instance": 1,
+		"job":      2,
+		"pod":      3,
+	}, valuesCount)
+}
+
+func TestGenerateSeriesForSeriesAPI(t *testing.T) {
+	activeStart := time.Unix(10_000, 0)
+	activeEnd := activeStart.Add(30 * time.Minute)
+
+	series, probes := GenerateSeriesForSeriesAPI("test", activeStart, activeEnd)
+
+	require.Len(t, series, 1)
+	assert.Equal(t, []prompb.Label{{Name: "__name__", Value: "test"}}, series[0].Labels)
+	assert.Equal(t, []prompb.Sample{
+		{Value: 1, Timestamp: activeStart.UnixMilli()},
+		{Value: 2, Timestamp: activeEnd.UnixMilli()},
+	}, series[0].Samples)
+
+	for _, probe := range probes {
+		overlaps := !probe.End.Before(activeStart) && !probe.Start.After(activeEnd)
+		assert.Equal(t, overlaps, probe.Included, "probe window [%s, %s]", probe.Start, probe.End)
+	}
+
+	// The series is excluded for a window ending right before activeStart.
+	require.NotEmpty(t, probes)
+	assert.Equal(t, activeStart.Add(-time.Millisecond), probes[0].End)
+	assert.False(t, probes[0].Included)
+}
+
+func TestGenerateSchemaChangingHistogramSeries(t *testing.T) {
+	start := time.Unix(1000, 0)
+	schemas := []int32{3, 3, 2, 0, 1}
+
+	series, matrix := GenerateSchemaChangingHistogramSeries("test", start, time.Minute, schemas)
+
+	require.Len(t, series, 1)
+	require.Len(t, series[0].Histograms, len(schemas))
+	require.Len(t, matrix, 1)
+	require.Len(t, matrix[0].Histograms, len(schemas))
+
+	for i, schema := range schemas {
+		h := series[0].Histograms[i]
+		assert.Equal(t, schema, h.Schema)
+		assert.Equal(t, start.Add(time.Duration(i)*time.Minute).UnixMilli(), h.Timestamp)
+		assert.Equal(t, model.Time(h.Timestamp), matrix[0].Histograms[i].Timestamp)
+	}
+
+	// Bucket boundaries depend on the schema, so the expected histograms differ even if bucket counts don't.
+	assert.NotEqual(t, matrix[0].Histograms[2].Histogram.Buckets[0].Upper, matrix[0].Histograms[3].Histogram.Buckets[0].Upper)
+}
+
+func TestGenerateHistogramSeriesOverRange(t *testing.T) {
+	start := time.Unix(1000, 0)
+	end := start.Add(4 * time.Minute)
+
+	series, matrix, exemplars := GenerateHistogramSeriesOverRange("test", start, end, time.Minute, prompb.Label{Name: "job", Value: "test"})
+
+	const expectedSteps = 5
+
+	require.Len(t, series, 1)
+	require.Len(t, series[0].Histograms, expectedSteps)
+	require.Len(t, series[0].Exemplars, expectedSteps)
+	for i := 0; i < expectedSteps; i++ {
+		assert.Equal(t, start.Add(time.Duration(i)*time.Minute).UnixMilli(), series[0].Histograms[i].Timestamp)
+		assert.Equal(t, series[0].Histograms[i].Timestamp, series[0].Exemplars[i].Timestamp)
+	}
+
+	require.Len(t, matrix, 1)
+	assert.Equal(t, model.Metric{"__name__": "test", "job": "test"}, matrix[0].Metric)
+	require.Len(t, matrix[0].Histograms, expectedSteps)
+
+	require.Len(t, exemplars, 1)
+	assert.Equal(t, model.LabelSet{"__name__": "test", "job": "test"}, exemplars[0].SeriesLabels)
+	require.Len(t, exemplars[0].Exemplars, expectedSteps)
+	for i := 0; i < expectedSteps; i++ {
+		assert.Equal(t, matrix[0].Histograms[i].Timestamp, exemplars[0].Exemplars[i].Timestamp)
+	}
+}
+
+func TestGenerateSeriesWithExemplarsOverRange(t *testing.T) {
+	start := time.Unix(1000, 0)
+	end := start.Add(4 * time.Minute)
+
+	series, exemplars := GenerateSeriesWithExemplarsOverRange("test", start, end, time.Minute)
+
+	const expectedSteps = 5
+
+	require.Len(t, series, 1)
+	require.Len(t, series[0].Samples, expectedSteps)
+	require.Len(t, series[0].Exemplars, expectedSteps)
+
+	require.Len(t, exemplars, 1)
+	assert.Equal(t, model.LabelSet{"__name__": "test"}, exemplars[0].SeriesLabels)
+	require.Len(t, exemplars[0].Exemplars, expectedSteps)
+	for i := 0; i < expectedSteps; i++ {
+		assert.Equal(t, model.TimeFromUnixNano(start.Add(time.Duration(i)*time.Minute).UnixNano()), exemplars[0].Exemplars[i].Timestamp)
+		assert.Equal(t, model.SampleValue(i), exemplars[0].Exemplars[i].Value)
+		assert.Equal(t, model.LabelSet{"trace_id": model.LabelValue(DeterministicTraceID(int64(i)))}, exemplars[0].Exemplars[i].Labels)
+		assert.Equal(t, series[0].Samples[i].Timestamp, series[0].Exemplars[i].Timestamp)
+	}
+}
+
+func TestExpectedExemplarResponse(t *testing.T) {
+	series := []prompb.TimeSeries{
+		{
+			Labels:  []prompb.Label{{Name: "__name__", Value: "test"}, {Name: "job", Value: "test"}},
+			Samples: []prompb.Sample{{Value: 1, Timestamp: 1000}},
+			Exemplars: []prompb.Exemplar{
+				{Value: 1, Timestamp: 1000, Labels: []prompb.Label{{Name: "trace_id", Value: "abc"}}},
+			},
+		},
+		{
+			Labels:  []prompb.Label{{Name: "__name__", Value: "without_exemplars"}},
+			Samples: []prompb.Sample{{Value: 1, Timestamp: 1000}},
+		},
+	}
+
+	assert.Equal(t, []promv1.ExemplarQueryResult{
+		{
+			SeriesLabels: model.LabelSet{"__name__": "test", "job": "test"},
+			Exemplars: []promv1.Exemplar{
+				{Labels: model.LabelSet{"trace_id": "abc"}, Value: 1, Timestamp: 1000},
+			},
+		},
+	}, ExpectedExemplarResponse(series))
+}
+
+func TestGenerateMetadataOnly(t *testing.T) {
+	req, expected := GenerateMetadataOnly([]string{"requests_total", "errors_total"}, prompb.MetricMetadata_COUNTER)
+
+	assert.Empty(t, req.Timeseries)
+	require.Len(t, req.Metadata, 2)
+	require.Len(t, expected, 2)
+
+	for _, metadata := range req.Metadata {
+		assert.Equal(t, prompb.MetricMetadata_COUNTER, metadata.Type)
+		assert.Equal(t, []promv1.Metadata{{Type: promv1.MetricTypeCounter, Help: metadata.Help}}, expected[metadata.MetricFamilyName])
+	}
+}
+
+func TestFormatQueryCases(t *testing.T) {
+	cases := FormatQueryCases()
+	require.NotEmpty(t, cases)
+
+	for _, c := range cases {
+		expr, err := parser.ParseExpr(c.Query)
+		require.NoError(t, err)
+		assert.Equal(t, c.Formatted, expr.Pretty(0))
+
+		// The formatted query is already in the canonical format.
+		expr, err = parser.ParseExpr(c.Formatted)
+		require.NoError(t, err)
+		assert.Equal(t, c.Formatted, expr.Pretty(0))
+	}
+}
+
+func TestGenerateMixedOOOSeries(t *testing.T) {
+	baseTS := time.Unix(1000, 0)
+	floatOffsets := []time.Duration{3 * time.Minute, time.Minute, 5 * time.Minute}
+	histOffsets := []time.Duration{4 * time.Minute, 0, 2 * time.Minute}
+
+	series, matrix := GenerateMixedOOOSeries("test", baseTS, floatOffsets, histOffsets)
+
+	// The samples are pushed in the order given, so they're not sorted.
+	require.Len(t, series, 1)
+	require.Len(t, series[0].Samples, len(floatOffsets))
+	require.Len(t, series[0].Histograms, len(histOffsets))
+	for i, offset := range floatOffsets {
+		assert.Equal(t, baseTS.Add(offset).UnixMilli(), series[0].Samples[i].Timestamp)
+	}
+	for i, offset := range histOffsets {
+		assert.Equal(t, baseTS.Add(offset).UnixMilli(), series[0].Histograms[i].Timestamp)
+	}
+
+	// The expected samples are sorted by timestamp.
+	require.Len(t, matrix, 1)
+	assert.Equal(t, model.Metric{"__name__": "test"}, matrix[0].Metric)
+	assert.Equal(t, []model.SamplePair{
+		{Timestamp: model.Time(baseTS.Add(time.Minute).UnixMilli()), Value: 1},
+		{Timestamp: model.Time(baseTS.Add(3 * time.Minute).UnixMilli()), Value: 0},
+		{Timestamp: model.Time(baseTS.Add(5 * time.Minute).UnixMilli()), Value: 2},
+	}, matrix[0].Values)
+	require.Len(t, matrix[0].Histograms, len(histOffsets))
+	assert.Equal(t, model.Time(baseTS.UnixMilli()), matrix[0].Histograms[0].Timestamp)
+	assert.Equal(t, model.Time(baseTS.Add(2*time.Minute).UnixMilli()), matrix[0].Histograms[1].Timestamp)
+	assert.Equal(t, model.Time(baseTS.Add(4*time.Minute).UnixMilli()), matrix[0].Histograms[2].Timestamp)
+}
+
+func TestGenerateNegativeBucketHistogramSeries(t *testing.T) {
+	series, vector, matrix := GenerateNegativeBucketHistogramSeries("test", time.Now())
+
+	require.Len(t, series, 1)
+	require.Len(t, series[0].Histograms, 1)
+	h := series[0].Histograms[0]
+	assert.Empty(t, h.PositiveSpans)
+	assert.Empty(t, h.PositiveDeltas)
+	assert.NotEmpty(t, h.NegativeSpans)
+	assert.NotEmpty(t, h.NegativeDeltas)
+
+	// All the buckets of the expected histogram are negative.
+	require.Len(t, vector, 1)
+	require.NotNil(t, vector[0].Histogram)
+	require.Len(t, vector[0].Histogram.Buckets, 3)
+	for _, b := range vector[0].Histogram.Buckets {
+		assert.LessOrEqual(t, float64(b.Upper), float64(0))
+	}
+	assert.Equal(t, model.FloatString(6), vector[0].Histogram.Count)
+
+	require.Len(t, matrix, 1)
+	require.Len(t, matrix[0].Histograms, 1)
+	assert.Equal(t, vector[0].Histogram, matrix[0].Histograms[0].Histogram)
+}
+
+func TestGenerateReservedLabelSeries(t *testing.T) {
+	series := GenerateReservedLabelSeries("test", time.Now(), "__reserved__")
+
+	require.Len(t, series, 1)
+	assert.Contains(t, series[0].Labels, prompb.Label{Name: "__name__", Value: "test"})
+	assert.Contains(t, series[0].Labels, prompb.Label{Name: "__reserved__", Value: "reserved"})
+	assert.Len(t, series[0].Samples, 1)
+}
+
+func TestGenerateSeriesAtAcceptanceBoundary(t *testing.T) {
+	now := time.UnixMilli(1_700_000_000_123).Add(456 * time.Microsecond)
+
+	futureSeries, pastSeries := GenerateSeriesAtAcceptanceBoundary("test", now, 10*time.Minute, time.Hour)
+
+	require.Len(t, futureSeries, 1)
+	assert.Contains(t, futureSeries[0].Labels, prompb.Label{Name: "boundary", Value: "future"})
+	require.Len(t, futureSeries[0].Samples, 1)
+	assert.Equal(t, int64(1_700_000_000_123+10*60*1000), futureSeries[0].Samples[0].Timestamp)
+
+	require.Len(t, pastSeries, 1)
+	assert.Contains(t, pastSeries[0].Labels, prompb.Label{Name: "boundary", Value: "past"})
+	require.Len(t, pastSeries[0].Samples, 1)
+	assert.Equal(t, int64(1_700_000_000_123-60*60*1000), pastSeries[0].Samples[0].Timestamp)
+}
+
+func TestGenerateFloatSeriesWithExemplarBurst(t *testing.T) {
+	ts := time.Now()
+	series := GenerateFloatSeriesWithExemplarBurst("test", ts, 100)
+
+	require.Len(t, series, 1)
+	require.Len(t, series[0].Samples, 1)
+	require.Len(t, series[0].Exemplars, 100)
+
+	traceIDs := map[string]struct{}{}
+	for _, e := range series[0].Exemplars {
+		assert.Equal(t, series[0].Samples[0].Timestamp, e.Timestamp)
+		require.Len(t, e.Labels, 1)
+		traceIDs[e.Labels[0].Value] = struct{}{}
+	}
+
+	// Each exemplar has a distinct trace ID, so that none of them is a duplicate.
+	assert.Len(t, traceIDs, 100)
+}
+
+func TestGenerateUpSeries(t *testing.T) {
+	start := time.Unix(1000, 0)
+
+	series, matrix := GenerateUpSeries("test", "localhost:9090", start, 15*time.Second, 3, 2)
+
+	require.Len(t, series, 1)
+	assert.Equal(t, []prompb.Label{
+		{Name: "__name__", Value: "up"},
+		{Name: "instance", Value: "localhost:9090"},
+		{Name: "job", Value: "test"},
+	}, series[0].Labels)
+	require.Len(t, series[0].Samples, 5)
+
+	require.Len(t, matrix, 1)
+	assert.Equal(t, model.Metric{"__name__": "up", "instance": "localhost:9090", "job": "test"}, matrix[0].Metric)
+	require.Len(t, matrix[0].Values, 5)
+
+	// The target goes down at step index 3.
+	for i, expected := range []model.SampleValue{1, 1, 1, 0, 0} {
+		assert.Equal(t, float64(expected), series[0].Samples[i].Value)
+		assert.Equal(t, start.Add(time.Duration(i)*15*time.Second).UnixMilli(), series[0].Samples[i].Timestamp)
+		assert.Equal(t, expected, matrix[0].Values[i].Value)
+	}
+}
+
+func TestGenerateSeriesForAllShards(t *testing.T) {
+	const totalShards = 16
+
+	seriesPerShard := GenerateSeriesForAllShards("test", time.Now(), totalShards)
+
+	require.Len(t, seriesPerShard, totalShards)
+	for shard := 0; shard < totalShards; shard++ {
+		require.NotEmpty(t, seriesPerShard[shard], "shard %d", shard)
+
+		for _, s := range seriesPerShard[shard] {
+			lbls := make([]labels.Label, 0, len(s.Labels))
+			for _, lbl := range s.Labels {
+				lbls = append(lbls, labels.Label{Name: lbl.Name, Value: lbl.Value})
+			}
+			assert.Equal(t, uint64(shard), labels.StableHash(labels.New(lbls...))%totalShards)
+		}
+	}
+}
+
+func TestGenerateShardedExpectation(t *testing.T) {
+	const totalShards = 8
+
+	series, partials, merged := GenerateShardedExpectation("test", time.Now(), totalShards)
+
+	require.Len(t, partials, totalShards)
+	require.Len(t, merged, 1)
+	require.GreaterOrEqual(t, len(series), totalShards)
+
+	partialsSum := 0.0
+	for shard, partial := range partials {
+		require.Len(t, partial, 1, "shard %d", shard)
+		assert.Equal(t, merged[0].Timestamp, partial[0].Timestamp)
+		partialsSum += float64(partial[0].Value)
+	}
+	assert.InDelta(t, float64(merged[0].Value), partialsSum, 1e-9)
+	assert.Equal(t, model.Metric{}, merged[0].Metric)
+	assert.Equal(t, model.Time(series[0].Samples[0].Timestamp), merged[0].Timestamp)
+}
+
+func TestGenerateHashmodColliders(t *testing.T) {
+	const (
+		modulus = 8
+		target  = 3
+		count   = 10
+	)
+
+	series, err := GenerateHashmodColliders("test", time.Now(), modulus, target, count)
+	require.NoError(t, err)
+	require.Len(t, series, count)
+
+	cfg := &relabel.Config{
+		SourceLabels: model.LabelNames{"instance"},
+		Separator:    relabel.DefaultRelabelConfig.Separator,
+		Regex:        relabel.DefaultRelabelConfig.Regex,
+		Modulus:      modulus,
+		TargetLabel:  "shard",
+		Action:       relabel.HashMod,
+	}
+
+	instances := map[string]struct{}{}
+	for _, s := range series {
+		lbls := make([]labels.Label, 0, len(s.Labels))
+		for _, lbl := range s.Labels {
+			lbls = append(lbls, labels.Label{Name: lbl.Name, Value: lbl.Value})
+		}
+
+		relabeled, keep := relabel.Process(labels.New(lbls...), cfg)
+		require.True(t, keep)
+		assert.Equal(t, fmt.Sprintf("%d", target), relabeled.Get("shard"))
+		instances[relabeled.Get("instance")] = struct{}{}
+	}
+	assert.Len(t, instances, count)
+
+	_, err = GenerateHashmodColliders("test", time.Now(), modulus, modulus, count)
+	require.Error(t, err)
+}
+
+func TestDeterministicTraceID(t *testing.T) {
+	id := DeterministicTraceID(1)
+	assert.Regexp(t, "^[0-9a-f]{32}$", id)
+
+	// The same seed produces the same trace ID.
+	assert.Equal(t, id, DeterministicTraceID(1))
+
+	// Different seeds produce different trace IDs.
+	assert.NotEqual(t, id, DeterministicTraceID(2))
+}
+
+func TestGenerateThresholdCrossingSeries(t *testing.T) {
+	start := time.Unix(1000, 0)
+	values := []float64{1, 5, 10, 10.5, 3, 11, 10}
+
+	series, aboveThresholdSteps := GenerateThresholdCrossingSeries("test", start, time.Minute, values, 10)
+
+	require.Len(t, series, 1)
+	require.Len(t, series[0].Samples, len(values))
+	for i, value := range values {
+		assert.Equal(t, prompb.Sample{Value: value, Timestamp: start.Add(time.Duration(i) * time.Minute).UnixMilli()}, series[0].Samples[i])
+	}
+
+	// Values equal to the threshold are not above it.
+	assert.Equal(t, []int{3, 5}, aboveThresholdSteps)
+}
+
+func TestGenerateSeriesForAvgOverTime(t *testing.T) {
+	start := time.Unix(1000, 0)
+	values := []float64{1, 2, 4, 8, 0.5, -3}
+
+	series, expected := GenerateSeriesForAvgOverTime("test", start, 15*time.Second, values)
+
+	require.Len(t, series, 1)
+	assert.Equal(t, []prompb.Label{{Name: "__name__", Value: "test"}}, series[0].Labels)
+	require.Len(t, series[0].Samples, len(values))
+
+	// Compute the average from the generated samples, as avg_over_time() would do.
+	sum := 0.0
+	for i, sample := range series[0].Samples {
+		assert.Equal(t, start.Add(time.Duration(i)*15*time.Second).UnixMilli(), sample.Timestamp)
+		sum += sample.Value
+	}
+
+	require.Len(t, expected, 1)
+	assert.Equal(t, model.Metric{}, expected[0].Metric)
+	assert.InDelta(t, sum/float64(len(values)), float64(expected[0].Value), 1e-9)
+	assert.InDelta(t, 2.083333333, float64(expected[0].Value), 1e-9)
+	assert.Equal(t, model.Time(start.Add(75*time.Second).UnixMilli()), expected[0].Timestamp)
+}
+
+func TestExpectedDelta(t *testing.T) {
+	start := time.Unix(1000, 0)
+
+	// A linearly-increasing gauge, whose value increases by 1 every 15s.
+	_, matrix := GenerateSeriesForChunkCut("test", start, 15*time.Second, 21, prompb.Label{Name: "job", Value: "gauge"})
+
+	t.Run("range covering exactly the samples", func(t *testing.T) {
+		// The first sample is included, because it sits exactly on the start of the closed range.
+		// The difference between the first and last samples is the slope of the gauge times the range.
+		vector := ExpectedDelta(matrix, 300)
+
+		require.Len(t, vector, 1)
+		assert.Equal(t, model.Metric{"job": "gauge"}, vector[0].Metric)
+		assert.InDelta(t, 20, float64(vector[0].Value), 1e-9)
+		assert.Equal(t, model.Time(start.Add(300*time.Second).UnixMilli()), vector[0].Timestamp)
+	})
+
+	t.Run("range exceeding the samples", func(t *testing.T) {
+		// The extrapolation before the first sample is limited to half of the interval between samples.
+		vector := ExpectedDelta(matrix, 600)
+
+		require.Len(t, vector, 1)
+		assert.InDelta(t, 20*307.5/300, float64(vector[0].Value), 1e-9)
+	})
+
+	t.Run("range with a single sample", func(t *testing.T) {
+		assert.Empty(t, ExpectedDelta(matrix, 10))
+	})
+
+	t.Run("non-linear gauge with a sample at the start of the range", func(t *testing.T) {
+		// The gauge jumps right after the first sample, so dropping the sample at the start of
+		// the range would give a very different result: (12-10) * 45/30 = 3.
+		nonLinear := model.Matrix{{
+			Metric: model.Metric{"__name__": "test", "job": "gauge"},
+			Values: []model.SamplePair{
+				{Timestamp: model.Time(start.UnixMilli()), Value: 0},
+				{Timestamp: model.Time(start.Add(15 * time.Second).UnixMilli()), Value: 10},
+				{Timestamp: model.Time(start.Add(30 * time.Second).UnixMilli()), Value: 11},
+				{Timestamp: model.Time(start.Add(45 * time.Second).UnixMilli()), Value: 12},
+			},
+		}}
+
+		vector := ExpectedDelta(nonLinear, 45)
+
+		require.Len(t, vector, 1)
+		assert.Equal(t, model.Metric{"job": "gauge"}, vector[0].Metric)
+		assert.InDelta(t, 12, float64(vector[0].Value), 1e-9)
+	})
+}
+
+func TestGenerateOverflowCounterSeries(t *testing.T) {
+	start := time.Unix(1000, 0)
+
+	series, resetSteps := GenerateOverflowCounterSeries("test_total", start, 15*time.Second)
+
+	require.Len(t, series, 1)
+	assert.Equal(t, []prompb.Label{{Name: "__name__", Value: "test_total"}}, series[0].Labels)
+	require.Len(t, series[0].Samples, 10)
+
+	// The counter wraps past the uint64 boundary once, midway.
+	assert.Equal(t, []int{5}, resetSteps)
+	assert.Greater(t, series[0].Samples[4].Value, float64(math.MaxUint64-1e15))
+	assert.Less(t, series[0].Samples[5].Value, float64(1e15))
+
+	for i, sample := range series[0].Samples {
+		assert.Equal(t, start.Add(time.Duration(i)*15*time.Second).UnixMilli(), sample.Timestamp)
+		if i > 0 && i != 5 {
+			assert.Greater(t, sample.Value, series[0].Samples[i-1].Value)
+		}
+	}
+}
+
+func TestGenerateMixedBatch(t *testing.T) {
+	series, vector := GenerateMixedBatch("test", time.Now(), 6)
+
+	require.Len(t, series, 6)
+	require.Len(t, vector, 6)
+
+	var floats, histograms, floatHistograms, gaugeHistograms, gaugeFloatHistograms int
+	for _, s := range series {
+		if len(s.Samples) > 0 {
+			floats++
+			continue
+		}
+
+		require.Len(t, s.Histograms, 1)
+		h := s.Histograms[0]
+		_, isFloat := h.GetCount().(*prompb.Histogram_CountFloat)
+		isGauge := h.ResetHint == prompb.Histogram_GAUGE
+
+		switch {
+		case isGauge && isFloat:
+			gaugeFloatHistograms++
+		case isGauge:
+			gaugeHistograms++
+		case isFloat:
+			floatHistograms++
+		default:
+			histograms++
+		}
+	}
+
+	assert.GreaterOrEqual(t, floats, 1)
+	assert.GreaterOrEqual(t, histograms, 1)
+	assert.GreaterOrEqual(t, floatHistograms, 1)
+	assert.GreaterOrEqual(t, gaugeHistograms, 1)
+	assert.GreaterOrEqual(t, gaugeFloatHistograms, 1)
+
+	for i, sample := range vector {
+		assert.Equal(t, model.LabelValue(fmt.Sprintf("test_%d", i)), sample.Metric["__name__"])
+	}
+}
+
+func TestGenerateSeriesToHitLimit(t *testing.T) {
+	series := GenerateSeriesToHitLimit("test", time.Now(), 10)
+
+	require.Len(t, series, 11)
+
+	// All the series are distinct.
+	names := map[string]struct{}{}
+	for _, s := range series {
+		require.Len(t, s.Labels, 1)
+		names[s.Labels[0].Value] = struct{}{}
+	}
+	assert.Len(t, names, 11)
+}
+
+func TestGenerateActiveSeries(t *testing.T) {
+	series, expectedCount, err := GenerateActiveSeries("test", time.Now(), 10, `{job="test", env="prod"}`)
+	require.NoError(t, err)
+	require.Len(t, series, 10)
+	assert.Equal(t, 10, expectedCount)
+
+	matchers, err := parser.ParseMetricSelector(`{job="test", env="prod"}`)
+	require.NoError(t, err)
+
+	names := map[string]struct{}{}
+	for _, s := range series {
+		lbls := map[string]string{}
+		for _, lbl := range s.Labels {
+			lbls[lbl.Name] = lbl.Value
+		}
+		for _, m := range matchers {
+			assert.True(t, m.Matches(lbls[m.Name]), "series %v doesn't match %s", s.Labels, m)
+		}
+		names[lbls["__name__"]] = struct{}{}
+	}
+	assert.Len(t, names, 10)
+
+	// Only the series matching all the matchers are expected to be returned.
+	_, expectedCount, err = GenerateActiveSeries("test", time.Now(), 10, `{__name__=~"test_[0-4]", job="test"}`)
+	require.NoError(t, err)
+	assert.Equal(t, 5, expectedCount)
+
+	_, expectedCount, err = GenerateActiveSeries("test", time.Now(), 10, `{job="test", env!="prod", pod=~".+"}`)
+	require.NoError(t, err)
+	assert.Equal(t, 0, expectedCount)
+
+	_, _, err = GenerateActiveSeries("test", time.Now(), 10, `{job=`)
+	assert.Error(t, err)
+}
+
+func TestGenerateHighCardinalityLabelSeries(t *testing.T) {
+	series := GenerateHighCardinalityLabelSeries("test", time.Now(), "pod", 50)
+
+	require.Len(t, series, 50)
+
+	values := map[string]struct{}{}
+	for _, s := range series {
+		// The series differ only in the value of the label.
+		require.Len(t, s.Labels, 2)
+		assert.Equal(t, prompb.Label{Name: "__name__", Value: "test"}, s.Labels[0])
+		assert.Equal(t, "pod", s.Labels[1].Name)
+		values[s.Labels[1].Value] = struct{}{}
+	}
+	assert.Len(t, values, 50)
+}
+
+func TestGenerateLongLabelValueSeries(t *testing.T) {
+	series := GenerateLongLabelValueSeries("test", time.Now(), "pod", 2049)
+
+	require.Len(t, series, 1)
+	require.Len(t, series[0].Labels, 2)
+	assert.Equal(t, prompb.Label{Name: "__name__", Value: "test"}, series[0].Labels[0])
+	assert.Equal(t, "pod", series[0].Labels[1].Name)
+	assert.Len(t, series[0].Labels[1].Value, 2049)
+}
+
+func TestGenerateHASeries(t *testing.T) {
+	series, vector, matrix := GenerateHASeries("test", time.Now(), "cluster-1", "replica-1", prompb.Label{Name: "job", Value: "test"})
+
+	require.Len(t, series, 1)
+	assert.Contains(t, series[0].Labels, prompb.Label{Name: "cluster", Value: "cluster-1"})
+	assert.Contains(t, series[0].Labels, prompb.Label{Name: "__replica__", Value: "replica-1"})
+	assert.Contains(t, series[0].Labels, prompb.Label{Name: "job", Value: "test"})
+
+	// The replica label is removed by the HA tracker, so it's not expected when querying.
+	expectedMetric := model.Metric{"__name__": "test", "cluster": "cluster-1", "job": "test"}
+	require.Len(t, vector, 1)
+	assert.Equal(t, expectedMetric, vector[0].Metric)
+	require.Len(t, matrix, 1)
+	assert.Equal(t, expectedMetric, matrix[0].Metric)
+}
+
+func TestGenerateHASeriesForReplicas(t *testing.T) {
+	first, second, vector, _ := GenerateHASeriesForReplicas("test", time.Now(), "cluster-1", "replica-1", "replica-2")
+
+	require.Len(t, first, 1)
+	require.Len(t, second, 1)
+	assert.Contains(t, first[0].Labels, prompb.Label{Name: "__replica__", Value: "replica-1"})
+	assert.Contains(t, second[0].Labels, prompb.Label{Name: "__replica__", Value: "replica-2"})
+	assert.Contains(t, second[0].Labels, prompb.Label{Name: "cluster", Value: "cluster-1"})
+	assert.Equal(t, first[0].Samples, second[0].Samples)
+	require.Len(t, vector, 1)
+}
+
+func TestGenerateSeriesDroppedByRelabel(t *testing.T) {
+	series, dropLabel := GenerateSeriesDroppedByRelabel("test", time.Now(), "dropped")
+
+	assert.Equal(t, prompb.Label{Name: "relabel_drop", Value: "dropped"}, dropLabel)
+	require.Len(t, series, 1)
+	assert.Contains(t, series[0].Labels, prompb.Label{Name: "__name__", Value: "test"})
+	assert.Contains(t, series[0].Labels, dropLabel)
+	assert.Len(t, series[0].Samples, 1)
+}
+
+func TestGenerateSeriesForRelabel(t *testing.T) {
+	series, expectedMetric := GenerateSeriesForRelabel("test", time.Now(), []string{"pod", "instance"}, map[string]string{"job": "test", "cluster": "cluster-1"})
+
+	require.Len(t, series, 1)
+	assert.Equal(t, []prompb.Label{
+		{Name: "__name__", Value: "test"},
+		{Name: "cluster", Value: "cluster-1"},
+		{Name: "instance", Value: "drop"},
+		{Name: "job", Value: "test"},
+		{Name: "pod", Value: "drop"},
+	}, series[0].Labels)
+	assert.Len(t, series[0].Samples, 1)
+
+	// The labels to drop are not expected once relabeling has been applied.
+	assert.Equal(t, model.Metric{"__name__": "test", "cluster": "cluster-1", "job": "test"}, expectedMetric)
+}
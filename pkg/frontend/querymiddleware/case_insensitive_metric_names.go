@@ -0,0 +1,105 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package querymiddleware
+
+import (
+	"context"
+	"regexp"
+
+	"github.com/grafana/dskit/tenant"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+
+	apierror "github.com/grafana/mimir/pkg/api/error"
+	"github.com/grafana/mimir/pkg/util/validation"
+)
+
+type caseInsensitiveMetricNamesMiddleware struct {
+	next             Handler
+	limits           Limits
+	rewrittenQueries prometheus.Counter
+}
+
+// newCaseInsensitiveMetricNamesMiddleware creates a middleware that, for tenants enabling it, rewrites
+// the equality matchers on the metric name to regexp matchers matching the metric name case-insensitively.
+// This changes the semantics of the query, so it's strictly opt-in: queries for multiple tenants are
+// rewritten only if all the tenants enable it.
+func newCaseInsensitiveMetricNamesMiddleware(limits Limits, reg prometheus.Registerer) Middleware {
+	rewrittenQueries := promauto.With(reg).NewCounter(prometheus.CounterOpts{
+		Name: "cortex_query_frontend_case_insensitive_metric_names_rewritten_queries_total",
+		Help: "Total queries whose metric name equality matchers have been rewritten to match the metric name case-insensitively.",
+	})
+
+	return MiddlewareFunc(func(next Handler) Handler {
+		return caseInsensitiveMetricNamesMiddleware{
+			next:             next,
+			limits:           limits,
+			rewrittenQueries: rewrittenQueries,
+		}
+	})
+}
+
+func (m caseInsensitiveMetricNamesMiddleware) Do(ctx context.Context, r Request) (Response, error) {
+	tenantIDs, err := tenant.TenantIDs(ctx)
+	if err != nil {
+		return nil, apierror.New(apierror.TypeBadData, err.Error())
+	}
+
+	if !validation.AllTrueBooleansPerTenant(tenantIDs, m.limits.CaseInsensitiveMetricNames) {
+		return m.next.Do(ctx, r)
+	}
+
+	expr, err := parser.ParseExpr(r.GetQuery())
+	if err != nil {
+		// Let the downstream handlers report the parsing error.
+		return m.next.Do(ctx, r)
+	}
+
+	rewritten, err := rewriteMetricNameMatchersCaseInsensitive(expr)
+	if err != nil {
+		return nil, apierror.New(apierror.TypeBadData, err.Error())
+	}
+	if !rewritten {
+		return m.next.Do(ctx, r)
+	}
+
+	m.rewrittenQueries.Inc()
+	return m.next.Do(ctx, r.WithQuery(expr.String()))
+}
+
+// rewriteMetricNameMatchersCaseInsensitive rewrites, in place, the non-empty equality matchers on the
+// metric name of the input expression to regexp matchers matching the same metric name case-insensitively.
+// Returns whether any matcher has been rewritten.
+func rewriteMetricNameMatchersCaseInsensitive(expr parser.Expr) (bool, error) {
+	rewritten := false
+	var rewriteErr error
+
+	parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+		selector, ok := node.(*parser.VectorSelector)
+		if !ok {
+			return nil
+		}
+
+		for i, matcher := range selector.LabelMatchers {
+			if matcher.Name != labels.MetricName || matcher.Type != labels.MatchEqual || matcher.Value == "" {
+				continue
+			}
+
+			caseInsensitive, err := labels.NewMatcher(labels.MatchRegexp, labels.MetricName, "(?i)"+regexp.QuoteMeta(matcher.Value))
+			if err != nil {
+				rewriteErr = err
+				return err
+			}
+
+			selector.LabelMatchers[i] = caseInsensitive
+			// The metric name is printed from the selector name, so it has to be cleared to print the regexp matcher instead.
+			selector.Name = ""
+			rewritten = true
+		}
+		return nil
+	})
+
+	return rewritten, rewriteErr
+}
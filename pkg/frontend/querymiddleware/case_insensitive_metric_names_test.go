@@ -0,0 +1,117 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package querymiddleware
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/grafana/dskit/tenant"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/common/user"
+)
+
+func TestCaseInsensitiveMetricNamesMiddleware(t *testing.T) {
+	enabled := mockLimits{caseInsensitiveMetricNames: true}
+
+	tests := map[string]struct {
+		orgID         string
+		limits        Limits
+		query         string
+		expectedQuery string
+	}{
+		"should rewrite the metric name when enabled": {
+			orgID:         "test1",
+			limits:        enabled,
+			query:         "up",
+			expectedQuery: `{__name__=~"(?i)up"}`,
+		},
+		"should rewrite the metric name of every selector, preserving the other matchers": {
+			orgID:         "test1",
+			limits:        enabled,
+			query:         `sum(rate(http_requests_total{job="test"}[5m])) / sum(rate(HTTP_Requests_Total[5m]))`,
+			expectedQuery: `sum(rate({__name__=~"(?i)http_requests_total",job="test"}[5m])) / sum(rate({__name__=~"(?i)HTTP_Requests_Total"}[5m]))`,
+		},
+		"should not rewrite regexp matchers on the metric name": {
+			orgID:         "test1",
+			limits:        enabled,
+			query:         `{__name__=~"up|down"}`,
+			expectedQuery: `{__name__=~"up|down"}`,
+		},
+		"should not rewrite the query when disabled": {
+			orgID:         "test1",
+			limits:        mockLimits{},
+			query:         `sum(up{job="test"})`,
+			expectedQuery: `sum(up{job="test"})`,
+		},
+		"should not rewrite the query when disabled for any of the tenants": {
+			orgID: "test1|test2",
+			limits: multiTenantMockLimits{byTenant: map[string]mockLimits{
+				"test1": {caseInsensitiveMetricNames: true},
+				"test2": {caseInsensitiveMetricNames: false},
+			}},
+			query:         "up",
+			expectedQuery: "up",
+		},
+		"should rewrite the query when enabled for all the tenants": {
+			orgID: "test1|test2",
+			limits: multiTenantMockLimits{byTenant: map[string]mockLimits{
+				"test1": {caseInsensitiveMetricNames: true},
+				"test2": {caseInsensitiveMetricNames: true},
+			}},
+			query:         "up",
+			expectedQuery: `{__name__=~"(?i)up"}`,
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			tenant.WithDefaultResolver(tenant.NewMultiResolver())
+
+			var actual Request
+			next := HandlerFunc(func(_ context.Context, req Request) (Response, error) {
+				actual = req
+				return &PrometheusResponse{Status: statusSuccess}, nil
+			})
+
+			reg := prometheus.NewPedanticRegistry()
+			ctx := user.InjectOrgID(context.Background(), testData.orgID)
+			_, err := newCaseInsensitiveMetricNamesMiddleware(testData.limits, reg).Wrap(next).Do(ctx, &PrometheusInstantQueryRequest{Query: testData.query})
+			require.NoError(t, err)
+			assert.Equal(t, testData.expectedQuery, actual.GetQuery())
+
+			expectedRewritten := 0
+			if testData.expectedQuery != testData.query {
+				expectedRewritten = 1
+			}
+			assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(fmt.Sprintf(`
+				# HELP cortex_query_frontend_case_insensitive_metric_names_rewritten_queries_total Total queries whose metric name equality matchers have been rewritten to match the metric name case-insensitively.
+				# TYPE cortex_query_frontend_case_insensitive_metric_names_rewritten_queries_total counter
+				cortex_query_frontend_case_insensitive_metric_names_rewritten_queries_total %d
+			`, expectedRewritten)), "cortex_query_frontend_case_insensitive_metric_names_rewritten_queries_total"))
+		})
+	}
+}
+
+func TestRewriteMetricNameMatchersCaseInsensitive(t *testing.T) {
+	expr, err := parser.ParseExpr("http_requests_total")
+	require.NoError(t, err)
+
+	rewritten, err := rewriteMetricNameMatchersCaseInsensitive(expr)
+	require.NoError(t, err)
+	require.True(t, rewritten)
+
+	matcher := expr.(*parser.VectorSelector).LabelMatchers[0]
+	for _, name := range []string{"http_requests_total", "HTTP_REQUESTS_TOTAL", "Http_Requests_Total"} {
+		assert.True(t, matcher.Matches(name), name)
+	}
+	for _, name := range []string{"http_requests", "http_requests_total_count", "xhttp_requests_total"} {
+		assert.False(t, matcher.Matches(name), name)
+	}
+}
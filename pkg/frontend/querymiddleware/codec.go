@@ -60,6 +60,10 @@ const (
 
 	formatJSON     = "json"
 	formatProtobuf = "protobuf"
+
+	// frontendResponseHeaderPrefix is the prefix of the response headers which are
+	// propagated to the client when encoding the response.
+	frontendResponseHeaderPrefix = "X-Mimir-"
 )
 
 // Codec is used to encode/decode query range requests and responses so they can be passed down to middlewares.
@@ -440,6 +444,11 @@ func (c prometheusCodec) EncodeResponse(ctx context.Context, req *http.Request,
 		StatusCode:    http.StatusOK,
 		ContentLength: int64(len(b)),
 	}
+	for _, h := range a.Headers {
+		if strings.HasPrefix(h.Name, frontendResponseHeaderPrefix) {
+			resp.Header[h.Name] = h.Values
+		}
+	}
 	return &resp, nil
 }
 
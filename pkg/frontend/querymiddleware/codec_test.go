@@ -205,6 +205,27 @@ func TestPrometheusCodec_EncodeResponse_ContentNegotiation(t *testing.T) {
 	}
 }
 
+func TestPrometheusCodec_EncodeResponse_FrontendHeaders(t *testing.T) {
+	testResponse := &PrometheusResponse{
+		Status: statusSuccess,
+		Data:   &PrometheusData{ResultType: matrix},
+		Headers: []*PrometheusResponseHeader{
+			{Name: "Content-Length", Values: []string{"12345"}},
+			{Name: "X-Mimir-Adjusted-Step", Values: []string{"60"}},
+		},
+	}
+
+	req, err := http.NewRequest(http.MethodGet, "/api/v1/query_range", nil)
+	require.NoError(t, err)
+
+	encodedResponse, err := newTestPrometheusCodec().EncodeResponse(context.Background(), req, testResponse)
+	require.NoError(t, err)
+
+	// Only the headers set by the query-frontend should be propagated.
+	require.Equal(t, "60", encodedResponse.Header.Get("X-Mimir-Adjusted-Step"))
+	require.Empty(t, encodedResponse.Header.Get("Content-Length"))
+}
+
 type prometheusAPIResponse struct {
 	Status    string       `json:"status"`
 	Data      interface{}  `json:"data,omitempty"`
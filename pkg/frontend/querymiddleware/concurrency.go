@@ -0,0 +1,151 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package querymiddleware
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/grafana/dskit/tenant"
+
+	apierror "github.com/grafana/mimir/pkg/api/error"
+	"github.com/grafana/mimir/pkg/util/validation"
+)
+
+// perTenantConcurrency tracks the queries run concurrently by each tenant. It's shared
+// by all the handlers wrapped by the same per-tenant concurrency middleware.
+type perTenantConcurrency struct {
+	mtx        sync.Mutex
+	semaphores map[string]*tenantSemaphore
+}
+
+// tenantSemaphore limits the queries run concurrently by a tenant. Its capacity is the
+// limit at the time it has been created.
+type tenantSemaphore struct {
+	limit int
+	slots chan struct{}
+
+	// refs is the number of queries holding or waiting for a slot. It's protected by
+	// the perTenantConcurrency mutex.
+	refs int
+}
+
+// acquireSemaphore returns the semaphore for the input tenant, referenced by the caller until
+// it calls releaseSemaphore. If the limit has changed since the semaphore was created, a new
+// one is created: queries running while the limit changes release their slot to the old
+// semaphore, so the new limit may be temporarily exceeded.
+func (c *perTenantConcurrency) acquireSemaphore(tenantID string, limit int) *tenantSemaphore {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	sem, ok := c.semaphores[tenantID]
+	if !ok || sem.limit != limit {
+		sem = &tenantSemaphore{limit: limit, slots: make(chan struct{}, limit)}
+		c.semaphores[tenantID] = sem
+	}
+	sem.refs++
+	return sem
+}
+
+// releaseSemaphore drops the reference to the semaphore of the input tenant taken by
+// acquireSemaphore. Semaphores no longer referenced by any query are removed, so that
+// the semaphores of tenants not running queries don't accumulate.
+func (c *perTenantConcurrency) releaseSemaphore(tenantID string, sem *tenantSemaphore) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	sem.refs--
+	if sem.refs == 0 && c.semaphores[tenantID] == sem {
+		delete(c.semaphores, tenantID)
+	}
+}
+
+type perTenantConcurrencyMiddleware struct {
+	next        Handler
+	limits      Limits
+	maxWait     time.Duration
+	concurrency *perTenantConcurrency
+}
+
+// newPerTenantConcurrencyMiddleware creates a middleware that limits the number of queries
+// each tenant runs concurrently, according to the per-tenant limit. Queries exceeding the
+// limit wait up to maxWait for a running query to complete, and then are rejected. Queries
+// federated across multiple tenants count towards the limit of each of the tenants.
+func newPerTenantConcurrencyMiddleware(limits Limits, maxWait time.Duration) Middleware {
+	concurrency := &perTenantConcurrency{semaphores: map[string]*tenantSemaphore{}}
+
+	return MiddlewareFunc(func(next Handler) Handler {
+		return perTenantConcurrencyMiddleware{
+			next:        next,
+			limits:      limits,
+			maxWait:     maxWait,
+			concurrency: concurrency,
+		}
+	})
+}
+
+func (m perTenantConcurrencyMiddleware) Do(ctx context.Context, r Request) (Response, error) {
+	tenantIDs, err := tenant.TenantIDs(ctx)
+	if err != nil {
+		return nil, apierror.New(apierror.TypeBadData, err.Error())
+	}
+
+	// The wait for a slot is bounded by maxWait across all the tenants of the query.
+	var timeout <-chan time.Time
+	if m.maxWait > 0 {
+		timer := time.NewTimer(m.maxWait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	// Take a slot of each tenant's semaphore. The tenant IDs are sorted, so the slots are
+	// always taken in the same order and concurrent federated queries can't deadlock.
+	acquired := make([]*tenantSemaphore, len(tenantIDs))
+	defer func() {
+		for i, sem := range acquired {
+			if sem != nil {
+				<-sem.slots
+				m.concurrency.releaseSemaphore(tenantIDs[i], sem)
+			}
+		}
+	}()
+
+	for i, tenantID := range tenantIDs {
+		limit := m.limits.MaxConcurrentQueries(tenantID)
+		if limit <= 0 {
+			continue
+		}
+
+		sem := m.concurrency.acquireSemaphore(tenantID, limit)
+		if err := m.acquire(ctx, sem, timeout); err != nil {
+			m.concurrency.releaseSemaphore(tenantID, sem)
+			return nil, err
+		}
+		acquired[i] = sem
+	}
+
+	return m.next.Do(ctx, r)
+}
+
+// acquire takes a slot of the semaphore, waiting for one to be released until timeout fires.
+// It doesn't wait if timeout is nil.
+func (m perTenantConcurrencyMiddleware) acquire(ctx context.Context, sem *tenantSemaphore, timeout <-chan time.Time) error {
+	select {
+	case sem.slots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	if timeout != nil {
+		select {
+		case sem.slots <- struct{}{}:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timeout:
+		}
+	}
+
+	return apierror.New(apierror.TypeTooManyRequests, validation.NewMaxConcurrentQueriesError(sem.limit).Error())
+}
@@ -0,0 +1,177 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package querymiddleware
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/grafana/dskit/tenant"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/common/user"
+	"go.uber.org/atomic"
+
+	apierror "github.com/grafana/mimir/pkg/api/error"
+)
+
+func TestPerTenantConcurrencyMiddleware(t *testing.T) {
+	const limit = 2
+
+	tenant.WithDefaultResolver(tenant.NewMultiResolver())
+
+	// startBlockedQueries runs limit queries of the tenant which don't complete until release is closed.
+	startBlockedQueries := func(t *testing.T, handler Handler, tenantID string, release chan struct{}) {
+		for i := 0; i < limit; i++ {
+			go func() {
+				_, _ = handler.Do(user.InjectOrgID(context.Background(), tenantID), &PrometheusInstantQueryRequest{Query: "blocked"})
+			}()
+		}
+		t.Cleanup(func() { close(release) })
+	}
+
+	newHandler := func(limits Limits, maxWait time.Duration, release chan struct{}, running *atomic.Int32) Handler {
+		next := HandlerFunc(func(_ context.Context, r Request) (Response, error) {
+			if r.GetQuery() == "blocked" {
+				running.Inc()
+				<-release
+			}
+			return &PrometheusResponse{Status: statusSuccess}, nil
+		})
+		return newPerTenantConcurrencyMiddleware(limits, maxWait).Wrap(next)
+	}
+
+	t.Run("should reject the query exceeding the limit after waiting", func(t *testing.T) {
+		release, running := make(chan struct{}), atomic.NewInt32(0)
+		handler := newHandler(mockLimits{maxConcurrentQueries: limit}, 50*time.Millisecond, release, running)
+		startBlockedQueries(t, handler, "test", release)
+		require.Eventually(t, func() bool { return running.Load() == limit }, time.Second, time.Millisecond)
+
+		start := time.Now()
+		_, err := handler.Do(user.InjectOrgID(context.Background(), "test"), &PrometheusInstantQueryRequest{Query: "up"})
+		require.Error(t, err)
+		assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+
+		resp, ok := apierror.HTTPResponseFromError(err)
+		require.True(t, ok)
+		assert.Equal(t, http.StatusTooManyRequests, int(resp.Code))
+		assert.Contains(t, err.Error(), "err-mimir-max-concurrent-queries-per-tenant")
+	})
+
+	t.Run("should run the query exceeding the limit once a running query completes", func(t *testing.T) {
+		release, running := make(chan struct{}), atomic.NewInt32(0)
+		handler := newHandler(mockLimits{maxConcurrentQueries: limit}, time.Minute, release, running)
+
+		for i := 0; i < limit; i++ {
+			go func() {
+				_, _ = handler.Do(user.InjectOrgID(context.Background(), "test"), &PrometheusInstantQueryRequest{Query: "blocked"})
+			}()
+		}
+		require.Eventually(t, func() bool { return running.Load() == limit }, time.Second, time.Millisecond)
+
+		done := make(chan error)
+		go func() {
+			_, err := handler.Do(user.InjectOrgID(context.Background(), "test"), &PrometheusInstantQueryRequest{Query: "up"})
+			done <- err
+		}()
+
+		select {
+		case <-done:
+			require.Fail(t, "the query exceeding the limit should have been delayed")
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		// Complete the running queries.
+		close(release)
+		require.NoError(t, <-done)
+	})
+
+	t.Run("should not limit the queries of other tenants", func(t *testing.T) {
+		release, running := make(chan struct{}), atomic.NewInt32(0)
+		handler := newHandler(mockLimits{maxConcurrentQueries: limit}, 0, release, running)
+		startBlockedQueries(t, handler, "test", release)
+		require.Eventually(t, func() bool { return running.Load() == limit }, time.Second, time.Millisecond)
+
+		_, err := handler.Do(user.InjectOrgID(context.Background(), "other"), &PrometheusInstantQueryRequest{Query: "up"})
+		require.NoError(t, err)
+	})
+
+	t.Run("should count federated queries towards the limit of each tenant", func(t *testing.T) {
+		release, running := make(chan struct{}), atomic.NewInt32(0)
+		limits := multiTenantMockLimits{byTenant: map[string]mockLimits{
+			"a": {maxConcurrentQueries: limit},
+			"b": {maxConcurrentQueries: limit},
+		}}
+		handler := newHandler(limits, 0, release, running)
+		startBlockedQueries(t, handler, "a", release)
+		require.Eventually(t, func() bool { return running.Load() == limit }, time.Second, time.Millisecond)
+
+		// The federated query can't exceed the limit of tenant a.
+		_, err := handler.Do(user.InjectOrgID(context.Background(), "a|b"), &PrometheusInstantQueryRequest{Query: "up"})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "err-mimir-max-concurrent-queries-per-tenant")
+
+		// Queries of tenant b are not limited by the running queries of tenant a.
+		_, err = handler.Do(user.InjectOrgID(context.Background(), "b"), &PrometheusInstantQueryRequest{Query: "up"})
+		require.NoError(t, err)
+	})
+
+	t.Run("should count federated queries running towards the limit of each tenant", func(t *testing.T) {
+		release, running := make(chan struct{}), atomic.NewInt32(0)
+		limits := multiTenantMockLimits{byTenant: map[string]mockLimits{
+			"a": {maxConcurrentQueries: limit},
+			"b": {maxConcurrentQueries: limit},
+		}}
+		handler := newHandler(limits, 0, release, running)
+		startBlockedQueries(t, handler, "a|b", release)
+		require.Eventually(t, func() bool { return running.Load() == limit }, time.Second, time.Millisecond)
+
+		for _, tenantID := range []string{"a", "b"} {
+			_, err := handler.Do(user.InjectOrgID(context.Background(), tenantID), &PrometheusInstantQueryRequest{Query: "up"})
+			require.Error(t, err)
+		}
+	})
+
+	t.Run("should remove the semaphores of tenants without running queries", func(t *testing.T) {
+		release, running := make(chan struct{}), atomic.NewInt32(0)
+		handler := newHandler(mockLimits{maxConcurrentQueries: limit}, time.Minute, release, running)
+		concurrency := handler.(perTenantConcurrencyMiddleware).concurrency
+
+		done := make(chan struct{})
+		for i := 0; i < limit; i++ {
+			go func() {
+				_, _ = handler.Do(user.InjectOrgID(context.Background(), "a|b"), &PrometheusInstantQueryRequest{Query: "blocked"})
+				done <- struct{}{}
+			}()
+		}
+		require.Eventually(t, func() bool { return running.Load() == limit }, time.Second, time.Millisecond)
+
+		_, err := handler.Do(user.InjectOrgID(context.Background(), "c"), &PrometheusInstantQueryRequest{Query: "up"})
+		require.NoError(t, err)
+
+		concurrency.mtx.Lock()
+		assert.Len(t, concurrency.semaphores, 2)
+		concurrency.mtx.Unlock()
+
+		close(release)
+		for i := 0; i < limit; i++ {
+			<-done
+		}
+
+		concurrency.mtx.Lock()
+		assert.Empty(t, concurrency.semaphores)
+		concurrency.mtx.Unlock()
+	})
+
+	t.Run("should not limit the queries when the limit is disabled", func(t *testing.T) {
+		release, running := make(chan struct{}), atomic.NewInt32(0)
+		handler := newHandler(mockLimits{}, 0, release, running)
+		startBlockedQueries(t, handler, "test", release)
+		require.Eventually(t, func() bool { return running.Load() == limit }, time.Second, time.Millisecond)
+
+		_, err := handler.Do(user.InjectOrgID(context.Background(), "test"), &PrometheusInstantQueryRequest{Query: "up"})
+		require.NoError(t, err)
+	})
+}
@@ -0,0 +1,125 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package querymiddleware
+
+import (
+	"context"
+	"strings"
+
+	"github.com/grafana/dskit/tenant"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+	"golang.org/x/exp/slices"
+
+	apierror "github.com/grafana/mimir/pkg/api/error"
+)
+
+type defaultMetricNameMiddleware struct {
+	next             Handler
+	limits           Limits
+	rewrittenQueries prometheus.Counter
+}
+
+// newDefaultMetricNameMiddleware creates a middleware that, for tenants configuring a default metric
+// name regexp, adds a regexp matcher on the metric name to the selectors without a matcher on the
+// metric name, like {job="test"}, to bound the series they select. This changes the semantics of the
+// query, so it's strictly opt-in: queries for multiple tenants are rewritten only if all the tenants
+// configure it, in which case the selectors match the metric names matched by any of the tenants' ones.
+func newDefaultMetricNameMiddleware(limits Limits, reg prometheus.Registerer) Middleware {
+	rewrittenQueries := promauto.With(reg).NewCounter(prometheus.CounterOpts{
+		Name: "cortex_query_frontend_default_metric_name_rewritten_queries_total",
+		Help: "Total queries whose selectors without a matcher on the metric name have been rewritten to match the default metric name regexp.",
+	})
+
+	return MiddlewareFunc(func(next Handler) Handler {
+		return defaultMetricNameMiddleware{
+			next:             next,
+			limits:           limits,
+			rewrittenQueries: rewrittenQueries,
+		}
+	})
+}
+
+func (m defaultMetricNameMiddleware) Do(ctx context.Context, r Request) (Response, error) {
+	tenantIDs, err := tenant.TenantIDs(ctx)
+	if err != nil {
+		return nil, apierror.New(apierror.TypeBadData, err.Error())
+	}
+
+	regexp := m.tenantsDefaultMetricNameRegexp(tenantIDs)
+	if regexp == "" {
+		return m.next.Do(ctx, r)
+	}
+
+	expr, err := parser.ParseExpr(r.GetQuery())
+	if err != nil {
+		// Let the downstream handlers report the parsing error.
+		return m.next.Do(ctx, r)
+	}
+
+	rewritten, err := addDefaultMetricNameMatchers(expr, regexp)
+	if err != nil {
+		return nil, apierror.New(apierror.TypeBadData, err.Error())
+	}
+	if !rewritten {
+		return m.next.Do(ctx, r)
+	}
+
+	m.rewrittenQueries.Inc()
+	return m.next.Do(ctx, r.WithQuery(expr.String()))
+}
+
+// tenantsDefaultMetricNameRegexp returns the regexp matching the metric names matched by the default
+// metric name regexp of any of the input tenants, or an empty string if any tenant doesn't configure it.
+func (m defaultMetricNameMiddleware) tenantsDefaultMetricNameRegexp(tenantIDs []string) string {
+	regexps := make([]string, 0, len(tenantIDs))
+	for _, tenantID := range tenantIDs {
+		regexp := m.limits.DefaultMetricNameRegexp(tenantID)
+		if regexp == "" {
+			return ""
+		}
+		regexps = append(regexps, regexp)
+	}
+
+	slices.Sort(regexps)
+	regexps = slices.Compact(regexps)
+	if len(regexps) == 1 {
+		return regexps[0]
+	}
+	return "(?:" + strings.Join(regexps, ")|(?:") + ")"
+}
+
+// addDefaultMetricNameMatchers adds, in place, a matcher on the metric name with the input regexp to
+// the selectors of the input expression without a matcher on the metric name. Returns whether any
+// matcher has been added.
+func addDefaultMetricNameMatchers(expr parser.Expr, regexp string) (bool, error) {
+	rewritten := false
+	var rewriteErr error
+
+	parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+		selector, ok := node.(*parser.VectorSelector)
+		if !ok {
+			return nil
+		}
+
+		for _, matcher := range selector.LabelMatchers {
+			if matcher.Name == labels.MetricName {
+				return nil
+			}
+		}
+
+		matcher, err := labels.NewMatcher(labels.MatchRegexp, labels.MetricName, regexp)
+		if err != nil {
+			rewriteErr = err
+			return err
+		}
+
+		selector.LabelMatchers = append(selector.LabelMatchers, matcher)
+		rewritten = true
+		return nil
+	})
+
+	return rewritten, rewriteErr
+}
@@ -0,0 +1,99 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package querymiddleware
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/grafana/dskit/tenant"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/common/user"
+)
+
+func TestDefaultMetricNameMiddleware(t *testing.T) {
+	enabled := mockLimits{defaultMetricNameRegexp: "up|node_.+"}
+
+	tests := map[string]struct {
+		orgID         string
+		limits        Limits
+		query         string
+		expectedQuery string
+	}{
+		"should add the default metric name matcher when enabled": {
+			orgID:         "test1",
+			limits:        enabled,
+			query:         `{job="test"}`,
+			expectedQuery: `{__name__=~"up|node_.+",job="test"}`,
+		},
+		"should add the default metric name matcher to every selector without a metric name": {
+			orgID:         "test1",
+			limits:        enabled,
+			query:         `sum(rate({job="test"}[5m])) / sum(rate(http_requests_total[5m]))`,
+			expectedQuery: `sum(rate({__name__=~"up|node_.+",job="test"}[5m])) / sum(rate(http_requests_total[5m]))`,
+		},
+		"should not add the default metric name matcher to selectors with a regexp matcher on the metric name": {
+			orgID:         "test1",
+			limits:        enabled,
+			query:         `{__name__=~"down|.+_total",job="test"}`,
+			expectedQuery: `{__name__=~"down|.+_total",job="test"}`,
+		},
+		"should not rewrite the query when disabled": {
+			orgID:         "test1",
+			limits:        mockLimits{},
+			query:         `sum({job="test"})`,
+			expectedQuery: `sum({job="test"})`,
+		},
+		"should not rewrite the query when disabled for any of the tenants": {
+			orgID: "test1|test2",
+			limits: multiTenantMockLimits{byTenant: map[string]mockLimits{
+				"test1": {defaultMetricNameRegexp: "up"},
+				"test2": {},
+			}},
+			query:         `{job="test"}`,
+			expectedQuery: `{job="test"}`,
+		},
+		"should match any of the tenants' default metric names when enabled for all the tenants": {
+			orgID: "test1|test2",
+			limits: multiTenantMockLimits{byTenant: map[string]mockLimits{
+				"test1": {defaultMetricNameRegexp: "up"},
+				"test2": {defaultMetricNameRegexp: "node_.+"},
+			}},
+			query:         `{job="test"}`,
+			expectedQuery: `{__name__=~"(?:node_.+)|(?:up)",job="test"}`,
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			tenant.WithDefaultResolver(tenant.NewMultiResolver())
+
+			var actual Request
+			next := HandlerFunc(func(_ context.Context, req Request) (Response, error) {
+				actual = req
+				return &PrometheusResponse{Status: statusSuccess}, nil
+			})
+
+			reg := prometheus.NewPedanticRegistry()
+			ctx := user.InjectOrgID(context.Background(), testData.orgID)
+			_, err := newDefaultMetricNameMiddleware(testData.limits, reg).Wrap(next).Do(ctx, &PrometheusInstantQueryRequest{Query: testData.query})
+			require.NoError(t, err)
+			assert.Equal(t, testData.expectedQuery, actual.GetQuery())
+
+			expectedRewritten := 0
+			if testData.expectedQuery != testData.query {
+				expectedRewritten = 1
+			}
+			assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(fmt.Sprintf(`
+				# HELP cortex_query_frontend_default_metric_name_rewritten_queries_total Total queries whose selectors without a matcher on the metric name have been rewritten to match the default metric name regexp.
+				# TYPE cortex_query_frontend_default_metric_name_rewritten_queries_total counter
+				cortex_query_frontend_default_metric_name_rewritten_queries_total %d
+			`, expectedRewritten)), "cortex_query_frontend_default_metric_name_rewritten_queries_total"))
+		})
+	}
+}
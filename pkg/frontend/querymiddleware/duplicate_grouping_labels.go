@@ -0,0 +1,61 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package querymiddleware
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/prometheus/prometheus/promql/parser"
+
+	apierror "github.com/grafana/mimir/pkg/api/error"
+)
+
+// newDuplicateGroupingLabelsMiddleware creates a middleware that rejects queries with an aggregation
+// whose by or without grouping list contains the same label more than once, like sum by (job, job) (up).
+// A duplicate label doesn't change the result, but it's likely a typo of a different label name.
+func newDuplicateGroupingLabelsMiddleware() Middleware {
+	return MiddlewareFunc(func(next Handler) Handler {
+		return HandlerFunc(func(ctx context.Context, r Request) (Response, error) {
+			expr, err := parseQuery(ctx, r.GetQuery())
+			if err != nil {
+				// Let the downstream handlers report the parsing error.
+				return next.Do(ctx, r)
+			}
+
+			if label, ok := duplicateGroupingLabel(expr); ok {
+				return nil, apierror.New(apierror.TypeBadData, fmt.Sprintf("the query has an aggregation grouping by the label %q more than once: remove the duplicate label from the grouping list", label))
+			}
+
+			return next.Do(ctx, r)
+		})
+	})
+}
+
+// duplicateGroupingLabel returns the first label found more than once in the grouping list of
+// an aggregation of the input expression, and whether any was found. Only the grouping labels
+// are checked: the same label can be used by multiple matchers of a selector.
+func duplicateGroupingLabel(expr parser.Expr) (string, bool) {
+	duplicate := ""
+	found := false
+
+	parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+		aggr, ok := node.(*parser.AggregateExpr)
+		if !ok || found {
+			return nil
+		}
+
+		seen := make(map[string]struct{}, len(aggr.Grouping))
+		for _, label := range aggr.Grouping {
+			if _, ok := seen[label]; ok {
+				duplicate = label
+				found = true
+				return nil
+			}
+			seen[label] = struct{}{}
+		}
+		return nil
+	})
+
+	return duplicate, found
+}
@@ -0,0 +1,67 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package querymiddleware
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	apierror "github.com/grafana/mimir/pkg/api/error"
+)
+
+func TestDuplicateGroupingLabelsMiddleware(t *testing.T) {
+	tests := map[string]struct {
+		query         string
+		expectedError bool
+	}{
+		"aggregation with distinct by labels": {
+			query: `sum by (job, instance) (up)`,
+		},
+		"aggregation with a duplicate by label": {
+			query:         `sum by (job, job) (up)`,
+			expectedError: true,
+		},
+		"aggregation with a duplicate without label": {
+			query:         `max without (instance, job, instance) (up)`,
+			expectedError: true,
+		},
+		"nested aggregation with a duplicate by label": {
+			query:         `count(sum by (job, job) (rate(http_requests_total[5m])))`,
+			expectedError: true,
+		},
+		"selector with the same label in multiple matchers": {
+			query: `sum by (job) (up{job!="a", job!="b"})`,
+		},
+		"binary operation matching on duplicate labels": {
+			query: `up + on (job, job) up`,
+		},
+		"query failing to parse": {
+			query: `sum by (job, job) (up`,
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			nextCalled := false
+			next := HandlerFunc(func(_ context.Context, _ Request) (Response, error) {
+				nextCalled = true
+				return &PrometheusResponse{Status: statusSuccess}, nil
+			})
+
+			_, err := newDuplicateGroupingLabelsMiddleware().Wrap(next).Do(context.Background(), &PrometheusInstantQueryRequest{Query: testData.query})
+
+			if testData.expectedError {
+				require.Error(t, err)
+				assert.True(t, apierror.IsAPIError(err))
+				assert.Contains(t, err.Error(), "more than once")
+				assert.False(t, nextCalled)
+			} else {
+				require.NoError(t, err)
+				assert.True(t, nextCalled)
+			}
+		})
+	}
+}
@@ -0,0 +1,56 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package querymiddleware
+
+import (
+	"context"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+
+	apierror "github.com/grafana/mimir/pkg/api/error"
+)
+
+// newEmptyMetricNameMiddleware creates a middleware that rejects queries with a selector matching
+// the metric name with an equality matcher on the empty string, like {__name__="", job="test"}.
+// Every series has a metric name, so such a selector can't match any series. Regexp matchers are
+// not rejected, even if they match the empty string, because they may match other metric names too.
+func newEmptyMetricNameMiddleware() Middleware {
+	return MiddlewareFunc(func(next Handler) Handler {
+		return HandlerFunc(func(ctx context.Context, r Request) (Response, error) {
+			expr, err := parseQuery(ctx, r.GetQuery())
+			if err != nil {
+				// Let the downstream handlers report the parsing error.
+				return next.Do(ctx, r)
+			}
+
+			if hasEmptyMetricNameMatcher(expr) {
+				return nil, apierror.New(apierror.TypeBadData, "the query has a selector matching an empty metric name, which can't match any series: remove the __name__=\"\" matcher from the selector")
+			}
+
+			return next.Do(ctx, r)
+		})
+	})
+}
+
+// hasEmptyMetricNameMatcher returns whether any selector of the input expression has an equality
+// matcher on the metric name with an empty value.
+func hasEmptyMetricNameMatcher(expr parser.Expr) bool {
+	found := false
+
+	parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+		selector, ok := node.(*parser.VectorSelector)
+		if !ok {
+			return nil
+		}
+
+		for _, matcher := range selector.LabelMatchers {
+			if matcher.Name == labels.MetricName && matcher.Type == labels.MatchEqual && matcher.Value == "" {
+				found = true
+			}
+		}
+		return nil
+	})
+
+	return found
+}
@@ -0,0 +1,66 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package querymiddleware
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	apierror "github.com/grafana/mimir/pkg/api/error"
+)
+
+func TestEmptyMetricNameMiddleware(t *testing.T) {
+	tests := map[string]struct {
+		query         string
+		expectedError bool
+	}{
+		"selector with a metric name": {
+			query: `up{job="test"}`,
+		},
+		"selector with an empty metric name equality matcher": {
+			query:         `{__name__="", job="test"}`,
+			expectedError: true,
+		},
+		"selector with an empty metric name equality matcher nested in a function": {
+			query:         `sum(rate({__name__="", job="test"}[5m]))`,
+			expectedError: true,
+		},
+		"selector with a regexp metric name matcher matching the empty string": {
+			query: `{__name__=~"up|", job="test"}`,
+		},
+		"selector with a not equal empty metric name matcher": {
+			query: `{__name__!="", job="test"}`,
+		},
+		"selector with an empty equality matcher on another label": {
+			query: `up{job=""}`,
+		},
+		"query failing to parse": {
+			query: `sum(up`,
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			nextCalled := false
+			next := HandlerFunc(func(_ context.Context, _ Request) (Response, error) {
+				nextCalled = true
+				return &PrometheusResponse{Status: statusSuccess}, nil
+			})
+
+			_, err := newEmptyMetricNameMiddleware().Wrap(next).Do(context.Background(), &PrometheusInstantQueryRequest{Query: testData.query})
+
+			if testData.expectedError {
+				require.Error(t, err)
+				assert.True(t, apierror.IsAPIError(err))
+				assert.Contains(t, err.Error(), "empty metric name")
+				assert.False(t, nextCalled)
+			} else {
+				require.NoError(t, err)
+				assert.True(t, nextCalled)
+			}
+		})
+	}
+}
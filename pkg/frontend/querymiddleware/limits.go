@@ -43,6 +43,50 @@ type Limits interface {
 	// query may be. 0 means "unlimited".
 	MaxQueryExpressionSizeBytes(userID string) int
 
+	// MaxQueryBatchSizeBytes returns the limit of the max number of bytes long the selectors
+	// of a batched request, like a series request, may be in total. 0 means "unlimited".
+	MaxQueryBatchSizeBytes(userID string) int
+
+	// MaxQueryMetricNames returns the limit of the number of distinct metric names a
+	// query may select. 0 means "unlimited".
+	MaxQueryMetricNames(userID string) int
+
+	// MaxQueryMetricNamesIgnoreRegexp returns whether regexp matchers on the metric name
+	// are ignored when enforcing MaxQueryMetricNames.
+	MaxQueryMetricNamesIgnoreRegexp(userID string) bool
+
+	// MaxQueryOrOperands returns the limit of the number of operands of the chain of 'or'
+	// operators at the top level of a query. 0 means "unlimited".
+	MaxQueryOrOperands(userID string) int
+
+	// QueryMetricNamesAllowlist returns the list of metric names a query may select.
+	// An empty list means "any metric name".
+	QueryMetricNamesAllowlist(userID string) []string
+
+	// MaxConcurrentQueries returns the limit of the number of queries of a tenant the
+	// query-frontend runs concurrently. 0 means "unlimited".
+	MaxConcurrentQueries(userID string) int
+
+	// CaseInsensitiveMetricNames returns whether equality matchers on the metric name are
+	// rewritten to match the metric name case-insensitively.
+	CaseInsensitiveMetricNames(userID string) bool
+
+	// AssumedScrapeInterval returns the scrape interval assumed for the tenant's series.
+	// 0 means "unknown".
+	AssumedScrapeInterval(userID string) time.Duration
+
+	// DefaultMetricNameRegexp returns the regular expression matcher on the metric name added
+	// to the selectors without a matcher on the metric name. An empty string means "disabled".
+	DefaultMetricNameRegexp(userID string) string
+
+	// RejectSubqueriesWithUnevenStep returns whether queries with a subquery whose step
+	// doesn't evenly divide its range are rejected.
+	RejectSubqueriesWithUnevenStep(userID string) bool
+
+	// RejectMatchAllRegexpMatchers returns whether queries with a regular expression matcher
+	// matching any value of a label other than the metric name are rejected.
+	RejectMatchAllRegexpMatchers(userID string) bool
+
 	// MaxCacheFreshness returns the period after which results are cacheable,
 	// to prevent caching of very recent results.
 	MaxCacheFreshness(userID string) time.Duration
@@ -122,9 +166,13 @@ func (l limitsMiddleware) Do(ctx context.Context, r Request) (Response, error) {
 
 		if r.GetEnd() < minStartTime {
 			// The request is fully outside the allowed range, so we can return an
-			// empty response.
+			// empty response. Queries ending before the blocks retention period of
+			// all the queried tenants have already been rejected by the store retention
+			// middleware, so the request gets here because of the max query lookback
+			// or, for queries federated across multiple tenants, because of the blocks
+			// retention period of some of them.
 			level.Debug(log).Log(
-				"msg", "skipping the execution of the query because its time range is before the 'max query lookback' or 'blocks retention period' setting",
+				"msg", "skipping the execution of the query because its time range is before the 'max query lookback' setting, or the 'blocks retention period' setting of some of the tenants",
 				"reqStart", util.FormatTimeMillis(r.GetStart()),
 				"redEnd", util.FormatTimeMillis(r.GetEnd()),
 				"maxQueryLookback", maxQueryLookback,
@@ -162,14 +210,6 @@ func (l limitsMiddleware) Do(ctx context.Context, r Request) (Response, error) {
 		}
 	}
 
-	// Enforce max query size, in bytes.
-	if maxQuerySize := validation.SmallestPositiveNonZeroIntPerTenant(tenantIDs, l.MaxQueryExpressionSizeBytes); maxQuerySize > 0 {
-		querySize := len(r.GetQuery())
-		if querySize > maxQuerySize {
-			return nil, apierror.New(apierror.TypeBadData, validation.NewMaxQueryExpressionSizeBytesError(querySize, maxQuerySize).Error())
-		}
-	}
-
 	// Enforce the max query length.
 	if maxQueryLength := validation.SmallestPositiveNonZeroDurationPerTenant(tenantIDs, l.MaxTotalQueryLength); maxQueryLength > 0 {
 		queryLen := timestamp.Time(r.GetEnd()).Sub(timestamp.Time(r.GetStart()))
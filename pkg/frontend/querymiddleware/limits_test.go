@@ -7,15 +7,12 @@ package querymiddleware
 
 import (
 	"context"
-	"fmt"
 	"net/http"
-	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/go-kit/log"
-	"github.com/grafana/dskit/tenant"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
@@ -129,77 +126,6 @@ func TestLimitsMiddleware_MaxQueryLookback(t *testing.T) {
 	}
 }
 
-func TestLimitsMiddleware_MaxQueryExpressionSizeBytes(t *testing.T) {
-	now := time.Now()
-
-	tests := map[string]struct {
-		query       string
-		queryLimits map[string]int
-		expectError bool
-	}{
-		"should fail for queries longer than the limit": {
-			query:       fmt.Sprintf("up{foo=\"%s\"}", strings.Repeat("a", 1000)),
-			queryLimits: map[string]int{"test1": 100, "test2": 100},
-			expectError: true,
-		},
-		"should fail for queries longer than a one tenant limit": {
-			query:       fmt.Sprintf("up{foo=\"%s\"}", strings.Repeat("a", 1000)),
-			queryLimits: map[string]int{"test1": 100, "test2": 2000},
-			expectError: true,
-		},
-		"should fail for queries longer than a one tenant limit with one limit disabled": {
-			query:       fmt.Sprintf("up{foo=\"%s\"}", strings.Repeat("a", 1000)),
-			queryLimits: map[string]int{"test1": 100, "test2": 0},
-			expectError: true,
-		},
-		"should work for queries under the limit": {
-			query:       fmt.Sprintf("up{foo=\"%s\"}", strings.Repeat("a", 50)),
-			queryLimits: map[string]int{"test1": 100, "test2": 100},
-			expectError: false,
-		},
-		"should work for queries when the limit is disabled": {
-			query:       fmt.Sprintf("up{foo=\"%s\"}", strings.Repeat("a", 50)),
-			queryLimits: map[string]int{"test1": 0, "test2": 0},
-			expectError: false,
-		},
-	}
-
-	for testName, testData := range tests {
-		t.Run(testName, func(t *testing.T) {
-			req := &PrometheusRangeQueryRequest{
-				Query: testData.query,
-				Start: util.TimeToMillis(now.Add(-time.Hour * 2)),
-				End:   util.TimeToMillis(now.Add(-time.Hour)),
-			}
-
-			tenant.WithDefaultResolver(tenant.NewMultiResolver())
-			limits := multiTenantMockLimits{
-				byTenant: map[string]mockLimits{
-					"test1": {maxQueryExpressionSizeBytes: testData.queryLimits["test1"]},
-					"test2": {maxQueryExpressionSizeBytes: testData.queryLimits["test2"]},
-				},
-			}
-			middleware := newLimitsMiddleware(limits, log.NewNopLogger())
-
-			innerRes := newEmptyPrometheusResponse()
-			inner := &mockHandler{}
-			inner.On("Do", mock.Anything, mock.Anything).Return(innerRes, nil)
-
-			ctx := user.InjectOrgID(context.Background(), "test1|test2")
-			outer := middleware.Wrap(inner)
-			res, err := outer.Do(ctx, req)
-
-			if testData.expectError {
-				require.Error(t, err)
-				require.Contains(t, err.Error(), "err-mimir-max-query-expression-size-bytes")
-			} else {
-				require.NoError(t, err)
-				require.Same(t, innerRes, res)
-			}
-		})
-	}
-}
-
 func TestLimitsMiddleware_MaxQueryLength(t *testing.T) {
 	const (
 		thirtyDays = 30 * 24 * time.Hour
@@ -371,6 +297,50 @@ func (m multiTenantMockLimits) MaxQueryExpressionSizeBytes(userID string) int {
 	return m.byTenant[userID].maxQueryExpressionSizeBytes
 }
 
+func (m multiTenantMockLimits) MaxQueryBatchSizeBytes(userID string) int {
+	return m.byTenant[userID].maxQueryBatchSizeBytes
+}
+
+func (m multiTenantMockLimits) MaxQueryMetricNames(userID string) int {
+	return m.byTenant[userID].maxQueryMetricNames
+}
+
+func (m multiTenantMockLimits) MaxQueryMetricNamesIgnoreRegexp(userID string) bool {
+	return m.byTenant[userID].maxQueryMetricNamesIgnoreRegexp
+}
+
+func (m multiTenantMockLimits) MaxQueryOrOperands(userID string) int {
+	return m.byTenant[userID].maxQueryOrOperands
+}
+
+func (m multiTenantMockLimits) QueryMetricNamesAllowlist(userID string) []string {
+	return m.byTenant[userID].queryMetricNamesAllowlist
+}
+
+func (m multiTenantMockLimits) MaxConcurrentQueries(userID string) int {
+	return m.byTenant[userID].maxConcurrentQueries
+}
+
+func (m multiTenantMockLimits) CaseInsensitiveMetricNames(userID string) bool {
+	return m.byTenant[userID].caseInsensitiveMetricNames
+}
+
+func (m multiTenantMockLimits) AssumedScrapeInterval(userID string) time.Duration {
+	return m.byTenant[userID].assumedScrapeInterval
+}
+
+func (m multiTenantMockLimits) DefaultMetricNameRegexp(userID string) string {
+	return m.byTenant[userID].defaultMetricNameRegexp
+}
+
+func (m multiTenantMockLimits) RejectSubqueriesWithUnevenStep(userID string) bool {
+	return m.byTenant[userID].rejectSubqueriesWithUnevenStep
+}
+
+func (m multiTenantMockLimits) RejectMatchAllRegexpMatchers(userID string) bool {
+	return m.byTenant[userID].rejectMatchAllRegexpMatchers
+}
+
 func (m multiTenantMockLimits) MaxQueryParallelism(userID string) int {
 	return m.byTenant[userID].maxQueryParallelism
 }
@@ -428,6 +398,17 @@ type mockLimits struct {
 	maxQueryLength                   time.Duration
 	maxTotalQueryLength              time.Duration
 	maxQueryExpressionSizeBytes      int
+	maxQueryBatchSizeBytes           int
+	maxQueryMetricNames              int
+	maxQueryMetricNamesIgnoreRegexp  bool
+	maxQueryOrOperands               int
+	queryMetricNamesAllowlist        []string
+	maxConcurrentQueries             int
+	caseInsensitiveMetricNames       bool
+	assumedScrapeInterval            time.Duration
+	defaultMetricNameRegexp          string
+	rejectSubqueriesWithUnevenStep   bool
+	rejectMatchAllRegexpMatchers     bool
 	maxCacheFreshness                time.Duration
 	maxQueryParallelism              int
 	maxShardedQueries                int
@@ -462,6 +443,50 @@ func (m mockLimits) MaxQueryExpressionSizeBytes(string) int {
 	return m.maxQueryExpressionSizeBytes
 }
 
+func (m mockLimits) MaxQueryBatchSizeBytes(string) int {
+	return m.maxQueryBatchSizeBytes
+}
+
+func (m mockLimits) MaxQueryMetricNames(string) int {
+	return m.maxQueryMetricNames
+}
+
+func (m mockLimits) MaxQueryMetricNamesIgnoreRegexp(string) bool {
+	return m.maxQueryMetricNamesIgnoreRegexp
+}
+
+func (m mockLimits) MaxQueryOrOperands(string) int {
+	return m.maxQueryOrOperands
+}
+
+func (m mockLimits) QueryMetricNamesAllowlist(string) []string {
+	return m.queryMetricNamesAllowlist
+}
+
+func (m mockLimits) MaxConcurrentQueries(string) int {
+	return m.maxConcurrentQueries
+}
+
+func (m mockLimits) CaseInsensitiveMetricNames(string) bool {
+	return m.caseInsensitiveMetricNames
+}
+
+func (m mockLimits) AssumedScrapeInterval(string) time.Duration {
+	return m.assumedScrapeInterval
+}
+
+func (m mockLimits) DefaultMetricNameRegexp(string) string {
+	return m.defaultMetricNameRegexp
+}
+
+func (m mockLimits) RejectSubqueriesWithUnevenStep(string) bool {
+	return m.rejectSubqueriesWithUnevenStep
+}
+
+func (m mockLimits) RejectMatchAllRegexpMatchers(string) bool {
+	return m.rejectMatchAllRegexpMatchers
+}
+
 func (m mockLimits) MaxQueryParallelism(string) int {
 	if m.maxQueryParallelism == 0 {
 		return 14 // Flag default.
@@ -0,0 +1,45 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package querymiddleware
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	// lookbackDeltaResponseHeader is the response header set by the lookback delta middleware.
+	// The value is the lookback delta used to evaluate the query, in seconds.
+	lookbackDeltaResponseHeader = "X-Mimir-Lookback-Delta"
+
+	// defaultLookbackDelta is the lookback delta used by the PromQL engine when it's configured to 0.
+	// It matches the engine default, which is not exported.
+	defaultLookbackDelta = 5 * time.Minute
+)
+
+// newLookbackDeltaMiddleware creates a middleware that returns the lookback delta used to evaluate
+// queries in the response headers, to help understanding why samples older than the query time show up
+// in the results. The lookback delta is not a per-tenant limit, but it's set by -querier.lookback-delta
+// which is shared between queriers and query-frontends.
+func newLookbackDeltaMiddleware(lookbackDelta time.Duration) Middleware {
+	if lookbackDelta == 0 {
+		lookbackDelta = defaultLookbackDelta
+	}
+
+	return MiddlewareFunc(func(next Handler) Handler {
+		return HandlerFunc(func(ctx context.Context, r Request) (Response, error) {
+			resp, err := next.Do(ctx, r)
+			if err != nil {
+				return nil, err
+			}
+
+			if promResp, ok := resp.(*PrometheusResponse); ok {
+				promResp.Headers = append(promResp.Headers, &PrometheusResponseHeader{
+					Name:   lookbackDeltaResponseHeader,
+					Values: []string{encodeDurationMs(lookbackDelta.Milliseconds())},
+				})
+			}
+			return resp, nil
+		})
+	})
+}
@@ -0,0 +1,59 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package querymiddleware
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLookbackDeltaMiddleware(t *testing.T) {
+	tests := map[string]struct {
+		lookbackDelta  time.Duration
+		input          Request
+		expectedHeader string
+	}{
+		"range query with the default lookback delta": {
+			lookbackDelta:  5 * time.Minute,
+			input:          &PrometheusRangeQueryRequest{Query: "up", Start: 0, End: 3600_000, Step: 60_000},
+			expectedHeader: "300",
+		},
+		"instant query with a custom lookback delta": {
+			lookbackDelta:  90 * time.Second,
+			input:          &PrometheusInstantQueryRequest{Query: "up", Time: 3600_000},
+			expectedHeader: "90",
+		},
+		"lookback delta set to 0 defaults to the engine default": {
+			lookbackDelta:  0,
+			input:          &PrometheusRangeQueryRequest{Query: "up", Start: 0, End: 3600_000, Step: 60_000},
+			expectedHeader: "300",
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			next := HandlerFunc(func(_ context.Context, _ Request) (Response, error) {
+				return &PrometheusResponse{Status: statusSuccess}, nil
+			})
+
+			resp, err := newLookbackDeltaMiddleware(testData.lookbackDelta).Wrap(next).Do(context.Background(), testData.input)
+			require.NoError(t, err)
+			assert.Equal(t, []*PrometheusResponseHeader{{Name: lookbackDeltaResponseHeader, Values: []string{testData.expectedHeader}}}, resp.GetHeaders())
+		})
+	}
+}
+
+func TestLookbackDeltaMiddleware_ShouldReturnDownstreamError(t *testing.T) {
+	downstreamErr := errors.New("downstream error")
+	next := HandlerFunc(func(_ context.Context, _ Request) (Response, error) {
+		return nil, downstreamErr
+	})
+
+	_, err := newLookbackDeltaMiddleware(5*time.Minute).Wrap(next).Do(context.Background(), &PrometheusInstantQueryRequest{Query: "up"})
+	assert.Equal(t, downstreamErr, err)
+}
@@ -0,0 +1,75 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package querymiddleware
+
+import (
+	"context"
+	"regexp/syntax"
+
+	"github.com/grafana/dskit/tenant"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+
+	apierror "github.com/grafana/mimir/pkg/api/error"
+	"github.com/grafana/mimir/pkg/util/validation"
+)
+
+type matchAllRegexpMiddleware struct {
+	next   Handler
+	limits Limits
+}
+
+// newMatchAllRegexpMiddleware creates a middleware that, for tenants enabling it, rejects queries with
+// a regexp matcher matching any value of a label other than the metric name, like pod=~".*". Such a
+// matcher matches the empty string too, so it doesn't filter any series. Regexp matchers on the metric
+// name are not rejected, because they're the only way to select series with any metric name.
+func newMatchAllRegexpMiddleware(limits Limits) Middleware {
+	return MiddlewareFunc(func(next Handler) Handler {
+		return matchAllRegexpMiddleware{
+			next:   next,
+			limits: limits,
+		}
+	})
+}
+
+func (m matchAllRegexpMiddleware) Do(ctx context.Context, r Request) (Response, error) {
+	tenantIDs, err := tenant.TenantIDs(ctx)
+	if err != nil {
+		return nil, apierror.New(apierror.TypeBadData, err.Error())
+	}
+
+	if !validation.AllTrueBooleansPerTenant(tenantIDs, m.limits.RejectMatchAllRegexpMatchers) {
+		return m.next.Do(ctx, r)
+	}
+
+	expr, err := parseQuery(ctx, r.GetQuery())
+	if err != nil {
+		// Let the downstream handlers report the parsing error.
+		return m.next.Do(ctx, r)
+	}
+
+	for _, selectors := range parser.ExtractSelectors(expr) {
+		for _, matcher := range selectors {
+			if matcher.Type == labels.MatchRegexp && matcher.Name != labels.MetricName && isMatchAllRegexp(matcher.Value) {
+				return nil, apierror.New(apierror.TypeBadData, validation.NewMatchAllRegexpMatcherError(matcher.String()).Error())
+			}
+		}
+	}
+
+	return m.next.Do(ctx, r)
+}
+
+// isMatchAllRegexp returns whether the input regexp matches any string, like .* does. This is
+// best-effort: regexps matching any string in a more convoluted way, like .*|foo, are not detected.
+func isMatchAllRegexp(value string) bool {
+	re, err := syntax.Parse(value, syntax.Perl|syntax.DotNL)
+	if err != nil {
+		return false
+	}
+
+	re = re.Simplify()
+	for re.Op == syntax.OpCapture {
+		re = re.Sub[0]
+	}
+	return re.Op == syntax.OpStar && (re.Sub[0].Op == syntax.OpAnyChar || re.Sub[0].Op == syntax.OpAnyCharNotNL)
+}
@@ -0,0 +1,91 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package querymiddleware
+
+import (
+	"context"
+	"testing"
+
+	"github.com/grafana/dskit/tenant"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/common/user"
+
+	apierror "github.com/grafana/mimir/pkg/api/error"
+)
+
+func TestMatchAllRegexpMiddleware(t *testing.T) {
+	enabled := map[string]mockLimits{"test1": {rejectMatchAllRegexpMatchers: true}, "test2": {rejectMatchAllRegexpMatchers: true}}
+
+	tests := map[string]struct {
+		query         string
+		limits        map[string]mockLimits
+		expectedError bool
+	}{
+		"should fail for a regexp matcher matching any value when enabled": {
+			query:         `up{pod=~".*"}`,
+			limits:        enabled,
+			expectedError: true,
+		},
+		"should fail for a grouped regexp matcher matching any value when enabled": {
+			query:         `sum(rate(http_requests_total{job="api", pod=~"(.*)"}[5m]))`,
+			limits:        enabled,
+			expectedError: true,
+		},
+		"should work for a regexp matcher matching some values when enabled": {
+			query:  `up{pod=~"web-.*"}`,
+			limits: enabled,
+		},
+		"should work for a regexp matcher on the metric name matching any value when enabled": {
+			query:  `{__name__=~".*", pod="web"}`,
+			limits: enabled,
+		},
+		"should work for a negated regexp matcher matching any value when enabled": {
+			query:  `up{pod!~".*"}`,
+			limits: enabled,
+		},
+		"should work for a regexp matcher matching any value when disabled": {
+			query:  `up{pod=~".*"}`,
+			limits: map[string]mockLimits{"test1": {}, "test2": {}},
+		},
+		"should work for a regexp matcher matching any value when disabled for any of the tenants": {
+			query:  `up{pod=~".*"}`,
+			limits: map[string]mockLimits{"test1": {rejectMatchAllRegexpMatchers: true}, "test2": {}},
+		},
+		"should let invalid queries through to the downstream handlers": {
+			query:  `up{pod=~".*"`,
+			limits: enabled,
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			for _, req := range []Request{
+				&PrometheusRangeQueryRequest{Query: testData.query, Start: 0, End: 3600_000, Step: 60_000},
+				&PrometheusInstantQueryRequest{Query: testData.query, Time: 3600_000},
+			} {
+				tenant.WithDefaultResolver(tenant.NewMultiResolver())
+				limits := multiTenantMockLimits{byTenant: testData.limits}
+
+				var nextCalled bool
+				next := HandlerFunc(func(_ context.Context, _ Request) (Response, error) {
+					nextCalled = true
+					return &PrometheusResponse{Status: statusSuccess}, nil
+				})
+
+				ctx := user.InjectOrgID(context.Background(), "test1|test2")
+				_, err := newMatchAllRegexpMiddleware(limits).Wrap(next).Do(ctx, req)
+
+				if testData.expectedError {
+					require.Error(t, err)
+					assert.True(t, apierror.IsAPIError(err))
+					assert.Contains(t, err.Error(), "err-mimir-match-all-regexp-matcher")
+					assert.False(t, nextCalled)
+				} else {
+					require.NoError(t, err)
+					assert.True(t, nextCalled)
+				}
+			}
+		})
+	}
+}
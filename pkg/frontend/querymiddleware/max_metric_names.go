@@ -0,0 +1,88 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package querymiddleware
+
+import (
+	"context"
+
+	"github.com/grafana/dskit/tenant"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+
+	apierror "github.com/grafana/mimir/pkg/api/error"
+	"github.com/grafana/mimir/pkg/util/validation"
+)
+
+type maxMetricNamesMiddleware struct {
+	next   Handler
+	limits Limits
+}
+
+// newMaxMetricNamesMiddleware creates a middleware that rejects queries selecting more
+// distinct metric names than the per-tenant limit.
+func newMaxMetricNamesMiddleware(limits Limits) Middleware {
+	return MiddlewareFunc(func(next Handler) Handler {
+		return maxMetricNamesMiddleware{
+			next:   next,
+			limits: limits,
+		}
+	})
+}
+
+func (m maxMetricNamesMiddleware) Do(ctx context.Context, r Request) (Response, error) {
+	tenantIDs, err := tenant.TenantIDs(ctx)
+	if err != nil {
+		return nil, apierror.New(apierror.TypeBadData, err.Error())
+	}
+
+	maxMetricNames := validation.SmallestPositiveNonZeroIntPerTenant(tenantIDs, m.limits.MaxQueryMetricNames)
+	if maxMetricNames <= 0 {
+		return m.next.Do(ctx, r)
+	}
+
+	expr, err := parseQuery(ctx, r.GetQuery())
+	if err != nil {
+		// Let the downstream handlers report the parsing error.
+		return m.next.Do(ctx, r)
+	}
+
+	metricNames, hasRegexp := queryMetricNames(expr)
+	if hasRegexp && !validation.AllTrueBooleansPerTenant(tenantIDs, m.limits.MaxQueryMetricNamesIgnoreRegexp) {
+		return nil, apierror.New(apierror.TypeBadData, validation.NewMaxQueryMetricNamesRegexpError(maxMetricNames).Error())
+	}
+	if len(metricNames) > maxMetricNames {
+		return nil, apierror.New(apierror.TypeBadData, validation.NewMaxQueryMetricNamesError(len(metricNames), maxMetricNames).Error())
+	}
+
+	return m.next.Do(ctx, r)
+}
+
+// queryMetricNames returns the distinct metric names selected by the input expression through
+// equality matchers, and whether any selector matches the metric name with a regexp matcher.
+func queryMetricNames(expr parser.Expr) (map[string]struct{}, bool) {
+	metricNames := map[string]struct{}{}
+	hasRegexp := false
+
+	parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+		selector, ok := node.(*parser.VectorSelector)
+		if !ok {
+			return nil
+		}
+
+		for _, matcher := range selector.LabelMatchers {
+			if matcher.Name != labels.MetricName {
+				continue
+			}
+
+			switch matcher.Type {
+			case labels.MatchEqual:
+				metricNames[matcher.Value] = struct{}{}
+			case labels.MatchRegexp, labels.MatchNotRegexp:
+				hasRegexp = true
+			}
+		}
+		return nil
+	})
+
+	return metricNames, hasRegexp
+}
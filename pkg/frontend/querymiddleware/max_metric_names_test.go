@@ -0,0 +1,106 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package querymiddleware
+
+import (
+	"context"
+	"testing"
+
+	"github.com/grafana/dskit/tenant"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/common/user"
+
+	apierror "github.com/grafana/mimir/pkg/api/error"
+)
+
+func TestMaxMetricNamesMiddleware(t *testing.T) {
+	tests := map[string]struct {
+		query         string
+		limits        map[string]mockLimits
+		expectedError bool
+	}{
+		"should work when the limit is disabled": {
+			query:  `up + node_cpu_seconds_total + {__name__=~"node_.*"}`,
+			limits: map[string]mockLimits{"test1": {}, "test2": {}},
+		},
+		"should work for queries selecting metric names within the limit": {
+			query:  `sum(rate(http_requests_total[5m])) / sum(rate(http_requests_total{status="500"}[5m])) + up`,
+			limits: map[string]mockLimits{"test1": {maxQueryMetricNames: 2}, "test2": {maxQueryMetricNames: 2}},
+		},
+		"should fail for queries selecting more metric names than the limit": {
+			query:         `up + node_cpu_seconds_total + {__name__="go_goroutines"}`,
+			limits:        map[string]mockLimits{"test1": {maxQueryMetricNames: 2}, "test2": {maxQueryMetricNames: 2}},
+			expectedError: true,
+		},
+		"should fail for queries selecting more metric names than a one tenant limit": {
+			query:         `up + node_cpu_seconds_total`,
+			limits:        map[string]mockLimits{"test1": {maxQueryMetricNames: 1}, "test2": {maxQueryMetricNames: 0}},
+			expectedError: true,
+		},
+		"should fail for queries selecting metric names with a regexp matcher": {
+			query:         `{__name__=~"node_.*"}`,
+			limits:        map[string]mockLimits{"test1": {maxQueryMetricNames: 10}, "test2": {maxQueryMetricNames: 10}},
+			expectedError: true,
+		},
+		"should fail for queries selecting metric names with a negative regexp matcher": {
+			query:         `{__name__!~"node_.*", job="test"}`,
+			limits:        map[string]mockLimits{"test1": {maxQueryMetricNames: 10}, "test2": {maxQueryMetricNames: 10}},
+			expectedError: true,
+		},
+		"should work for queries selecting metric names with a regexp matcher if regexp matchers are ignored": {
+			query: `up + {__name__=~"node_.*"}`,
+			limits: map[string]mockLimits{
+				"test1": {maxQueryMetricNames: 1, maxQueryMetricNamesIgnoreRegexp: true},
+				"test2": {maxQueryMetricNames: 1, maxQueryMetricNamesIgnoreRegexp: true},
+			},
+		},
+		"should fail for queries selecting metric names with a regexp matcher if regexp matchers are ignored only for one tenant": {
+			query: `up + {__name__=~"node_.*"}`,
+			limits: map[string]mockLimits{
+				"test1": {maxQueryMetricNames: 1, maxQueryMetricNamesIgnoreRegexp: true},
+				"test2": {maxQueryMetricNames: 1},
+			},
+			expectedError: true,
+		},
+		"should not count non-equality matchers on other labels": {
+			query:  `up{job=~"a|b"}`,
+			limits: map[string]mockLimits{"test1": {maxQueryMetricNames: 1}, "test2": {maxQueryMetricNames: 1}},
+		},
+		"should let invalid queries through to the downstream handlers": {
+			query:  `up +`,
+			limits: map[string]mockLimits{"test1": {maxQueryMetricNames: 1}, "test2": {maxQueryMetricNames: 1}},
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			for _, req := range []Request{
+				&PrometheusRangeQueryRequest{Query: testData.query, Start: 0, End: 3600_000, Step: 60_000},
+				&PrometheusInstantQueryRequest{Query: testData.query, Time: 3600_000},
+			} {
+				tenant.WithDefaultResolver(tenant.NewMultiResolver())
+				limits := multiTenantMockLimits{byTenant: testData.limits}
+
+				var nextCalled bool
+				next := HandlerFunc(func(_ context.Context, _ Request) (Response, error) {
+					nextCalled = true
+					return &PrometheusResponse{Status: statusSuccess}, nil
+				})
+
+				ctx := user.InjectOrgID(context.Background(), "test1|test2")
+				_, err := newMaxMetricNamesMiddleware(limits).Wrap(next).Do(ctx, req)
+
+				if testData.expectedError {
+					require.Error(t, err)
+					assert.True(t, apierror.IsAPIError(err))
+					assert.Contains(t, err.Error(), "err-mimir-max-query-metric-names")
+					assert.False(t, nextCalled)
+				} else {
+					require.NoError(t, err)
+					assert.True(t, nextCalled)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,69 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package querymiddleware
+
+import (
+	"context"
+
+	"github.com/grafana/dskit/tenant"
+	"github.com/prometheus/prometheus/promql/parser"
+
+	apierror "github.com/grafana/mimir/pkg/api/error"
+	"github.com/grafana/mimir/pkg/util/validation"
+)
+
+type maxOrOperandsMiddleware struct {
+	next   Handler
+	limits Limits
+}
+
+// newMaxOrOperandsMiddleware creates a middleware that rejects queries whose top-level chain of
+// 'or' operators, like 'a or b or c', has more operands than the per-tenant limit. Such queries
+// are usually generated programmatically and each operand is executed as a distinct selection.
+func newMaxOrOperandsMiddleware(limits Limits) Middleware {
+	return MiddlewareFunc(func(next Handler) Handler {
+		return maxOrOperandsMiddleware{
+			next:   next,
+			limits: limits,
+		}
+	})
+}
+
+func (m maxOrOperandsMiddleware) Do(ctx context.Context, r Request) (Response, error) {
+	tenantIDs, err := tenant.TenantIDs(ctx)
+	if err != nil {
+		return nil, apierror.New(apierror.TypeBadData, err.Error())
+	}
+
+	maxOperands := validation.SmallestPositiveNonZeroIntPerTenant(tenantIDs, m.limits.MaxQueryOrOperands)
+	if maxOperands <= 0 {
+		return m.next.Do(ctx, r)
+	}
+
+	expr, err := parseQuery(ctx, r.GetQuery())
+	if err != nil {
+		// Let the downstream handlers report the parsing error.
+		return m.next.Do(ctx, r)
+	}
+
+	if operands := countOrOperands(expr); operands > maxOperands {
+		return nil, apierror.New(apierror.TypeBadData, validation.NewMaxQueryOrOperandsError(operands, maxOperands).Error())
+	}
+
+	return m.next.Do(ctx, r)
+}
+
+// countOrOperands returns the number of operands of the chain of 'or' operators at the top level
+// of the input expression, looking through parentheses. An expression which is not an 'or' binary
+// expression is a single operand.
+func countOrOperands(expr parser.Expr) int {
+	switch e := expr.(type) {
+	case *parser.ParenExpr:
+		return countOrOperands(e.Expr)
+	case *parser.BinaryExpr:
+		if e.Op == parser.LOR {
+			return countOrOperands(e.LHS) + countOrOperands(e.RHS)
+		}
+	}
+	return 1
+}
@@ -0,0 +1,86 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package querymiddleware
+
+import (
+	"context"
+	"testing"
+
+	"github.com/grafana/dskit/tenant"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/common/user"
+
+	apierror "github.com/grafana/mimir/pkg/api/error"
+)
+
+func TestMaxOrOperandsMiddleware(t *testing.T) {
+	tests := map[string]struct {
+		query         string
+		limits        map[string]mockLimits
+		expectedError bool
+	}{
+		"should work when the limit is disabled": {
+			query:  `a or b or c or d`,
+			limits: map[string]mockLimits{"test1": {}, "test2": {}},
+		},
+		"should work for queries with an 'or' chain at the limit": {
+			query:  `a or b or c`,
+			limits: map[string]mockLimits{"test1": {maxQueryOrOperands: 3}, "test2": {maxQueryOrOperands: 3}},
+		},
+		"should fail for queries with an 'or' chain over the limit": {
+			query:         `a or b or c or d`,
+			limits:        map[string]mockLimits{"test1": {maxQueryOrOperands: 3}, "test2": {maxQueryOrOperands: 3}},
+			expectedError: true,
+		},
+		"should fail for queries with an 'or' chain over a one tenant limit": {
+			query:         `a or b or c`,
+			limits:        map[string]mockLimits{"test1": {maxQueryOrOperands: 2}, "test2": {maxQueryOrOperands: 0}},
+			expectedError: true,
+		},
+		"should count the operands through parentheses": {
+			query:         `a or (b or (c or d))`,
+			limits:        map[string]mockLimits{"test1": {maxQueryOrOperands: 3}, "test2": {maxQueryOrOperands: 3}},
+			expectedError: true,
+		},
+		"should count an operand which is not an 'or' binary expression once": {
+			query:  `sum(a or b or c or d) or (e and f) or g + h`,
+			limits: map[string]mockLimits{"test1": {maxQueryOrOperands: 3}, "test2": {maxQueryOrOperands: 3}},
+		},
+		"should let invalid queries through to the downstream handlers": {
+			query:  `a or b or`,
+			limits: map[string]mockLimits{"test1": {maxQueryOrOperands: 1}, "test2": {maxQueryOrOperands: 1}},
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			for _, req := range []Request{
+				&PrometheusRangeQueryRequest{Query: testData.query, Start: 0, End: 3600_000, Step: 60_000},
+				&PrometheusInstantQueryRequest{Query: testData.query, Time: 3600_000},
+			} {
+				tenant.WithDefaultResolver(tenant.NewMultiResolver())
+				limits := multiTenantMockLimits{byTenant: testData.limits}
+
+				var nextCalled bool
+				next := HandlerFunc(func(_ context.Context, _ Request) (Response, error) {
+					nextCalled = true
+					return &PrometheusResponse{Status: statusSuccess}, nil
+				})
+
+				ctx := user.InjectOrgID(context.Background(), "test1|test2")
+				_, err := newMaxOrOperandsMiddleware(limits).Wrap(next).Do(ctx, req)
+
+				if testData.expectedError {
+					require.Error(t, err)
+					assert.True(t, apierror.IsAPIError(err))
+					assert.Contains(t, err.Error(), "err-mimir-max-query-or-operands")
+					assert.False(t, nextCalled)
+				} else {
+					require.NoError(t, err)
+					assert.True(t, nextCalled)
+				}
+			}
+		})
+	}
+}
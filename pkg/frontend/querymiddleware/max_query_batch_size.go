@@ -0,0 +1,91 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package querymiddleware
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+
+	"github.com/golang/snappy"
+	"github.com/grafana/dskit/tenant"
+	"github.com/prometheus/prometheus/prompb"
+
+	apierror "github.com/grafana/mimir/pkg/api/error"
+	"github.com/grafana/mimir/pkg/util/validation"
+)
+
+// batchSizeFunc returns the total size in bytes of the selectors of the batch carried by the input request.
+type batchSizeFunc func(r *http.Request) (int, error)
+
+// newMaxQueryBatchSizeRoundTripper creates a round tripper that rejects requests carrying a batch
+// of selectors, like the match[] selectors of a series request or the queries of a remote read request,
+// whose total size in bytes is greater than the per-tenant limit. These requests are not decoded into a
+// Request, so the size of the batch is computed by batchSize from the HTTP request.
+func newMaxQueryBatchSizeRoundTripper(next http.RoundTripper, limits Limits, batchSize batchSizeFunc) http.RoundTripper {
+	return RoundTripFunc(func(r *http.Request) (*http.Response, error) {
+		tenantIDs, err := tenant.TenantIDs(r.Context())
+		if err != nil {
+			return nil, apierror.New(apierror.TypeBadData, err.Error())
+		}
+
+		maxBatchSize := validation.SmallestPositiveNonZeroIntPerTenant(tenantIDs, limits.MaxQueryBatchSizeBytes)
+		if maxBatchSize <= 0 {
+			return next.RoundTrip(r)
+		}
+
+		size, err := batchSize(r)
+		if err != nil {
+			return nil, apierror.New(apierror.TypeBadData, err.Error())
+		}
+		if size > maxBatchSize {
+			return nil, apierror.New(apierror.TypeBadData, validation.NewMaxQueryBatchSizeBytesError(size, maxBatchSize).Error())
+		}
+
+		return next.RoundTrip(r)
+	})
+}
+
+// seriesRequestBatchSize returns the total size of the match[] selectors of a series request. The
+// selectors are read from the HTTP request form, which holds both the URL query and the body.
+func seriesRequestBatchSize(r *http.Request) (int, error) {
+	if err := r.ParseForm(); err != nil {
+		return 0, err
+	}
+
+	size := 0
+	for _, selector := range r.Form["match[]"] {
+		size += len(selector)
+	}
+	return size, nil
+}
+
+// remoteReadRequestBatchSize returns the total size of the label matchers of the queries of a remote
+// read request, as the sum of the size of the label name and value of each matcher. The body is
+// restored after being decoded, so that it can be forwarded as is.
+func remoteReadRequestBatchSize(r *http.Request) (int, error) {
+	compressed, err := io.ReadAll(r.Body)
+	if err != nil {
+		return 0, err
+	}
+	_ = r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(compressed))
+
+	buf, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		return 0, err
+	}
+
+	var req prompb.ReadRequest
+	if err := req.Unmarshal(buf); err != nil {
+		return 0, err
+	}
+
+	size := 0
+	for _, query := range req.Queries {
+		for _, matcher := range query.Matchers {
+			size += len(matcher.Name) + len(matcher.Value)
+		}
+	}
+	return size, nil
+}
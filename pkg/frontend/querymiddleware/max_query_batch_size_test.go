@@ -0,0 +1,194 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package querymiddleware
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/golang/snappy"
+	"github.com/grafana/dskit/tenant"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/common/user"
+
+	apierror "github.com/grafana/mimir/pkg/api/error"
+)
+
+func TestMaxQueryBatchSizeRoundTripper(t *testing.T) {
+	tests := map[string]struct {
+		method        string
+		url           string
+		body          string
+		limit         int
+		expectedError bool
+	}{
+		"limit disabled": {
+			method: http.MethodGet,
+			url:    "/api/v1/series?match[]=up&match[]=process_start_time_seconds",
+			limit:  0,
+		},
+		"batch under the limit": {
+			method: http.MethodGet,
+			url:    "/api/v1/series?match[]=up&match[]=down",
+			limit:  10,
+		},
+		"batch equal to the limit": {
+			method: http.MethodGet,
+			url:    "/api/v1/series?match[]=up&match[]=down",
+			limit:  6,
+		},
+		"batch over the limit": {
+			method:        http.MethodGet,
+			url:           "/api/v1/series?match[]=up&match[]=down",
+			limit:         5,
+			expectedError: true,
+		},
+		"single selector over the limit": {
+			method:        http.MethodGet,
+			url:           "/api/v1/series?match[]=process_start_time_seconds",
+			limit:         10,
+			expectedError: true,
+		},
+		"batch over the limit with selectors in both the URL query and the body": {
+			method:        http.MethodPost,
+			url:           "/api/v1/series?match[]=up",
+			body:          "match[]=down",
+			limit:         5,
+			expectedError: true,
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			downstreamCalled := false
+			downstream := RoundTripFunc(func(_ *http.Request) (*http.Response, error) {
+				downstreamCalled = true
+				return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+			})
+
+			req, err := http.NewRequestWithContext(user.InjectOrgID(context.Background(), "test"), testData.method, testData.url, strings.NewReader(testData.body))
+			require.NoError(t, err)
+			if testData.method == http.MethodPost {
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+
+			limits := mockLimits{maxQueryBatchSizeBytes: testData.limit}
+			_, err = newMaxQueryBatchSizeRoundTripper(downstream, limits, seriesRequestBatchSize).RoundTrip(req)
+
+			if testData.expectedError {
+				require.Error(t, err)
+				resp, ok := apierror.HTTPResponseFromError(err)
+				require.True(t, ok)
+				assert.Equal(t, http.StatusBadRequest, int(resp.Code))
+				assert.Contains(t, string(resp.Body), "err-mimir-max-query-batch-size-bytes")
+				assert.False(t, downstreamCalled)
+			} else {
+				require.NoError(t, err)
+				assert.True(t, downstreamCalled)
+			}
+		})
+	}
+}
+
+func TestMaxQueryBatchSizeRoundTripper_MultipleTenants(t *testing.T) {
+	tenant.WithDefaultResolver(tenant.NewMultiResolver())
+	limits := multiTenantMockLimits{byTenant: map[string]mockLimits{
+		"tenant-1": {maxQueryBatchSizeBytes: 0},
+		"tenant-2": {maxQueryBatchSizeBytes: 5},
+	}}
+
+	downstream := RoundTripFunc(func(_ *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+	})
+
+	req, err := http.NewRequestWithContext(user.InjectOrgID(context.Background(), "tenant-1|tenant-2"), http.MethodGet, "/api/v1/series?match[]=up&match[]=down", nil)
+	require.NoError(t, err)
+
+	// The smallest non-zero limit among the tenants is enforced.
+	_, err = newMaxQueryBatchSizeRoundTripper(downstream, limits, seriesRequestBatchSize).RoundTrip(req)
+	require.Error(t, err)
+}
+
+func TestMaxQueryBatchSizeRoundTripper_RemoteRead(t *testing.T) {
+	readReq := &prompb.ReadRequest{Queries: []*prompb.Query{
+		{Matchers: []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "up"}}},
+		{Matchers: []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "down"}, {Type: prompb.LabelMatcher_RE, Name: "job", Value: "a|b"}}},
+	}}
+	raw, err := readReq.Marshal()
+	require.NoError(t, err)
+	body := snappy.Encode(nil, raw)
+
+	// The size of each matcher is the size of its label name and value.
+	const batchSize = 10 + 12 + 6
+
+	tests := map[string]struct {
+		limit         int
+		expectedError bool
+	}{
+		"limit disabled": {
+			limit: 0,
+		},
+		"batch under the limit": {
+			limit: batchSize + 1,
+		},
+		"batch equal to the limit": {
+			limit: batchSize,
+		},
+		"batch over the limit": {
+			limit:         batchSize - 1,
+			expectedError: true,
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			var downstreamBody []byte
+			downstream := RoundTripFunc(func(r *http.Request) (*http.Response, error) {
+				var err error
+				downstreamBody, err = io.ReadAll(r.Body)
+				require.NoError(t, err)
+				return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+			})
+
+			req, err := http.NewRequestWithContext(user.InjectOrgID(context.Background(), "test"), http.MethodPost, "/prometheus/api/v1/read", bytes.NewReader(body))
+			require.NoError(t, err)
+
+			limits := mockLimits{maxQueryBatchSizeBytes: testData.limit}
+			_, err = newMaxQueryBatchSizeRoundTripper(downstream, limits, remoteReadRequestBatchSize).RoundTrip(req)
+
+			if testData.expectedError {
+				require.Error(t, err)
+				resp, ok := apierror.HTTPResponseFromError(err)
+				require.True(t, ok)
+				assert.Equal(t, http.StatusBadRequest, int(resp.Code))
+				assert.Contains(t, string(resp.Body), "err-mimir-max-query-batch-size-bytes")
+				assert.Nil(t, downstreamBody)
+			} else {
+				require.NoError(t, err)
+				// The request body is forwarded as is.
+				assert.Equal(t, body, downstreamBody)
+			}
+		})
+	}
+}
+
+func TestMaxQueryBatchSizeRoundTripper_RemoteReadInvalidBody(t *testing.T) {
+	downstream := RoundTripFunc(func(_ *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+	})
+
+	req, err := http.NewRequestWithContext(user.InjectOrgID(context.Background(), "test"), http.MethodPost, "/prometheus/api/v1/read", strings.NewReader("not snappy"))
+	require.NoError(t, err)
+
+	_, err = newMaxQueryBatchSizeRoundTripper(downstream, mockLimits{maxQueryBatchSizeBytes: 10}, remoteReadRequestBatchSize).RoundTrip(req)
+	require.Error(t, err)
+	resp, ok := apierror.HTTPResponseFromError(err)
+	require.True(t, ok)
+	assert.Equal(t, http.StatusBadRequest, int(resp.Code))
+}
@@ -0,0 +1,45 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package querymiddleware
+
+import (
+	"context"
+
+	"github.com/grafana/dskit/tenant"
+
+	apierror "github.com/grafana/mimir/pkg/api/error"
+	"github.com/grafana/mimir/pkg/util/validation"
+)
+
+type maxQueryExpressionSizeMiddleware struct {
+	next   Handler
+	limits Limits
+}
+
+// newMaxQueryExpressionSizeMiddleware creates a middleware that rejects queries whose raw
+// expression is longer, in bytes, than the per-tenant limit. The check doesn't require
+// parsing the query, so this middleware should run before any middleware parsing it.
+func newMaxQueryExpressionSizeMiddleware(limits Limits) Middleware {
+	return MiddlewareFunc(func(next Handler) Handler {
+		return maxQueryExpressionSizeMiddleware{
+			next:   next,
+			limits: limits,
+		}
+	})
+}
+
+func (m maxQueryExpressionSizeMiddleware) Do(ctx context.Context, r Request) (Response, error) {
+	tenantIDs, err := tenant.TenantIDs(ctx)
+	if err != nil {
+		return nil, apierror.New(apierror.TypeBadData, err.Error())
+	}
+
+	if maxQuerySize := validation.SmallestPositiveNonZeroIntPerTenant(tenantIDs, m.limits.MaxQueryExpressionSizeBytes); maxQuerySize > 0 {
+		querySize := len(r.GetQuery())
+		if querySize > maxQuerySize {
+			return nil, apierror.New(apierror.TypeBadData, validation.NewMaxQueryExpressionSizeBytesError(querySize, maxQuerySize).Error())
+		}
+	}
+
+	return m.next.Do(ctx, r)
+}
@@ -0,0 +1,62 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package querymiddleware
+
+import (
+	"context"
+)
+
+const (
+	// adjustedStepResponseHeader is the response header set by the max resolution middleware
+	// when the step of a range query has been increased. The value is the adjusted step, in seconds.
+	adjustedStepResponseHeader = "X-Mimir-Adjusted-Step"
+)
+
+// newMaxResolutionMiddleware creates a middleware that increases the step of range queries
+// which would return more than maxPoints points per series. The step is increased to the
+// smallest value keeping the number of points within maxPoints, while start and end are
+// left untouched.
+func newMaxResolutionMiddleware(maxPoints int) Middleware {
+	return MiddlewareFunc(func(next Handler) Handler {
+		return HandlerFunc(func(ctx context.Context, r Request) (Response, error) {
+			step := maxResolutionStep(r, maxPoints)
+			if step == r.GetStep() {
+				return next.Do(ctx, r)
+			}
+
+			adjusted := *(r.(*PrometheusRangeQueryRequest))
+			adjusted.Step = step
+
+			resp, err := next.Do(ctx, &adjusted)
+			if err != nil {
+				return nil, err
+			}
+
+			if promResp, ok := resp.(*PrometheusResponse); ok {
+				promResp.Headers = append(promResp.Headers, &PrometheusResponseHeader{
+					Name:   adjustedStepResponseHeader,
+					Values: []string{encodeDurationMs(step)},
+				})
+			}
+			return resp, nil
+		})
+	})
+}
+
+// maxResolutionStep returns the smallest step, in milliseconds, such that the range query
+// returns at most maxPoints points per series. If the request step already satisfies
+// the limit, or the request is not a range query, the request step is returned.
+func maxResolutionStep(r Request, maxPoints int) int64 {
+	if _, ok := r.(*PrometheusRangeQueryRequest); !ok || maxPoints <= 0 || r.GetStep() <= 0 {
+		return r.GetStep()
+	}
+
+	queryRange := r.GetEnd() - r.GetStart()
+	if queryRange/r.GetStep()+1 <= int64(maxPoints) {
+		return r.GetStep()
+	}
+
+	// The number of points is floor(range / step) + 1, so the smallest step
+	// keeping it within maxPoints is floor(range / maxPoints) + 1.
+	return queryRange/int64(maxPoints) + 1
+}
@@ -0,0 +1,85 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package querymiddleware
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMaxResolutionMiddleware(t *testing.T) {
+	const maxPoints = 11
+
+	tests := map[string]struct {
+		input          Request
+		expectedStep   int64
+		expectedHeader string
+	}{
+		"should not adjust the step if the query returns fewer points than the limit": {
+			input:        &PrometheusRangeQueryRequest{Start: 0, End: 50_000, Step: 10_000},
+			expectedStep: 10_000,
+		},
+		"should not adjust the step if the query returns exactly the limit of points": {
+			input:        &PrometheusRangeQueryRequest{Start: 0, End: 100_000, Step: 10_000},
+			expectedStep: 10_000,
+		},
+		"should increase the step to the smallest value keeping points within the limit": {
+			input:          &PrometheusRangeQueryRequest{Start: 0, End: 100_000, Step: 1_000},
+			expectedStep:   9_091,
+			expectedHeader: "9.091",
+		},
+		"should increase the step of a query with a non-zero start": {
+			input:          &PrometheusRangeQueryRequest{Start: 3_600_000, End: 7_200_000, Step: 15_000},
+			expectedStep:   327_273,
+			expectedHeader: "327.273",
+		},
+		"should not adjust instant queries": {
+			input:        &PrometheusInstantQueryRequest{Time: 100_000},
+			expectedStep: 0,
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			var actual Request
+			next := HandlerFunc(func(_ context.Context, req Request) (Response, error) {
+				actual = req
+				return &PrometheusResponse{Status: statusSuccess}, nil
+			})
+
+			resp, err := newMaxResolutionMiddleware(maxPoints).Wrap(next).Do(context.Background(), testData.input)
+			require.NoError(t, err)
+
+			// Start and end must be preserved.
+			assert.Equal(t, testData.input.GetStart(), actual.GetStart())
+			assert.Equal(t, testData.input.GetEnd(), actual.GetEnd())
+			assert.Equal(t, testData.expectedStep, actual.GetStep())
+
+			// The adjusted step must keep the number of points within the limit.
+			if actual.GetStep() > 0 {
+				assert.LessOrEqual(t, (actual.GetEnd()-actual.GetStart())/actual.GetStep()+1, int64(maxPoints))
+			}
+
+			if testData.expectedHeader == "" {
+				assert.Empty(t, resp.GetHeaders())
+			} else {
+				assert.Equal(t, []*PrometheusResponseHeader{{Name: adjustedStepResponseHeader, Values: []string{testData.expectedHeader}}}, resp.GetHeaders())
+			}
+		})
+	}
+}
+
+func TestMaxResolutionStep(t *testing.T) {
+	for _, step := range []time.Duration{time.Second, 15 * time.Second, time.Minute} {
+		req := &PrometheusRangeQueryRequest{Start: 0, End: (7 * 24 * time.Hour).Milliseconds(), Step: step.Milliseconds()}
+		adjusted := maxResolutionStep(req, 1000)
+
+		// The adjusted step is the smallest one returning at most the max number of points.
+		require.LessOrEqual(t, req.GetEnd()/adjusted+1, int64(1000))
+		require.Greater(t, req.GetEnd()/(adjusted-1)+1, int64(1000))
+	}
+}
@@ -0,0 +1,120 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package querymiddleware
+
+import (
+	"context"
+
+	"github.com/grafana/dskit/tenant"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+	"golang.org/x/exp/slices"
+
+	apierror "github.com/grafana/mimir/pkg/api/error"
+	"github.com/grafana/mimir/pkg/util/validation"
+)
+
+type metricAllowlistMiddleware struct {
+	next   Handler
+	limits Limits
+}
+
+// newMetricAllowlistMiddleware creates a middleware that rejects queries selecting metric names
+// which are not in the per-tenant allowlist. Regexp matchers on the metric name are allowed only
+// if they're an alternation of literal metric names, all in the allowlist, because otherwise it
+// can't be proven they don't select other metric names. Queries for multiple tenants can select
+// only the metric names allowed for all the tenants.
+func newMetricAllowlistMiddleware(limits Limits) Middleware {
+	return MiddlewareFunc(func(next Handler) Handler {
+		return metricAllowlistMiddleware{
+			next:   next,
+			limits: limits,
+		}
+	})
+}
+
+func (m metricAllowlistMiddleware) Do(ctx context.Context, r Request) (Response, error) {
+	tenantIDs, err := tenant.TenantIDs(ctx)
+	if err != nil {
+		return nil, apierror.New(apierror.TypeBadData, err.Error())
+	}
+
+	var allowlists [][]string
+	for _, tenantID := range tenantIDs {
+		if allowlist := m.limits.QueryMetricNamesAllowlist(tenantID); len(allowlist) > 0 {
+			allowlists = append(allowlists, allowlist)
+		}
+	}
+	if len(allowlists) == 0 {
+		return m.next.Do(ctx, r)
+	}
+
+	expr, err := parseQuery(ctx, r.GetQuery())
+	if err != nil {
+		// Let the downstream handlers report the parsing error.
+		return m.next.Do(ctx, r)
+	}
+
+	isAllowed := func(metricName string) bool {
+		for _, allowlist := range allowlists {
+			if !slices.Contains(allowlist, metricName) {
+				return false
+			}
+		}
+		return true
+	}
+
+	var allowErr error
+	parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+		selector, ok := node.(*parser.VectorSelector)
+		if !ok {
+			return nil
+		}
+
+		allowErr = checkSelectorMetricNamesAllowed(selector, isAllowed)
+		return allowErr
+	})
+	if allowErr != nil {
+		return nil, apierror.New(apierror.TypeBadData, allowErr.Error())
+	}
+
+	return m.next.Do(ctx, r)
+}
+
+// checkSelectorMetricNamesAllowed returns an error if the input selector may select a metric name
+// which is not allowed. A selector without any matcher on the metric name selects any metric name.
+func checkSelectorMetricNamesAllowed(selector *parser.VectorSelector, isAllowed func(string) bool) error {
+	hasMetricNameMatcher := false
+
+	for _, matcher := range selector.LabelMatchers {
+		if matcher.Name != labels.MetricName {
+			continue
+		}
+		hasMetricNameMatcher = true
+
+		switch matcher.Type {
+		case labels.MatchEqual:
+			if !isAllowed(matcher.Value) {
+				return validation.NewQueryMetricNameNotAllowedError(matcher.Value)
+			}
+		case labels.MatchRegexp:
+			// The set matches are non-empty only if the regexp is an alternation of literals.
+			setMatches := matcher.SetMatches()
+			if len(setMatches) == 0 {
+				return validation.NewQueryMetricNameMatcherNotAllowedError(matcher.String())
+			}
+			for _, metricName := range setMatches {
+				if !isAllowed(metricName) {
+					return validation.NewQueryMetricNameNotAllowedError(metricName)
+				}
+			}
+		default:
+			return validation.NewQueryMetricNameMatcherNotAllowedError(matcher.String())
+		}
+	}
+
+	if !hasMetricNameMatcher {
+		return validation.NewQueryMetricNameMatcherNotAllowedError(selector.String())
+	}
+	return nil
+}
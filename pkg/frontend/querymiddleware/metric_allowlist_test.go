@@ -0,0 +1,107 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package querymiddleware
+
+import (
+	"context"
+	"testing"
+
+	"github.com/grafana/dskit/tenant"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/common/user"
+
+	apierror "github.com/grafana/mimir/pkg/api/error"
+)
+
+func TestMetricAllowlistMiddleware(t *testing.T) {
+	allowlist := []string{"up", "http_requests_total", "node_cpu_seconds_total"}
+
+	tests := map[string]struct {
+		query         string
+		limits        map[string]mockLimits
+		expectedError bool
+	}{
+		"should work when the allowlist is disabled": {
+			query:  `go_goroutines + {job="test"}`,
+			limits: map[string]mockLimits{"test1": {}, "test2": {}},
+		},
+		"should work for queries selecting allowed metrics": {
+			query:  `sum(rate(http_requests_total{job="test"}[5m])) / up`,
+			limits: map[string]mockLimits{"test1": {queryMetricNamesAllowlist: allowlist}, "test2": {queryMetricNamesAllowlist: allowlist}},
+		},
+		"should fail for queries selecting a disallowed metric": {
+			query:         `up + go_goroutines`,
+			limits:        map[string]mockLimits{"test1": {queryMetricNamesAllowlist: allowlist}, "test2": {queryMetricNamesAllowlist: allowlist}},
+			expectedError: true,
+		},
+		"should fail for queries selecting a metric disallowed for one tenant": {
+			query:         `node_cpu_seconds_total`,
+			limits:        map[string]mockLimits{"test1": {queryMetricNamesAllowlist: allowlist}, "test2": {queryMetricNamesAllowlist: []string{"up"}}},
+			expectedError: true,
+		},
+		"should work for queries selecting a metric allowed for a tenant if the other tenant has no allowlist": {
+			query:  `node_cpu_seconds_total`,
+			limits: map[string]mockLimits{"test1": {queryMetricNamesAllowlist: allowlist}, "test2": {}},
+		},
+		"should work for queries selecting allowed metrics with a regexp of alternated literals": {
+			query:  `{__name__=~"up|http_requests_total"}`,
+			limits: map[string]mockLimits{"test1": {queryMetricNamesAllowlist: allowlist}, "test2": {queryMetricNamesAllowlist: allowlist}},
+		},
+		"should fail for queries selecting a disallowed metric with a regexp of alternated literals": {
+			query:         `{__name__=~"up|go_goroutines"}`,
+			limits:        map[string]mockLimits{"test1": {queryMetricNamesAllowlist: allowlist}, "test2": {queryMetricNamesAllowlist: allowlist}},
+			expectedError: true,
+		},
+		"should fail for queries selecting metrics with a regexp which is not an alternation of literals": {
+			query:         `{__name__=~"http_.*"}`,
+			limits:        map[string]mockLimits{"test1": {queryMetricNamesAllowlist: allowlist}, "test2": {queryMetricNamesAllowlist: allowlist}},
+			expectedError: true,
+		},
+		"should fail for queries selecting metrics with a negative matcher": {
+			query:         `{__name__!="up", job="test"}`,
+			limits:        map[string]mockLimits{"test1": {queryMetricNamesAllowlist: allowlist}, "test2": {queryMetricNamesAllowlist: allowlist}},
+			expectedError: true,
+		},
+		"should fail for queries without a matcher on the metric name": {
+			query:         `{job="test"}`,
+			limits:        map[string]mockLimits{"test1": {queryMetricNamesAllowlist: allowlist}, "test2": {queryMetricNamesAllowlist: allowlist}},
+			expectedError: true,
+		},
+		"should let invalid queries through to the downstream handlers": {
+			query:  `go_goroutines +`,
+			limits: map[string]mockLimits{"test1": {queryMetricNamesAllowlist: allowlist}, "test2": {queryMetricNamesAllowlist: allowlist}},
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			for _, req := range []Request{
+				&PrometheusRangeQueryRequest{Query: testData.query, Start: 0, End: 3600_000, Step: 60_000},
+				&PrometheusInstantQueryRequest{Query: testData.query, Time: 3600_000},
+			} {
+				tenant.WithDefaultResolver(tenant.NewMultiResolver())
+				limits := multiTenantMockLimits{byTenant: testData.limits}
+
+				var nextCalled bool
+				next := HandlerFunc(func(_ context.Context, _ Request) (Response, error) {
+					nextCalled = true
+					return &PrometheusResponse{Status: statusSuccess}, nil
+				})
+
+				ctx := user.InjectOrgID(context.Background(), "test1|test2")
+				_, err := newMetricAllowlistMiddleware(limits).Wrap(next).Do(ctx, req)
+
+				if testData.expectedError {
+					require.Error(t, err)
+					assert.True(t, apierror.IsAPIError(err))
+					assert.Contains(t, err.Error(), "err-mimir-query-metric-name-not-allowed")
+					assert.False(t, nextCalled)
+				} else {
+					require.NoError(t, err)
+					assert.True(t, nextCalled)
+				}
+			}
+		})
+	}
+}
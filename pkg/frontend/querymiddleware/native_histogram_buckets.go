@@ -0,0 +1,181 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package querymiddleware
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+
+	apierror "github.com/grafana/mimir/pkg/api/error"
+	"github.com/grafana/mimir/pkg/frontend/querymiddleware/astmapper"
+)
+
+const classicHistogramBucketSuffix = "_bucket"
+
+// parseNativeHistogramsMapping parses the input mappings, in the form <classic>:<native>, and returns
+// the native histogram name by classic histogram name.
+func parseNativeHistogramsMapping(mappings []string) (map[string]string, error) {
+	parsed := make(map[string]string, len(mappings))
+
+	for _, mapping := range mappings {
+		classic, native, ok := strings.Cut(mapping, ":")
+		if !ok || classic == "" || native == "" {
+			return nil, fmt.Errorf("the mapping %q is not in the form <classic histogram name>:<native histogram name>", mapping)
+		}
+		if _, exists := parsed[classic]; exists {
+			return nil, fmt.Errorf("the classic histogram %q is mapped more than once", classic)
+		}
+		parsed[classic] = native
+	}
+
+	return parsed, nil
+}
+
+type nativeHistogramBucketsMiddleware struct {
+	next             Handler
+	mapping          map[string]string
+	rewrittenQueries prometheus.Counter
+}
+
+// newNativeHistogramBucketsMiddleware creates a middleware that rewrites the instant vector selectors
+// of a single bucket of the classic histograms in the input mapping, like metric_bucket{le="0.5"}, to
+// compute the same cumulative count from the mapped native histogram. This changes the labels of the
+// query result, so it's strictly opt-in: the middleware is a no-op if the mapping is empty.
+func newNativeHistogramBucketsMiddleware(mapping map[string]string, reg prometheus.Registerer) Middleware {
+	rewrittenQueries := promauto.With(reg).NewCounter(prometheus.CounterOpts{
+		Name: "cortex_query_frontend_native_histogram_buckets_rewritten_queries_total",
+		Help: "Total queries whose classic histogram bucket selectors have been rewritten to query the mapped native histogram.",
+	})
+
+	return MiddlewareFunc(func(next Handler) Handler {
+		return nativeHistogramBucketsMiddleware{
+			next:             next,
+			mapping:          mapping,
+			rewrittenQueries: rewrittenQueries,
+		}
+	})
+}
+
+func (m nativeHistogramBucketsMiddleware) Do(ctx context.Context, r Request) (Response, error) {
+	if len(m.mapping) == 0 {
+		return m.next.Do(ctx, r)
+	}
+
+	expr, err := parser.ParseExpr(r.GetQuery())
+	if err != nil {
+		// Let the downstream handlers report the parsing error.
+		return m.next.Do(ctx, r)
+	}
+
+	mapper := &nativeHistogramBucketsMapper{mapping: m.mapping}
+	rewritten, err := astmapper.NewASTExprMapper(mapper).Map(expr)
+	if err != nil {
+		return nil, apierror.New(apierror.TypeBadData, err.Error())
+	}
+	if !mapper.rewritten {
+		return m.next.Do(ctx, r)
+	}
+
+	m.rewrittenQueries.Inc()
+	return m.next.Do(ctx, r.WithQuery(rewritten.String()))
+}
+
+// nativeHistogramBucketsMapper is an astmapper.ExprMapper rewriting the selectors of a single
+// classic histogram bucket to compute the same cumulative count from the mapped native histogram.
+type nativeHistogramBucketsMapper struct {
+	mapping   map[string]string
+	rewritten bool
+}
+
+// MapExpr implements astmapper.ExprMapper.
+func (m *nativeHistogramBucketsMapper) MapExpr(expr parser.Expr) (parser.Expr, bool, error) {
+	switch e := expr.(type) {
+	case *parser.MatrixSelector:
+		// Range selectors can't be rewritten, because the native histogram functions
+		// computing the bucket count only accept an instant vector.
+		return e, true, nil
+	case *parser.VectorSelector:
+		native, le, ok := m.nativeHistogramBucket(e)
+		if !ok {
+			return e, true, nil
+		}
+
+		mapped, err := nativeHistogramBucketExpr(e, native, le)
+		if err != nil {
+			return nil, false, err
+		}
+		m.rewritten = true
+		return mapped, true, nil
+	default:
+		return expr, false, nil
+	}
+}
+
+// nativeHistogramBucket returns the mapped native histogram name and the upper bound of the bucket
+// selected by the input selector, and whether the selector selects a single bucket of a mapped classic
+// histogram, through equality matchers on both the metric name and the le label.
+func (m *nativeHistogramBucketsMapper) nativeHistogramBucket(selector *parser.VectorSelector) (string, float64, bool) {
+	var native string
+	var le float64
+	var hasName, hasLe bool
+
+	for _, matcher := range selector.LabelMatchers {
+		switch {
+		case matcher.Name == labels.MetricName && matcher.Type == labels.MatchEqual:
+			if !strings.HasSuffix(matcher.Value, classicHistogramBucketSuffix) {
+				return "", 0, false
+			}
+			if native, hasName = m.mapping[strings.TrimSuffix(matcher.Value, classicHistogramBucketSuffix)]; !hasName {
+				return "", 0, false
+			}
+		case matcher.Name == labels.BucketLabel:
+			if matcher.Type != labels.MatchEqual {
+				return "", 0, false
+			}
+			var err error
+			if le, err = strconv.ParseFloat(matcher.Value, 64); err != nil {
+				return "", 0, false
+			}
+			hasLe = true
+		}
+	}
+
+	return native, le, hasName && hasLe
+}
+
+// nativeHistogramBucketExpr returns the expression computing, from the native histogram, the cumulative
+// count of the classic histogram bucket with the input upper bound. The native histogram selector keeps
+// the matchers on the other labels, the offset and the @ modifier of the classic bucket selector.
+func nativeHistogramBucketExpr(classic *parser.VectorSelector, native string, le float64) (parser.Expr, error) {
+	matchers := make([]*labels.Matcher, 0, len(classic.LabelMatchers))
+	for _, matcher := range classic.LabelMatchers {
+		if matcher.Name != labels.MetricName && matcher.Name != labels.BucketLabel {
+			matchers = append(matchers, matcher)
+		}
+	}
+
+	nameMatcher, err := labels.NewMatcher(labels.MatchEqual, labels.MetricName, native)
+	if err != nil {
+		return nil, err
+	}
+
+	selector := &parser.VectorSelector{
+		Name:           native,
+		OriginalOffset: classic.OriginalOffset,
+		Timestamp:      classic.Timestamp,
+		StartOrEnd:     classic.StartOrEnd,
+		LabelMatchers:  append(matchers, nameMatcher),
+	}
+
+	query := fmt.Sprintf("(histogram_fraction(-Inf, %s, %s) * histogram_count(%s))", strconv.FormatFloat(le, 'f', -1, 64), selector, selector)
+	expr, err := parser.ParseExpr(query)
+	return expr, errors.Wrap(err, "failed to rewrite the classic histogram bucket selector")
+}
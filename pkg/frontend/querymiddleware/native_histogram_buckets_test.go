@@ -0,0 +1,94 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package querymiddleware
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/common/user"
+)
+
+func TestNativeHistogramBucketsMiddleware(t *testing.T) {
+	mapping := map[string]string{"http_request_duration_seconds": "http_request_duration_seconds_native"}
+
+	tests := map[string]struct {
+		mapping       map[string]string
+		query         string
+		expectedQuery string
+	}{
+		"should rewrite a classic histogram bucket selector": {
+			mapping:       mapping,
+			query:         `http_request_duration_seconds_bucket{le="0.5",job="api"}`,
+			expectedQuery: `(histogram_fraction(-Inf, 0.5, http_request_duration_seconds_native{job="api"}) * histogram_count(http_request_duration_seconds_native{job="api"}))`,
+		},
+		"should rewrite the bucket selectors within the query, preserving offset and @ modifiers": {
+			mapping:       mapping,
+			query:         `sum by (job) (http_request_duration_seconds_bucket{le="+Inf"} offset 5m) / sum by (job) (http_request_duration_seconds_bucket{le="1"} @ 3600)`,
+			expectedQuery: `sum by (job) ((histogram_fraction(-Inf, +Inf, http_request_duration_seconds_native offset 5m) * histogram_count(http_request_duration_seconds_native offset 5m))) / sum by (job) ((histogram_fraction(-Inf, 1, http_request_duration_seconds_native @ 3600.000) * histogram_count(http_request_duration_seconds_native @ 3600.000)))`,
+		},
+		"should not rewrite range selectors": {
+			mapping:       mapping,
+			query:         `rate(http_request_duration_seconds_bucket{le="0.5"}[5m])`,
+			expectedQuery: `rate(http_request_duration_seconds_bucket{le="0.5"}[5m])`,
+		},
+		"should not rewrite selectors without an equality matcher on the le label": {
+			mapping:       mapping,
+			query:         `http_request_duration_seconds_bucket{le=~"0.5|1"} + http_request_duration_seconds_bucket`,
+			expectedQuery: `http_request_duration_seconds_bucket{le=~"0.5|1"} + http_request_duration_seconds_bucket`,
+		},
+		"should not rewrite classic histograms which are not mapped": {
+			mapping:       mapping,
+			query:         `grpc_request_duration_seconds_bucket{le="0.5"}`,
+			expectedQuery: `grpc_request_duration_seconds_bucket{le="0.5"}`,
+		},
+		"should not rewrite the query when no mapping is configured": {
+			mapping:       nil,
+			query:         `http_request_duration_seconds_bucket{le="0.5"}`,
+			expectedQuery: `http_request_duration_seconds_bucket{le="0.5"}`,
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			var actual Request
+			next := HandlerFunc(func(_ context.Context, req Request) (Response, error) {
+				actual = req
+				return &PrometheusResponse{Status: statusSuccess}, nil
+			})
+
+			reg := prometheus.NewPedanticRegistry()
+			ctx := user.InjectOrgID(context.Background(), "test")
+			_, err := newNativeHistogramBucketsMiddleware(testData.mapping, reg).Wrap(next).Do(ctx, &PrometheusInstantQueryRequest{Query: testData.query})
+			require.NoError(t, err)
+			assert.Equal(t, testData.expectedQuery, actual.GetQuery())
+
+			expectedRewritten := 0
+			if testData.expectedQuery != testData.query {
+				expectedRewritten = 1
+			}
+			assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(fmt.Sprintf(`
+				# HELP cortex_query_frontend_native_histogram_buckets_rewritten_queries_total Total queries whose classic histogram bucket selectors have been rewritten to query the mapped native histogram.
+				# TYPE cortex_query_frontend_native_histogram_buckets_rewritten_queries_total counter
+				cortex_query_frontend_native_histogram_buckets_rewritten_queries_total %d
+			`, expectedRewritten)), "cortex_query_frontend_native_histogram_buckets_rewritten_queries_total"))
+		})
+	}
+}
+
+func TestParseNativeHistogramsMapping(t *testing.T) {
+	parsed, err := parseNativeHistogramsMapping([]string{"a:a_native", "b:b_native"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"a": "a_native", "b": "b_native"}, parsed)
+
+	for _, invalid := range [][]string{{"a"}, {"a:"}, {":a_native"}, {"a:a_native", "a:b_native"}} {
+		_, err := parseNativeHistogramsMapping(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
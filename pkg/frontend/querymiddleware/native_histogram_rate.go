@@ -0,0 +1,151 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package querymiddleware
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+
+	apierror "github.com/grafana/mimir/pkg/api/error"
+	"github.com/grafana/mimir/pkg/frontend/querymiddleware/astmapper"
+)
+
+type nativeHistogramRateMiddleware struct {
+	next             Handler
+	mapping          map[string]string
+	rewrittenQueries prometheus.Counter
+}
+
+// newNativeHistogramRateMiddleware creates a middleware that rewrites the rate() of the classic counters
+// in the input mapping, like rate(http_requests_total[5m]), to also consider the rate of the observations
+// of the mapped native histogram, like rate(http_requests_total[5m]) or histogram_count(rate(http_request_duration_seconds[5m])).
+// This allows to query series migrated from the classic counter to the native histogram, but changes
+// the query result when only the native histogram exists, so it's strictly opt-in: the middleware is a
+// no-op if the mapping is empty.
+func newNativeHistogramRateMiddleware(mapping map[string]string, reg prometheus.Registerer) Middleware {
+	rewrittenQueries := promauto.With(reg).NewCounter(prometheus.CounterOpts{
+		Name: "cortex_query_frontend_native_histogram_rate_rewritten_queries_total",
+		Help: "Total queries whose rate of classic counters have been rewritten to also consider the mapped native histogram.",
+	})
+
+	return MiddlewareFunc(func(next Handler) Handler {
+		return nativeHistogramRateMiddleware{
+			next:             next,
+			mapping:          mapping,
+			rewrittenQueries: rewrittenQueries,
+		}
+	})
+}
+
+func (m nativeHistogramRateMiddleware) Do(ctx context.Context, r Request) (Response, error) {
+	if len(m.mapping) == 0 {
+		return m.next.Do(ctx, r)
+	}
+
+	expr, err := parser.ParseExpr(r.GetQuery())
+	if err != nil {
+		// Let the downstream handlers report the parsing error.
+		return m.next.Do(ctx, r)
+	}
+
+	mapper := &nativeHistogramRateMapper{mapping: m.mapping}
+	rewritten, err := astmapper.NewASTExprMapper(mapper).Map(expr)
+	if err != nil {
+		return nil, apierror.New(apierror.TypeBadData, err.Error())
+	}
+	if !mapper.rewritten {
+		return m.next.Do(ctx, r)
+	}
+
+	m.rewrittenQueries.Inc()
+	return m.next.Do(ctx, r.WithQuery(rewritten.String()))
+}
+
+// nativeHistogramRateMapper is an astmapper.ExprMapper rewriting the rate() of a classic counter
+// to also consider the rate of the observations of the mapped native histogram.
+type nativeHistogramRateMapper struct {
+	mapping   map[string]string
+	rewritten bool
+}
+
+// MapExpr implements astmapper.ExprMapper.
+func (m *nativeHistogramRateMapper) MapExpr(expr parser.Expr) (parser.Expr, bool, error) {
+	call, ok := expr.(*parser.Call)
+	if !ok || call.Func.Name != "rate" || len(call.Args) != 1 {
+		return expr, false, nil
+	}
+
+	// The rate of a subquery isn't rewritten, but the expressions within the subquery may be.
+	matrix, ok := call.Args[0].(*parser.MatrixSelector)
+	if !ok {
+		return expr, false, nil
+	}
+	classic, ok := matrix.VectorSelector.(*parser.VectorSelector)
+	if !ok {
+		return expr, false, nil
+	}
+
+	native, ok := m.nativeHistogram(classic)
+	if !ok {
+		return expr, true, nil
+	}
+
+	mapped, err := nativeHistogramRateExpr(call, matrix, classic, native)
+	if err != nil {
+		return nil, false, err
+	}
+	m.rewritten = true
+	return mapped, true, nil
+}
+
+// nativeHistogram returns the mapped native histogram name of the classic counter selected by
+// the input selector, and whether the selector selects a mapped classic counter through an equality
+// matcher on the metric name.
+func (m *nativeHistogramRateMapper) nativeHistogram(selector *parser.VectorSelector) (string, bool) {
+	for _, matcher := range selector.LabelMatchers {
+		if matcher.Name == labels.MetricName && matcher.Type == labels.MatchEqual {
+			native, ok := m.mapping[matcher.Value]
+			return native, ok
+		}
+	}
+	return "", false
+}
+
+// nativeHistogramRateExpr returns the expression computing the rate of the classic counter or, for
+// the series only existing as native histogram, the rate of the native histogram observations. The
+// native histogram selector keeps the range, the matchers on the other labels, the offset and the @
+// modifier of the classic counter selector.
+func nativeHistogramRateExpr(call *parser.Call, classicMatrix *parser.MatrixSelector, classic *parser.VectorSelector, native string) (parser.Expr, error) {
+	matchers := make([]*labels.Matcher, 0, len(classic.LabelMatchers))
+	for _, matcher := range classic.LabelMatchers {
+		if matcher.Name != labels.MetricName {
+			matchers = append(matchers, matcher)
+		}
+	}
+
+	nameMatcher, err := labels.NewMatcher(labels.MatchEqual, labels.MetricName, native)
+	if err != nil {
+		return nil, err
+	}
+
+	nativeMatrix := &parser.MatrixSelector{
+		VectorSelector: &parser.VectorSelector{
+			Name:           native,
+			OriginalOffset: classic.OriginalOffset,
+			Timestamp:      classic.Timestamp,
+			StartOrEnd:     classic.StartOrEnd,
+			LabelMatchers:  append(matchers, nameMatcher),
+		},
+		Range: classicMatrix.Range,
+	}
+
+	query := fmt.Sprintf("(%s or histogram_count(rate(%s)))", call, nativeMatrix)
+	expr, err := parser.ParseExpr(query)
+	return expr, errors.Wrap(err, "failed to rewrite the rate of the classic counter")
+}
@@ -0,0 +1,83 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package querymiddleware
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/common/user"
+)
+
+func TestNativeHistogramRateMiddleware(t *testing.T) {
+	mapping := map[string]string{"http_requests_total": "http_request_duration_seconds"}
+
+	tests := map[string]struct {
+		mapping       map[string]string
+		query         string
+		expectedQuery string
+	}{
+		"should rewrite the rate of a mapped classic counter": {
+			mapping:       mapping,
+			query:         `rate(http_requests_total{job="api"}[5m])`,
+			expectedQuery: `(rate(http_requests_total{job="api"}[5m]) or histogram_count(rate(http_request_duration_seconds{job="api"}[5m])))`,
+		},
+		"should rewrite the rate within the query, preserving offset and @ modifiers": {
+			mapping:       mapping,
+			query:         `sum by (job) (rate(http_requests_total[1m] offset 5m)) / sum by (job) (rate(http_requests_total[1m] @ 3600))`,
+			expectedQuery: `sum by (job) ((rate(http_requests_total[1m] offset 5m) or histogram_count(rate(http_request_duration_seconds[1m] offset 5m)))) / sum by (job) ((rate(http_requests_total[1m] @ 3600.000) or histogram_count(rate(http_request_duration_seconds[1m] @ 3600.000))))`,
+		},
+		"should not rewrite other functions": {
+			mapping:       mapping,
+			query:         `increase(http_requests_total[5m])`,
+			expectedQuery: `increase(http_requests_total[5m])`,
+		},
+		"should not rewrite selectors without an equality matcher on the metric name": {
+			mapping:       mapping,
+			query:         `rate({__name__=~"http_requests_total"}[5m])`,
+			expectedQuery: `rate({__name__=~"http_requests_total"}[5m])`,
+		},
+		"should not rewrite classic counters which are not mapped": {
+			mapping:       mapping,
+			query:         `rate(grpc_requests_total[5m])`,
+			expectedQuery: `rate(grpc_requests_total[5m])`,
+		},
+		"should not rewrite the query when no mapping is configured": {
+			mapping:       nil,
+			query:         `rate(http_requests_total[5m])`,
+			expectedQuery: `rate(http_requests_total[5m])`,
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			var actual Request
+			next := HandlerFunc(func(_ context.Context, req Request) (Response, error) {
+				actual = req
+				return &PrometheusResponse{Status: statusSuccess}, nil
+			})
+
+			reg := prometheus.NewPedanticRegistry()
+			ctx := user.InjectOrgID(context.Background(), "test")
+			_, err := newNativeHistogramRateMiddleware(testData.mapping, reg).Wrap(next).Do(ctx, &PrometheusInstantQueryRequest{Query: testData.query})
+			require.NoError(t, err)
+			assert.Equal(t, testData.expectedQuery, actual.GetQuery())
+
+			expectedRewritten := 0
+			if testData.expectedQuery != testData.query {
+				expectedRewritten = 1
+			}
+			assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(fmt.Sprintf(`
+				# HELP cortex_query_frontend_native_histogram_rate_rewritten_queries_total Total queries whose rate of classic counters have been rewritten to also consider the mapped native histogram.
+				# TYPE cortex_query_frontend_native_histogram_rate_rewritten_queries_total counter
+				cortex_query_frontend_native_histogram_rate_rewritten_queries_total %d
+			`, expectedRewritten)), "cortex_query_frontend_native_histogram_rate_rewritten_queries_total"))
+		})
+	}
+}
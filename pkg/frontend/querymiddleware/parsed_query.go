@@ -0,0 +1,60 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package querymiddleware
+
+import (
+	"context"
+	"sync"
+
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+type parsedQueryContextKey int
+
+const parsedQueryKey parsedQueryContextKey = 0
+
+// parsedQuery holds the last query parsed through parseQuery, so that the middlewares inspecting
+// the same query don't parse it once each.
+type parsedQuery struct {
+	mtx   sync.Mutex
+	query string
+	expr  parser.Expr
+	err   error
+	valid bool
+}
+
+// newParsedQueryMiddleware creates a middleware that injects in the context the holder of the query
+// parsed through parseQuery by the downstream middlewares. It must run before any of them.
+func newParsedQueryMiddleware() Middleware {
+	return MiddlewareFunc(func(next Handler) Handler {
+		return HandlerFunc(func(ctx context.Context, r Request) (Response, error) {
+			if _, ok := ctx.Value(parsedQueryKey).(*parsedQuery); ok {
+				return next.Do(ctx, r)
+			}
+			return next.Do(context.WithValue(ctx, parsedQueryKey, &parsedQuery{}), r)
+		})
+	})
+}
+
+// parseQuery returns the expression parsed from the input query, reusing the one parsed by a previous
+// call with the same query in the same request. The query is parsed again if a middleware has rewritten
+// it in the meanwhile. The returned expression is shared with the other middlewares, so callers must
+// not modify it: the middlewares rewriting the query, like the default metric name one, and anything
+// mapping the expression in-place, like the astmapper mappers or promql.PreprocessExpr, must parse their
+// own copy with parser.ParseExpr.
+func parseQuery(ctx context.Context, query string) (parser.Expr, error) {
+	holder, ok := ctx.Value(parsedQueryKey).(*parsedQuery)
+	if !ok {
+		return parser.ParseExpr(query)
+	}
+
+	holder.mtx.Lock()
+	defer holder.mtx.Unlock()
+
+	if !holder.valid || holder.query != query {
+		holder.expr, holder.err = parser.ParseExpr(query)
+		holder.query = query
+		holder.valid = true
+	}
+	return holder.expr, holder.err
+}
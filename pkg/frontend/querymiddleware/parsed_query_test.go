@@ -0,0 +1,102 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package querymiddleware
+
+import (
+	"context"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/common/user"
+)
+
+func TestParseQuery(t *testing.T) {
+	t.Run("the query is parsed once across the middlewares", func(t *testing.T) {
+		var exprs []parser.Expr
+		inspect := MiddlewareFunc(func(next Handler) Handler {
+			return HandlerFunc(func(ctx context.Context, r Request) (Response, error) {
+				expr, err := parseQuery(ctx, r.GetQuery())
+				require.NoError(t, err)
+				exprs = append(exprs, expr)
+				return next.Do(ctx, r)
+			})
+		})
+		rewrite := MiddlewareFunc(func(next Handler) Handler {
+			return HandlerFunc(func(ctx context.Context, r Request) (Response, error) {
+				return next.Do(ctx, r.WithQuery("sum(up)"))
+			})
+		})
+		downstream := HandlerFunc(func(context.Context, Request) (Response, error) {
+			return &PrometheusResponse{Status: statusSuccess}, nil
+		})
+
+		handler := MergeMiddlewares(newParsedQueryMiddleware(), inspect, inspect, rewrite, inspect, inspect).Wrap(downstream)
+		_, err := handler.Do(context.Background(), &PrometheusRangeQueryRequest{Query: "up"})
+		require.NoError(t, err)
+
+		require.Len(t, exprs, 4)
+		assert.Equal(t, "up", exprs[0].String())
+		assert.Same(t, exprs[0], exprs[1])
+		// The rewritten query is parsed again.
+		assert.Equal(t, "sum(up)", exprs[2].String())
+		assert.Same(t, exprs[2], exprs[3])
+	})
+
+	t.Run("the rewriting middlewares don't modify the shared expression", func(t *testing.T) {
+		var exprs []parser.Expr
+		inspect := MiddlewareFunc(func(next Handler) Handler {
+			return HandlerFunc(func(ctx context.Context, r Request) (Response, error) {
+				expr, err := parseQuery(ctx, r.GetQuery())
+				require.NoError(t, err)
+				exprs = append(exprs, expr)
+				return next.Do(ctx, r)
+			})
+		})
+		var downstreamQuery string
+		downstream := HandlerFunc(func(_ context.Context, r Request) (Response, error) {
+			downstreamQuery = r.GetQuery()
+			return &PrometheusResponse{Status: statusSuccess}, nil
+		})
+
+		const query = `sum(rate(http_requests_total[5m])) / sum(rate({job="api"}[5m]))`
+		handler := MergeMiddlewares(
+			newParsedQueryMiddleware(),
+			inspect,
+			newDefaultMetricNameMiddleware(mockLimits{defaultMetricNameRegexp: "http_.+"}, prometheus.NewPedanticRegistry()),
+			inspect,
+			newNativeHistogramRateMiddleware(map[string]string{"http_requests_total": "http_request_duration_seconds"}, prometheus.NewPedanticRegistry()),
+			inspect,
+		).Wrap(downstream)
+		_, err := handler.Do(user.InjectOrgID(context.Background(), "test"), &PrometheusRangeQueryRequest{Query: query})
+		require.NoError(t, err)
+
+		// Each middleware sees the query it received, not the one modified by the downstream middlewares.
+		require.Len(t, exprs, 3)
+		assert.Equal(t, query, exprs[0].String())
+		assert.Equal(t, `sum(rate(http_requests_total[5m])) / sum(rate({__name__=~"http_.+",job="api"}[5m]))`, exprs[1].String())
+		assert.Equal(t, downstreamQuery, exprs[2].String())
+		assert.NotEqual(t, exprs[1].String(), exprs[2].String())
+	})
+
+	t.Run("the parsing error is returned", func(t *testing.T) {
+		ctx := context.WithValue(context.Background(), parsedQueryKey, &parsedQuery{})
+
+		_, err := parseQuery(ctx, "up{")
+		require.Error(t, err)
+		_, err = parseQuery(ctx, "up{")
+		require.Error(t, err)
+	})
+
+	t.Run("the query is parsed without the middleware", func(t *testing.T) {
+		first, err := parseQuery(context.Background(), "up")
+		require.NoError(t, err)
+		second, err := parseQuery(context.Background(), "up")
+		require.NoError(t, err)
+
+		assert.Equal(t, "up", first.String())
+		assert.NotSame(t, first, second)
+	})
+}
@@ -0,0 +1,87 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package querymiddleware
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/grafana/dskit/tenant"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+
+	"github.com/grafana/mimir/pkg/util/spanlogger"
+)
+
+type queryStatsLogMiddleware struct {
+	next   Handler
+	logger log.Logger
+	now    func() time.Time
+}
+
+// newQueryStatsLogMiddleware creates a middleware that logs a single line for each query, with
+// statistics about the query and the time taken by the downstream handlers to execute it. This
+// complements the metrics tracked by the query stats middleware with per-query detail. The
+// middleware is a no-op if not enabled.
+func newQueryStatsLogMiddleware(enabled bool, logger log.Logger) Middleware {
+	return MiddlewareFunc(func(next Handler) Handler {
+		if !enabled {
+			return next
+		}
+		return queryStatsLogMiddleware{
+			next:   next,
+			logger: logger,
+			now:    time.Now,
+		}
+	})
+}
+
+func (m queryStatsLogMiddleware) Do(ctx context.Context, req Request) (Response, error) {
+	start := m.now()
+	resp, err := m.next.Do(ctx, req)
+	elapsed := m.now().Sub(start)
+
+	fields := []interface{}{
+		"msg", "query stats",
+		"query", req.GetQuery(),
+		"range", time.Duration(req.GetEnd()-req.GetStart()) * time.Millisecond,
+		"step", time.Duration(req.GetStep()) * time.Millisecond,
+	}
+	if tenantIDs, tenantErr := tenant.TenantIDs(ctx); tenantErr == nil {
+		fields = append(fields, "user", tenant.JoinTenantIDs(tenantIDs))
+	}
+	// Queries failing to parse are logged without the statistics computed on the parsed expression.
+	if expr, parseErr := parseQuery(ctx, req.GetQuery()); parseErr == nil {
+		selectors, regexpMatchers, subqueries := queryExpressionStats(expr)
+		fields = append(fields, "selectors", selectors, "regexp_matchers", regexpMatchers, "subqueries", subqueries)
+	}
+	fields = append(fields, "duration", elapsed)
+	if err != nil {
+		fields = append(fields, "err", err)
+	}
+
+	level.Info(spanlogger.FromContext(ctx, m.logger)).Log(fields...)
+	return resp, err
+}
+
+// queryExpressionStats returns the number of vector selectors, regexp matchers and subqueries
+// in the input expression.
+func queryExpressionStats(expr parser.Expr) (selectors, regexpMatchers, subqueries int) {
+	parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+		switch n := node.(type) {
+		case *parser.VectorSelector:
+			selectors++
+			for _, matcher := range n.LabelMatchers {
+				if matcher.Type == labels.MatchRegexp || matcher.Type == labels.MatchNotRegexp {
+					regexpMatchers++
+				}
+			}
+		case *parser.SubqueryExpr:
+			subqueries++
+		}
+		return nil
+	})
+	return
+}
@@ -0,0 +1,122 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package querymiddleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/common/user"
+)
+
+// capturingLogger records the fields of each logged line.
+type capturingLogger struct {
+	mtx   sync.Mutex
+	lines []map[string]string
+}
+
+func (l *capturingLogger) Log(keyvals ...interface{}) error {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	line := map[string]string{}
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		line[fmt.Sprint(keyvals[i])] = fmt.Sprint(keyvals[i+1])
+	}
+	l.lines = append(l.lines, line)
+	return nil
+}
+
+func TestQueryStatsLogMiddleware(t *testing.T) {
+	tests := map[string]struct {
+		query          string
+		downstreamErr  error
+		expectedFields map[string]string
+		missingFields  []string
+	}{
+		"query with selectors, regexp matchers and subqueries": {
+			query: `sum(rate(foo{job=~"a|b", pod!~"x.*"}[5m])) / max_over_time(bar{job="a"}[1h:1m])`,
+			expectedFields: map[string]string{
+				"msg":             "query stats",
+				"level":           "info",
+				"user":            "test",
+				"range":           "1h0m0s",
+				"step":            "1m0s",
+				"selectors":       "2",
+				"regexp_matchers": "2",
+				"subqueries":      "1",
+				"duration":        "250ms",
+			},
+			missingFields: []string{"err"},
+		},
+		"failed query": {
+			query:         "up",
+			downstreamErr: errors.New("downstream failure"),
+			expectedFields: map[string]string{
+				"selectors":       "1",
+				"regexp_matchers": "0",
+				"subqueries":      "0",
+				"err":             "downstream failure",
+			},
+		},
+		"query failing to parse": {
+			query: "up{",
+			expectedFields: map[string]string{
+				"query": "up{",
+			},
+			missingFields: []string{"selectors", "regexp_matchers", "subqueries"},
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			logger := &capturingLogger{}
+			next := HandlerFunc(func(_ context.Context, _ Request) (Response, error) {
+				return &PrometheusResponse{Status: statusSuccess}, testData.downstreamErr
+			})
+			handler := newQueryStatsLogMiddleware(true, logger).Wrap(next).(queryStatsLogMiddleware)
+
+			// Stub the clock so that the downstream handlers take a fixed time.
+			start := time.Now()
+			calls := 0
+			handler.now = func() time.Time {
+				calls++
+				if calls == 1 {
+					return start
+				}
+				return start.Add(250 * time.Millisecond)
+			}
+
+			_, err := handler.Do(user.InjectOrgID(context.Background(), "test"), &PrometheusRangeQueryRequest{Query: testData.query, Start: 0, End: 3600_000, Step: 60_000})
+			assert.Equal(t, testData.downstreamErr, err)
+
+			require.Len(t, logger.lines, 1)
+			line := logger.lines[0]
+			assert.Equal(t, testData.query, line["query"])
+			for name, value := range testData.expectedFields {
+				assert.Equal(t, value, line[name], "field %s", name)
+			}
+			for _, name := range testData.missingFields {
+				assert.NotContains(t, line, name)
+			}
+		})
+	}
+}
+
+func TestQueryStatsLogMiddleware_Disabled(t *testing.T) {
+	logger := &capturingLogger{}
+	next := HandlerFunc(func(_ context.Context, _ Request) (Response, error) {
+		return &PrometheusResponse{Status: statusSuccess}, nil
+	})
+
+	_, err := newQueryStatsLogMiddleware(false, log.Logger(logger)).Wrap(next).Do(user.InjectOrgID(context.Background(), "test"), &PrometheusRangeQueryRequest{Query: "up", Start: 0, End: 3600_000, Step: 60_000})
+	require.NoError(t, err)
+	assert.Empty(t, logger.lines)
+}
@@ -0,0 +1,118 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package querymiddleware
+
+import (
+	"context"
+	"time"
+
+	"github.com/grafana/dskit/tenant"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/atomic"
+
+	"github.com/grafana/mimir/pkg/util"
+)
+
+type resultsCacheLookupsContextKey int
+
+const resultsCacheLookupsKey resultsCacheLookupsContextKey = 0
+
+// resultsCacheLookups records the outcome of the results cache lookups done while
+// executing a query. It's injected in the context by the results cache tracking
+// middleware and updated by the results cache layer.
+type resultsCacheLookups struct {
+	hits   atomic.Uint32
+	misses atomic.Uint32
+}
+
+// contextWithResultsCacheLookups returns a new context carrying a resultsCacheLookups
+// to be updated by the results cache layer.
+func contextWithResultsCacheLookups(ctx context.Context) (*resultsCacheLookups, context.Context) {
+	lookups := &resultsCacheLookups{}
+	return lookups, context.WithValue(ctx, resultsCacheLookupsKey, lookups)
+}
+
+// resultsCacheLookupsFromContext returns the resultsCacheLookups injected in the context,
+// or nil if the results cache lookups are not tracked.
+func resultsCacheLookupsFromContext(ctx context.Context) *resultsCacheLookups {
+	lookups, _ := ctx.Value(resultsCacheLookupsKey).(*resultsCacheLookups)
+	return lookups
+}
+
+// addHit records a lookup whose response has been entirely fetched from the results cache.
+// It's safe to call on a nil resultsCacheLookups.
+func (l *resultsCacheLookups) addHit() {
+	if l != nil {
+		l.hits.Inc()
+	}
+}
+
+// addMiss records a lookup whose response has not been entirely fetched from the results cache.
+// It's safe to call on a nil resultsCacheLookups.
+func (l *resultsCacheLookups) addMiss() {
+	if l != nil {
+		l.misses.Inc()
+	}
+}
+
+// resultsCacheTracking holds the state shared by all the handlers wrapped by the same
+// results cache tracking middleware.
+type resultsCacheTracking struct {
+	requests    *prometheus.CounterVec
+	activeUsers *util.ActiveUsersCleanupService
+}
+
+// cleanupInactiveUser removes the metrics of a tenant which hasn't run any query recently.
+func (t *resultsCacheTracking) cleanupInactiveUser(userID string) {
+	t.requests.DeletePartialMatch(prometheus.Labels{"user": userID})
+}
+
+type resultsCacheTrackingMiddleware struct {
+	next     Handler
+	tracking *resultsCacheTracking
+}
+
+// newResultsCacheTrackingMiddleware creates a middleware that tracks, for each tenant, the
+// number of results cache lookups which were a hit or miss while executing the query. The
+// metrics of tenants which haven't run any query recently are removed.
+func newResultsCacheTrackingMiddleware(reg prometheus.Registerer) Middleware {
+	tracking := &resultsCacheTracking{
+		requests: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "cortex_query_frontend_results_cache_requests_total",
+			Help: "Total number of results cache lookups done by the query-frontend, by tenant and result. A lookup is a hit only if the response has been entirely fetched from the results cache.",
+		}, []string{"user", "result"}),
+	}
+	tracking.activeUsers = util.NewActiveUsersCleanupWithDefaultValues(tracking.cleanupInactiveUser)
+
+	// Start cleanup. If cleaner stops or fail, we will simply not clean the metrics for inactive users.
+	_ = tracking.activeUsers.StartAsync(context.Background())
+
+	return MiddlewareFunc(func(next Handler) Handler {
+		return resultsCacheTrackingMiddleware{
+			next:     next,
+			tracking: tracking,
+		}
+	})
+}
+
+func (m resultsCacheTrackingMiddleware) Do(ctx context.Context, req Request) (Response, error) {
+	tenantIDs, err := tenant.TenantIDs(ctx)
+	if err != nil {
+		return m.next.Do(ctx, req)
+	}
+
+	lookups, ctx := contextWithResultsCacheLookups(ctx)
+	resp, err := m.next.Do(ctx, req)
+
+	userID := tenant.JoinTenantIDs(tenantIDs)
+	m.tracking.activeUsers.UpdateUserTimestamp(userID, time.Now())
+	if hits := lookups.hits.Load(); hits > 0 {
+		m.tracking.requests.WithLabelValues(userID, "hit").Add(float64(hits))
+	}
+	if misses := lookups.misses.Load(); misses > 0 {
+		m.tracking.requests.WithLabelValues(userID, "miss").Add(float64(misses))
+	}
+
+	return resp, err
+}
@@ -0,0 +1,109 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package querymiddleware
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/common/user"
+)
+
+func TestResultsCacheTrackingMiddleware(t *testing.T) {
+	tests := map[string]struct {
+		hits, misses    int
+		expectedMetrics string
+	}{
+		"no results cache lookups": {
+			expectedMetrics: ``,
+		},
+		"results cache hit": {
+			hits: 1,
+			expectedMetrics: `
+				# HELP cortex_query_frontend_results_cache_requests_total Total number of results cache lookups done by the query-frontend, by tenant and result. A lookup is a hit only if the response has been entirely fetched from the results cache.
+				# TYPE cortex_query_frontend_results_cache_requests_total counter
+				cortex_query_frontend_results_cache_requests_total{result="hit",user="test"} 1
+			`,
+		},
+		"results cache miss": {
+			misses: 1,
+			expectedMetrics: `
+				# HELP cortex_query_frontend_results_cache_requests_total Total number of results cache lookups done by the query-frontend, by tenant and result. A lookup is a hit only if the response has been entirely fetched from the results cache.
+				# TYPE cortex_query_frontend_results_cache_requests_total counter
+				cortex_query_frontend_results_cache_requests_total{result="miss",user="test"} 1
+			`,
+		},
+		"results cache hits and misses": {
+			hits:   2,
+			misses: 3,
+			expectedMetrics: `
+				# HELP cortex_query_frontend_results_cache_requests_total Total number of results cache lookups done by the query-frontend, by tenant and result. A lookup is a hit only if the response has been entirely fetched from the results cache.
+				# TYPE cortex_query_frontend_results_cache_requests_total counter
+				cortex_query_frontend_results_cache_requests_total{result="hit",user="test"} 2
+				cortex_query_frontend_results_cache_requests_total{result="miss",user="test"} 3
+			`,
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			// Simulate the results cache layer recording the lookups outcome.
+			next := HandlerFunc(func(ctx context.Context, _ Request) (Response, error) {
+				lookups := resultsCacheLookupsFromContext(ctx)
+				require.NotNil(t, lookups)
+
+				for i := 0; i < testData.hits; i++ {
+					lookups.addHit()
+				}
+				for i := 0; i < testData.misses; i++ {
+					lookups.addMiss()
+				}
+				return &PrometheusResponse{Status: statusSuccess}, nil
+			})
+
+			reg := prometheus.NewPedanticRegistry()
+			ctx := user.InjectOrgID(context.Background(), "test")
+			_, err := newResultsCacheTrackingMiddleware(reg).Wrap(next).Do(ctx, &PrometheusRangeQueryRequest{Query: "up"})
+			require.NoError(t, err)
+
+			assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(testData.expectedMetrics), "cortex_query_frontend_results_cache_requests_total"))
+		})
+	}
+}
+
+func TestResultsCacheTrackingMiddleware_CleanupInactiveUser(t *testing.T) {
+	next := HandlerFunc(func(ctx context.Context, _ Request) (Response, error) {
+		resultsCacheLookupsFromContext(ctx).addHit()
+		return &PrometheusResponse{Status: statusSuccess}, nil
+	})
+
+	reg := prometheus.NewPedanticRegistry()
+	handler := newResultsCacheTrackingMiddleware(reg).Wrap(next).(resultsCacheTrackingMiddleware)
+	for _, userID := range []string{"user-1", "user-2"} {
+		_, err := handler.Do(user.InjectOrgID(context.Background(), userID), &PrometheusRangeQueryRequest{Query: "up"})
+		require.NoError(t, err)
+	}
+
+	// The metrics of the inactive tenant are removed, while the others are kept.
+	handler.tracking.cleanupInactiveUser("user-1")
+
+	assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+		# HELP cortex_query_frontend_results_cache_requests_total Total number of results cache lookups done by the query-frontend, by tenant and result. A lookup is a hit only if the response has been entirely fetched from the results cache.
+		# TYPE cortex_query_frontend_results_cache_requests_total counter
+		cortex_query_frontend_results_cache_requests_total{result="hit",user="user-2"} 1
+	`), "cortex_query_frontend_results_cache_requests_total"))
+}
+
+func TestResultsCacheLookups_NotTracked(t *testing.T) {
+	lookups := resultsCacheLookupsFromContext(context.Background())
+	assert.Nil(t, lookups)
+
+	// Recording the outcome of lookups must not panic when they are not tracked.
+	lookups.addHit()
+	lookups.addMiss()
+}
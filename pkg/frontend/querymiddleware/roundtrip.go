@@ -9,13 +9,16 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"io"
 	"net/http"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/go-kit/log"
 	"github.com/grafana/dskit/cache"
+	"github.com/grafana/dskit/flagext"
 	"github.com/grafana/dskit/tenant"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
@@ -23,6 +26,7 @@ import (
 	"github.com/prometheus/prometheus/promql"
 	"golang.org/x/exp/slices"
 
+	apierror "github.com/grafana/mimir/pkg/api/error"
 	"github.com/grafana/mimir/pkg/util"
 )
 
@@ -30,18 +34,46 @@ const (
 	day                    = 24 * time.Hour
 	queryRangePathSuffix   = "/query_range"
 	instantQueryPathSuffix = "/query"
+	seriesPathSuffix       = "/series"
+	labelNamesPathSuffix   = "/labels"
+	exemplarsPathSuffix    = "/query_exemplars"
+	remoteReadPathSuffix   = "/api/v1/read"
+
+	endpointRange       = "range"
+	endpointInstant     = "instant"
+	endpointSeries      = "series"
+	endpointLabels      = "labels"
+	endpointLabelValues = "label_values"
+	endpointExemplars   = "exemplars"
+	endpointOther       = "other"
+
+	maxWithoutAggregationKeptLabelsFlag = "query-frontend.max-without-aggregation-kept-labels"
 )
 
+var labelValuesPathRegexp = regexp.MustCompile(`/label/[^/]+/values$`)
+
 // Config for query_range middleware chain.
 type Config struct {
-	SplitQueriesByInterval time.Duration `yaml:"split_queries_by_interval" category:"advanced"`
-	AlignQueriesWithStep   bool          `yaml:"align_queries_with_step"`
-	ResultsCacheConfig     `yaml:"results_cache"`
-	CacheResults           bool   `yaml:"cache_results"`
-	MaxRetries             int    `yaml:"max_retries" category:"advanced"`
-	ShardedQueries         bool   `yaml:"parallelize_shardable_queries"`
-	CacheUnalignedRequests bool   `yaml:"cache_unaligned_requests" category:"advanced"`
-	TargetSeriesPerShard   uint64 `yaml:"query_sharding_target_series_per_shard" category:"experimental"`
+	SplitQueriesByInterval          time.Duration `yaml:"split_queries_by_interval" category:"advanced"`
+	AlignQueriesWithStep            bool          `yaml:"align_queries_with_step"`
+	ResultsCacheConfig              `yaml:"results_cache"`
+	CacheResults                    bool          `yaml:"cache_results"`
+	CacheResultsPerTenantMetrics    bool          `yaml:"cache_results_per_tenant_metrics" category:"experimental"`
+	MaxRetries                      int           `yaml:"max_retries" category:"advanced"`
+	ShardedQueries                  bool          `yaml:"parallelize_shardable_queries"`
+	CacheUnalignedRequests          bool          `yaml:"cache_unaligned_requests" category:"advanced"`
+	TargetSeriesPerShard            uint64        `yaml:"query_sharding_target_series_per_shard" category:"experimental"`
+	MaxResolutionPoints             int           `yaml:"max_resolution_points" category:"experimental"`
+	AtModifierOutOfRangeDelta       time.Duration `yaml:"at_modifier_out_of_range_delta" category:"experimental"`
+	MaxWithoutAggregationKeptLabels int           `yaml:"max_without_aggregation_kept_labels" category:"experimental"`
+	MaxConcurrentQueriesWait        time.Duration `yaml:"max_concurrent_queries_wait" category:"experimental"`
+	SlowQueryParseThreshold         time.Duration `yaml:"slow_query_parse_threshold" category:"experimental"`
+	OverResolvedQueriesPoints       int           `yaml:"over_resolved_queries_points" category:"experimental"`
+	LookbackDeltaResponseHeader     bool          `yaml:"lookback_delta_response_header" category:"experimental"`
+	LogQueryStats                   bool          `yaml:"log_query_stats" category:"experimental"`
+
+	NativeHistogramsMapping     flagext.StringSliceCSV `yaml:"native_histograms_mapping" category:"experimental"`
+	NativeHistogramsRateMapping flagext.StringSliceCSV `yaml:"native_histograms_rate_mapping" category:"experimental"`
 
 	// CacheSplitter allows to inject a CacheSplitter to use for generating cache keys.
 	// If nil, the querymiddleware package uses a ConstSplitter with SplitQueriesByInterval.
@@ -56,9 +88,20 @@ func (cfg *Config) RegisterFlags(f *flag.FlagSet) {
 	f.DurationVar(&cfg.SplitQueriesByInterval, "query-frontend.split-queries-by-interval", 24*time.Hour, "Split range queries by an interval and execute in parallel. You should use a multiple of 24 hours to optimize querying blocks. 0 to disable it.")
 	f.BoolVar(&cfg.AlignQueriesWithStep, "query-frontend.align-queries-with-step", false, "Mutate incoming queries to align their start and end with their step.")
 	f.BoolVar(&cfg.CacheResults, "query-frontend.cache-results", false, "Cache query results.")
+	f.BoolVar(&cfg.CacheResultsPerTenantMetrics, "query-frontend.cache-results-per-tenant-metrics", false, "True to track the results cache hits and misses for each tenant in the cortex_query_frontend_results_cache_requests_total metric. Applies only if -query-frontend.cache-results is enabled.")
 	f.BoolVar(&cfg.ShardedQueries, "query-frontend.parallelize-shardable-queries", false, "True to enable query sharding.")
 	f.BoolVar(&cfg.CacheUnalignedRequests, "query-frontend.cache-unaligned-requests", false, "Cache requests that are not step-aligned.")
 	f.Uint64Var(&cfg.TargetSeriesPerShard, "query-frontend.query-sharding-target-series-per-shard", 0, "How many series a single sharded partial query should load at most. This is not a strict requirement guaranteed to be honoured by query sharding, but a hint given to the query sharding when the query execution is initially planned. 0 to disable cardinality-based hints.")
+	f.IntVar(&cfg.MaxResolutionPoints, "query-frontend.max-resolution-points", 0, "Maximum number of points per series a range query can return. If a range query would return more points, its step is increased to the smallest value keeping the number of points within this limit, and the adjusted step is returned in the "+adjustedStepResponseHeader+" response header. 0 to disable.")
+	f.DurationVar(&cfg.AtModifierOutOfRangeDelta, "query-frontend.at-modifier-out-of-range-delta", 24*time.Hour, "Queries using the @ modifier with a timestamp more than this delta before the start or after the end of the query time range are tracked in the cortex_query_frontend_at_modifier_out_of_range_queries_total metric.")
+	f.IntVar(&cfg.MaxWithoutAggregationKeptLabels, maxWithoutAggregationKeptLabelsFlag, 0, "Maximum number of labels an aggregation using the without clause can keep. Queries with an aggregation keeping more labels are rejected, because the aggregation is assumed to not reduce the number of output series enough. This is a heuristic, since the labels kept depend on the labels of the aggregated series: they're assumed to be 10, other than the metric name, unless the aggregated series are the output of an aggregation using the by clause. 0 to disable.")
+	f.DurationVar(&cfg.MaxConcurrentQueriesWait, "query-frontend.max-concurrent-queries-wait", time.Second, "How long a query of a tenant exceeding -query-frontend.max-concurrent-queries-per-tenant waits for another query of the tenant to complete, before being rejected.")
+	f.DurationVar(&cfg.SlowQueryParseThreshold, "query-frontend.slow-query-parse-threshold", time.Second, "Queries taking longer than this threshold to parse are logged. 0 to disable.")
+	f.IntVar(&cfg.OverResolvedQueriesPoints, "query-frontend.over-resolved-queries-points", 0, "Range queries returning more than this number of points per series are tracked in the cortex_query_frontend_over_resolved_queries_total metric. This allows to estimate how many queries -query-frontend.max-resolution-points would adjust, before enabling it. 0 to disable.")
+	f.BoolVar(&cfg.LookbackDeltaResponseHeader, "query-frontend.lookback-delta-response-header", false, "True to return the lookback delta used to evaluate range and instant queries, in seconds, in the "+lookbackDeltaResponseHeader+" response header.")
+	f.BoolVar(&cfg.LogQueryStats, "query-frontend.log-query-stats", false, "True to log a line for each range and instant query, with the tenant, query, range, step, number of selectors, regular expression matchers and subqueries, and the time taken to execute the query.")
+	f.Var(&cfg.NativeHistogramsMapping, "query-frontend.native-histograms-mapping", "Comma-separated list of mappings from a classic histogram to the native histogram with the same observations, in the form <classic histogram name>:<native histogram name>, where the classic histogram name doesn't include the _bucket suffix. Instant vector selectors of a single bucket of a mapped classic histogram, having an equality matcher on the le label, are rewritten to query the native histogram instead. The rewritten query returns series without the metric name and le label. Empty to disable.")
+	f.Var(&cfg.NativeHistogramsRateMapping, "query-frontend.native-histograms-rate-mapping", "Comma-separated list of mappings from a classic counter to the native histogram whose observations count the same events, in the form <classic counter name>:<native histogram name>. The rate() of a selector of a mapped classic counter, having an equality matcher on the metric name, is rewritten to also return, for the series only existing as native histogram, the rate of the native histogram observations. This is meant to be used while migrating from the classic counter to the native histogram. Empty to disable.")
 	f.StringVar(&cfg.QueryResultResponseFormat, "query-frontend.query-result-response-format", formatProtobuf, fmt.Sprintf("Format to use when retrieving query results from queriers. Supported values: %s", strings.Join(allFormats, ", ")))
 	cfg.ResultsCacheConfig.RegisterFlags(f)
 }
@@ -77,6 +120,14 @@ func (cfg *Config) Validate() error {
 		}
 	}
 
+	if _, err := parseNativeHistogramsMapping(cfg.NativeHistogramsMapping); err != nil {
+		return errors.Wrap(err, "invalid query-frontend native histograms mapping")
+	}
+
+	if _, err := parseNativeHistogramsMapping(cfg.NativeHistogramsRateMapping); err != nil {
+		return errors.Wrap(err, "invalid query-frontend native histograms rate mapping")
+	}
+
 	if !slices.Contains(allFormats, cfg.QueryResultResponseFormat) {
 		return fmt.Errorf("unknown query result response format '%s'. Supported values: %s", cfg.QueryResultResponseFormat, strings.Join(allFormats, ", "))
 	}
@@ -163,6 +214,7 @@ func NewTripperware(
 	}
 	return MergeTripperwares(
 		newActiveUsersTripperware(registerer),
+		newRequestsByEndpointTripperware(registerer),
 		queryRangeTripperware,
 	), err
 }
@@ -183,10 +235,61 @@ func newQueryTripperware(
 	// Metric used to keep track of each middleware execution duration.
 	metrics := newInstrumentMiddlewareMetrics(registerer)
 
+	// The concurrency middleware is shared between range and instant queries, so that
+	// both count towards the same per-tenant limit.
+	concurrencyMiddleware := newPerTenantConcurrencyMiddleware(limits, cfg.MaxConcurrentQueriesWait)
+
+	// The case-insensitive metric names middleware is shared between range and instant queries,
+	// because the metric it tracks can be registered only once.
+	caseInsensitiveMetricNamesMiddleware := newCaseInsensitiveMetricNamesMiddleware(limits, registerer)
+	defaultMetricNameMiddleware := newDefaultMetricNameMiddleware(limits, registerer)
+
+	// Same for the native histogram buckets middleware, which is a no-op if no mapping is configured.
+	nativeHistogramsMapping, err := parseNativeHistogramsMapping(cfg.NativeHistogramsMapping)
+	if err != nil {
+		return nil, err
+	}
+	nativeHistogramBucketsMiddleware := newNativeHistogramBucketsMiddleware(nativeHistogramsMapping, registerer)
+	nativeHistogramsRateMapping, err := parseNativeHistogramsMapping(cfg.NativeHistogramsRateMapping)
+	if err != nil {
+		return nil, err
+	}
+	nativeHistogramRateMiddleware := newNativeHistogramRateMiddleware(nativeHistogramsRateMapping, registerer)
+
 	queryRangeMiddleware := []Middleware{
-		// Track query range statistics. Added first before any subsequent middleware modifies the request.
-		newQueryStatsMiddleware(registerer),
+		// Reject queries exceeding the max expression size before they get parsed.
+		newMaxQueryExpressionSizeMiddleware(limits),
+		// Share the parsed query across the middlewares inspecting it, instead of parsing it once each.
+		newParsedQueryMiddleware(),
+		// Track query range statistics. Added before any subsequent middleware modifies the request.
+		newQueryStatsMiddleware(registerer, log, newBlocksRetentionEarliestDataTime(limits, time.Now), cfg.AtModifierOutOfRangeDelta, cfg.SlowQueryParseThreshold, cfg.OverResolvedQueriesPoints, limits.AssumedScrapeInterval, limits.QueryShardingTotalShards),
+		newQueryStatsLogMiddleware(cfg.LogQueryStats, log),
+		newStoreRetentionMiddleware(limits),
 		newLimitsMiddleware(limits, log),
+		newUnknownFunctionMiddleware(),
+		newEmptyMetricNameMiddleware(),
+		newDuplicateGroupingLabelsMiddleware(),
+		newMaxMetricNamesMiddleware(limits),
+		newMaxOrOperandsMiddleware(limits),
+		newSubqueryStepMiddleware(limits),
+		newMatchAllRegexpMiddleware(limits),
+		newMetricAllowlistMiddleware(limits),
+		defaultMetricNameMiddleware,
+		// Rewrite classic histogram buckets and counters before the metric names are made case-insensitive,
+		// otherwise the classic metric names wouldn't be recognized anymore.
+		nativeHistogramBucketsMiddleware,
+		nativeHistogramRateMiddleware,
+		caseInsensitiveMetricNamesMiddleware,
+		concurrencyMiddleware,
+	}
+	if cfg.LookbackDeltaResponseHeader {
+		queryRangeMiddleware = append(queryRangeMiddleware, newLookbackDeltaMiddleware(engineOpts.LookbackDelta))
+	}
+	if cfg.MaxWithoutAggregationKeptLabels > 0 {
+		queryRangeMiddleware = append(queryRangeMiddleware, newInstrumentMiddleware("without_aggregation", metrics, log), newWithoutAggregationMiddleware(cfg.MaxWithoutAggregationKeptLabels))
+	}
+	if cfg.MaxResolutionPoints > 0 {
+		queryRangeMiddleware = append(queryRangeMiddleware, newInstrumentMiddleware("max_resolution", metrics, log), newMaxResolutionMiddleware(cfg.MaxResolutionPoints))
 	}
 	if cfg.AlignQueriesWithStep {
 		queryRangeMiddleware = append(queryRangeMiddleware, newInstrumentMiddleware("step_align", metrics, log), newStepAlignMiddleware())
@@ -215,6 +318,10 @@ func newQueryTripperware(
 			splitter = ConstSplitter(cfg.SplitQueriesByInterval)
 		}
 
+		if cfg.CacheResults && cfg.CacheResultsPerTenantMetrics {
+			queryRangeMiddleware = append(queryRangeMiddleware, newResultsCacheTrackingMiddleware(registerer))
+		}
+
 		queryRangeMiddleware = append(queryRangeMiddleware, newInstrumentMiddleware("split_by_interval_and_results_cache", metrics, log), newSplitAndCacheMiddleware(
 			cfg.SplitQueriesByInterval > 0,
 			cfg.CacheResults,
@@ -231,7 +338,13 @@ func newQueryTripperware(
 		))
 	}
 
-	queryInstantMiddleware := []Middleware{newLimitsMiddleware(limits, log)}
+	queryInstantMiddleware := []Middleware{newMaxQueryExpressionSizeMiddleware(limits), newParsedQueryMiddleware(), newQueryStatsLogMiddleware(cfg.LogQueryStats, log), newStoreRetentionMiddleware(limits), newLimitsMiddleware(limits, log), newUnknownFunctionMiddleware(), newEmptyMetricNameMiddleware(), newDuplicateGroupingLabelsMiddleware(), newMaxMetricNamesMiddleware(limits), newMaxOrOperandsMiddleware(limits), newSubqueryStepMiddleware(limits), newMatchAllRegexpMiddleware(limits), newMetricAllowlistMiddleware(limits), defaultMetricNameMiddleware, nativeHistogramBucketsMiddleware, nativeHistogramRateMiddleware, caseInsensitiveMetricNamesMiddleware, concurrencyMiddleware}
+	if cfg.LookbackDeltaResponseHeader {
+		queryInstantMiddleware = append(queryInstantMiddleware, newLookbackDeltaMiddleware(engineOpts.LookbackDelta))
+	}
+	if cfg.MaxWithoutAggregationKeptLabels > 0 {
+		queryInstantMiddleware = append(queryInstantMiddleware, newInstrumentMiddleware("without_aggregation", metrics, log), newWithoutAggregationMiddleware(cfg.MaxWithoutAggregationKeptLabels))
+	}
 
 	queryInstantMiddleware = append(
 		queryInstantMiddleware,
@@ -283,15 +396,21 @@ func newQueryTripperware(
 
 	return func(next http.RoundTripper) http.RoundTripper {
 		queryrange := newLimitedParallelismRoundTripper(next, codec, limits, queryRangeMiddleware...)
-		instant := defaultInstantQueryParamsRoundTripper(
+		instant := rejectInstantQueryStepRoundTripper(defaultInstantQueryParamsRoundTripper(
 			newLimitedParallelismRoundTripper(next, codec, limits, queryInstantMiddleware...),
-		)
+		))
+		series := normalizeSeriesRequestRoundTripper(newMaxQueryBatchSizeRoundTripper(next, limits, seriesRequestBatchSize))
+		remoteRead := newMaxQueryBatchSizeRoundTripper(next, limits, remoteReadRequestBatchSize)
 		return RoundTripFunc(func(r *http.Request) (*http.Response, error) {
 			switch {
 			case isRangeQuery(r.URL.Path):
 				return queryrange.RoundTrip(r)
 			case isInstantQuery(r.URL.Path):
 				return instant.RoundTrip(r)
+			case isSeriesQuery(r.URL.Path):
+				return series.RoundTrip(r)
+			case isRemoteReadQuery(r.URL.Path):
+				return remoteRead.RoundTrip(r)
 			default:
 				return next.RoundTrip(r)
 			}
@@ -306,6 +425,11 @@ func newActiveUsersTripperware(registerer prometheus.Registerer) Tripperware {
 		Help: "Total queries sent per tenant.",
 	}, []string{"op", "user"})
 
+	federatedQueries := promauto.With(registerer).NewCounter(prometheus.CounterOpts{
+		Name: "cortex_query_frontend_federated_queries_total",
+		Help: "Total queries sent for multiple tenants through tenant federation.",
+	})
+
 	activeUsers := util.NewActiveUsersCleanupWithDefaultValues(func(user string) {
 		queriesPerTenant.DeletePartialMatch(prometheus.Labels{"user": user})
 	})
@@ -327,12 +451,58 @@ func newActiveUsersTripperware(registerer prometheus.Registerer) Tripperware {
 			userStr := tenant.JoinTenantIDs(tenantIDs)
 			activeUsers.UpdateUserTimestamp(userStr, time.Now())
 			queriesPerTenant.WithLabelValues(op, userStr).Inc()
+			if len(tenantIDs) > 1 {
+				federatedQueries.Inc()
+			}
 
 			return next.RoundTrip(r)
 		})
 	}
 }
 
+// newRequestsByEndpointTripperware returns a Tripperware tracking the number of requests received
+// by the query-frontend for each API endpoint. Only range and instant queries are decoded into a
+// Request by the query-frontend, so requests are classified based on the URL path.
+func newRequestsByEndpointTripperware(registerer prometheus.Registerer) Tripperware {
+	requestsByEndpoint := promauto.With(registerer).NewCounterVec(prometheus.CounterOpts{
+		Name: "cortex_query_frontend_requests_by_endpoint_total",
+		Help: "Total requests received by the query-frontend per API endpoint.",
+	}, []string{"endpoint"})
+
+	// Initialize known label values.
+	for _, endpoint := range []string{endpointRange, endpointInstant, endpointSeries, endpointLabels, endpointLabelValues, endpointExemplars, endpointOther} {
+		requestsByEndpoint.WithLabelValues(endpoint)
+	}
+
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripFunc(func(r *http.Request) (*http.Response, error) {
+			requestsByEndpoint.WithLabelValues(requestEndpoint(r.URL.Path)).Inc()
+			return next.RoundTrip(r)
+		})
+	}
+}
+
+// requestEndpoint returns the API endpoint type of the request with the input URL path,
+// or endpointOther if the path doesn't match any known endpoint.
+func requestEndpoint(path string) string {
+	switch {
+	case isRangeQuery(path):
+		return endpointRange
+	case isInstantQuery(path):
+		return endpointInstant
+	case isSeriesQuery(path):
+		return endpointSeries
+	case strings.HasSuffix(path, labelNamesPathSuffix):
+		return endpointLabels
+	case labelValuesPathRegexp.MatchString(path):
+		return endpointLabelValues
+	case strings.HasSuffix(path, exemplarsPathSuffix):
+		return endpointExemplars
+	default:
+		return endpointOther
+	}
+}
+
 func isRangeQuery(path string) bool {
 	return strings.HasSuffix(path, queryRangePathSuffix)
 }
@@ -341,6 +511,14 @@ func isInstantQuery(path string) bool {
 	return strings.HasSuffix(path, instantQueryPathSuffix)
 }
 
+func isSeriesQuery(path string) bool {
+	return strings.HasSuffix(path, seriesPathSuffix)
+}
+
+func isRemoteReadQuery(path string) bool {
+	return strings.HasSuffix(path, remoteReadPathSuffix)
+}
+
 func defaultInstantQueryParamsRoundTripper(next http.RoundTripper) http.RoundTripper {
 	return RoundTripFunc(func(r *http.Request) (*http.Response, error) {
 		if isInstantQuery(r.URL.Path) && !r.Form.Has("time") && !r.URL.Query().Has("time") {
@@ -359,3 +537,55 @@ func defaultInstantQueryParamsRoundTripper(next http.RoundTripper) http.RoundTri
 		return next.RoundTrip(r)
 	})
 }
+
+// rejectInstantQueryStepRoundTripper rejects instant queries with a non-zero step parameter, which
+// is a sign of a client bug, like a range query sent to the instant query endpoint. The step is
+// not part of PrometheusInstantQueryRequest, so it's checked on the HTTP request before decoding it.
+func rejectInstantQueryStepRoundTripper(next http.RoundTripper) http.RoundTripper {
+	return RoundTripFunc(func(r *http.Request) (*http.Response, error) {
+		if err := r.ParseForm(); err != nil {
+			return nil, apierror.New(apierror.TypeBadData, err.Error())
+		}
+
+		if step := r.Form.Get("step"); step != "" {
+			if stepMs, err := parseDurationMs(step); err != nil || stepMs != 0 {
+				return nil, apierror.Newf(apierror.TypeBadData, "instant queries don't support the step parameter, but it has been set to %q: remove the step parameter, or use the range query endpoint", step)
+			}
+		}
+
+		return next.RoundTrip(r)
+	})
+}
+
+// normalizeSeriesRequestRoundTripper rewrites series requests, sent either as a GET with the match[]
+// and other parameters in the URL query or as a POST with the parameters in the form-encoded body,
+// into the equivalent POST request with all the parameters in the body, so that downstream handlers
+// receive series requests in a single format. POST is the canonical format because long lists of
+// match[] may exceed the URL size limits. Repeated parameters, like multiple match[], are all preserved
+// in their original order. Requests with any other method are forwarded unchanged.
+func normalizeSeriesRequestRoundTripper(next http.RoundTripper) http.RoundTripper {
+	return RoundTripFunc(func(r *http.Request) (*http.Response, error) {
+		if r.Method != http.MethodGet && r.Method != http.MethodPost {
+			return next.RoundTrip(r)
+		}
+
+		if err := r.ParseForm(); err != nil {
+			return nil, apierror.New(apierror.TypeBadData, err.Error())
+		}
+
+		body := r.Form.Encode()
+		normalized := r.Clone(r.Context())
+		normalized.Method = http.MethodPost
+		normalized.URL.RawQuery = ""
+		normalized.Body = io.NopCloser(strings.NewReader(body))
+		normalized.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(strings.NewReader(body)), nil
+		}
+		normalized.ContentLength = int64(len(body))
+		normalized.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		// The form is already parsed, so that downstream handlers parsing it don't consume the body.
+		normalized.Form, normalized.PostForm = r.Form, r.Form
+
+		return next.RoundTrip(normalized)
+	})
+}
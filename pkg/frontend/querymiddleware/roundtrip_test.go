@@ -19,6 +19,7 @@ import (
 	"time"
 
 	"github.com/go-kit/log"
+	"github.com/grafana/dskit/tenant"
 	"github.com/prometheus/client_golang/api"
 	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
 	"github.com/prometheus/client_golang/prometheus"
@@ -30,6 +31,7 @@ import (
 	"github.com/weaveworks/common/middleware"
 	"github.com/weaveworks/common/user"
 
+	apierror "github.com/grafana/mimir/pkg/api/error"
 	"github.com/grafana/mimir/pkg/mimirpb"
 )
 
@@ -330,6 +332,245 @@ func TestTripperware_Metrics(t *testing.T) {
 	}
 }
 
+func TestActiveUsersTripperware_FederatedQueries(t *testing.T) {
+	tests := map[string]struct {
+		orgID         string
+		expectedCount int
+	}{
+		"single tenant": {
+			orgID:         "tenant-1",
+			expectedCount: 0,
+		},
+		"multiple tenants": {
+			orgID:         "tenant-1|tenant-2",
+			expectedCount: 1,
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			tenant.WithDefaultResolver(tenant.NewMultiResolver())
+
+			reg := prometheus.NewPedanticRegistry()
+			downstream := RoundTripFunc(func(_ *http.Request) (*http.Response, error) {
+				return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+			})
+			rt := newActiveUsersTripperware(reg)(downstream)
+
+			req, err := http.NewRequest("GET", "/api/v1/query?query=up", http.NoBody)
+			require.NoError(t, err)
+			req = req.WithContext(user.InjectOrgID(context.Background(), testData.orgID))
+
+			_, err = rt.RoundTrip(req)
+			require.NoError(t, err)
+
+			assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(fmt.Sprintf(`
+				# HELP cortex_query_frontend_federated_queries_total Total queries sent for multiple tenants through tenant federation.
+				# TYPE cortex_query_frontend_federated_queries_total counter
+				cortex_query_frontend_federated_queries_total %d
+			`, testData.expectedCount)), "cortex_query_frontend_federated_queries_total"))
+		})
+	}
+}
+
+func TestRequestsByEndpointTripperware(t *testing.T) {
+	reg := prometheus.NewPedanticRegistry()
+	downstream := RoundTripFunc(func(_ *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+	})
+	rt := newRequestsByEndpointTripperware(reg)(downstream)
+
+	for _, path := range []string{
+		"/prometheus/api/v1/query_range?query=up&start=0&end=60&step=15",
+		"/prometheus/api/v1/query_range?query=up&start=0&end=60&step=15",
+		"/prometheus/api/v1/query?query=up",
+		"/prometheus/api/v1/series?match[]=up",
+		"/prometheus/api/v1/labels",
+		"/prometheus/api/v1/label/job/values",
+		"/prometheus/api/v1/label/__name__/values",
+		"/prometheus/api/v1/query_exemplars?query=up",
+		"/prometheus/api/v1/metadata",
+	} {
+		req, err := http.NewRequest("GET", path, http.NoBody)
+		require.NoError(t, err)
+
+		resp, err := rt.RoundTrip(req)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+		# HELP cortex_query_frontend_requests_by_endpoint_total Total requests received by the query-frontend per API endpoint.
+		# TYPE cortex_query_frontend_requests_by_endpoint_total counter
+		cortex_query_frontend_requests_by_endpoint_total{endpoint="exemplars"} 1
+		cortex_query_frontend_requests_by_endpoint_total{endpoint="instant"} 1
+		cortex_query_frontend_requests_by_endpoint_total{endpoint="label_values"} 2
+		cortex_query_frontend_requests_by_endpoint_total{endpoint="labels"} 1
+		cortex_query_frontend_requests_by_endpoint_total{endpoint="other"} 1
+		cortex_query_frontend_requests_by_endpoint_total{endpoint="range"} 2
+		cortex_query_frontend_requests_by_endpoint_total{endpoint="series"} 1
+	`), "cortex_query_frontend_requests_by_endpoint_total"))
+}
+
+func TestRejectInstantQueryStepRoundTripper(t *testing.T) {
+	tests := map[string]struct {
+		method        string
+		url           string
+		body          string
+		expectedError bool
+	}{
+		"instant query without a step": {
+			method: http.MethodGet,
+			url:    "/api/v1/query?query=up&time=60",
+		},
+		"instant query with a zero step": {
+			method: http.MethodGet,
+			url:    "/api/v1/query?query=up&time=60&step=0",
+		},
+		"instant query with a step in the URL query": {
+			method:        http.MethodGet,
+			url:           "/api/v1/query?query=up&time=60&step=15",
+			expectedError: true,
+		},
+		"instant query with a step in the body": {
+			method:        http.MethodPost,
+			url:           "/api/v1/query",
+			body:          "query=up&time=60&step=1m",
+			expectedError: true,
+		},
+		"instant query with an invalid step": {
+			method:        http.MethodGet,
+			url:           "/api/v1/query?query=up&time=60&step=foo",
+			expectedError: true,
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			downstreamCalled := false
+			downstream := RoundTripFunc(func(_ *http.Request) (*http.Response, error) {
+				downstreamCalled = true
+				return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+			})
+
+			req, err := http.NewRequest(testData.method, testData.url, strings.NewReader(testData.body))
+			require.NoError(t, err)
+			if testData.method == http.MethodPost {
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+
+			_, err = rejectInstantQueryStepRoundTripper(downstream).RoundTrip(req)
+
+			if testData.expectedError {
+				require.Error(t, err)
+				resp, ok := apierror.HTTPResponseFromError(err)
+				require.True(t, ok)
+				assert.Equal(t, http.StatusBadRequest, int(resp.Code))
+				assert.False(t, downstreamCalled)
+			} else {
+				require.NoError(t, err)
+				assert.True(t, downstreamCalled)
+			}
+		})
+	}
+}
+
+func TestNormalizeSeriesRequestRoundTripper(t *testing.T) {
+	manyMatchers := make([]string, 1000)
+	for i := range manyMatchers {
+		manyMatchers[i] = fmt.Sprintf(`{__name__="metric_%d"}`, i)
+	}
+
+	tests := map[string]struct {
+		method       string
+		url          string
+		body         string
+		expectedForm url.Values
+	}{
+		"GET request with multiple match[] in the URL query": {
+			method:       http.MethodGet,
+			url:          "/api/v1/series?match[]=up&match[]=down&start=0",
+			expectedForm: url.Values{"match[]": {"up", "down"}, "start": {"0"}},
+		},
+		"POST request with multiple match[] in the body": {
+			method:       http.MethodPost,
+			url:          "/api/v1/series",
+			body:         "match[]=up&match[]=down&start=0&end=60",
+			expectedForm: url.Values{"match[]": {"up", "down"}, "start": {"0"}, "end": {"60"}},
+		},
+		"POST request with match[] in both the URL query and the body": {
+			method:       http.MethodPost,
+			url:          "/api/v1/series?match[]=down",
+			body:         "match[]=up",
+			expectedForm: url.Values{"match[]": {"up", "down"}},
+		},
+		"POST request with a long list of match[] in the body": {
+			method:       http.MethodPost,
+			url:          "/api/v1/series",
+			body:         url.Values{"match[]": manyMatchers}.Encode(),
+			expectedForm: url.Values{"match[]": manyMatchers},
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			var downstreamReq *http.Request
+			var downstreamBody []byte
+			downstream := RoundTripFunc(func(r *http.Request) (*http.Response, error) {
+				downstreamReq = r
+
+				// Parsing the form must not consume the body.
+				require.NoError(t, r.ParseForm())
+
+				var err error
+				downstreamBody, err = io.ReadAll(r.Body)
+				require.NoError(t, err)
+				return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+			})
+
+			req, err := http.NewRequest(testData.method, testData.url, strings.NewReader(testData.body))
+			require.NoError(t, err)
+			if testData.method == http.MethodPost {
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+
+			_, err = normalizeSeriesRequestRoundTripper(downstream).RoundTrip(req)
+			require.NoError(t, err)
+
+			require.NotNil(t, downstreamReq)
+			assert.Equal(t, http.MethodPost, downstreamReq.Method)
+			assert.Equal(t, "/api/v1/series", downstreamReq.URL.Path)
+			assert.Empty(t, downstreamReq.URL.RawQuery)
+			assert.Equal(t, "application/x-www-form-urlencoded", downstreamReq.Header.Get("Content-Type"))
+			assert.Equal(t, int64(len(downstreamBody)), downstreamReq.ContentLength)
+
+			// All the parameters are in the body.
+			form, err := url.ParseQuery(string(downstreamBody))
+			require.NoError(t, err)
+			assert.Equal(t, testData.expectedForm, form)
+		})
+	}
+}
+
+func TestNormalizeSeriesRequestRoundTripper_ShouldNotNormalizeOtherMethods(t *testing.T) {
+	var downstreamReq *http.Request
+	downstream := RoundTripFunc(func(r *http.Request) (*http.Response, error) {
+		downstreamReq = r
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+	})
+
+	req, err := http.NewRequest(http.MethodDelete, "/api/v1/series?match[]=up", nil)
+	require.NoError(t, err)
+
+	_, err = normalizeSeriesRequestRoundTripper(downstream).RoundTrip(req)
+	require.NoError(t, err)
+
+	// The request is forwarded as is.
+	assert.Same(t, req, downstreamReq)
+	assert.Equal(t, http.MethodDelete, downstreamReq.Method)
+	assert.Equal(t, "match[]=up", downstreamReq.URL.RawQuery)
+}
+
 func TestConfig_Validate(t *testing.T) {
 	tests := map[string]struct {
 		config        Config
@@ -353,6 +594,44 @@ func TestConfig_Validate(t *testing.T) {
 	}
 }
 
+func TestConfig_Validate_NativeHistogramsMappings(t *testing.T) {
+	tests := map[string]struct {
+		config        Config
+		expectedError string
+	}{
+		"valid mappings": {
+			config: Config{
+				QueryResultResponseFormat:   formatJSON,
+				NativeHistogramsMapping:     []string{"a:a_native"},
+				NativeHistogramsRateMapping: []string{"b_total:b_native"},
+			},
+		},
+		"malformed native histograms mapping": {
+			config:        Config{QueryResultResponseFormat: formatJSON, NativeHistogramsMapping: []string{"a"}},
+			expectedError: `invalid query-frontend native histograms mapping: the mapping "a" is not in the form <classic histogram name>:<native histogram name>`,
+		},
+		"malformed native histograms rate mapping": {
+			config:        Config{QueryResultResponseFormat: formatJSON, NativeHistogramsRateMapping: []string{"b_total:"}},
+			expectedError: `invalid query-frontend native histograms rate mapping: the mapping "b_total:" is not in the form <classic histogram name>:<native histogram name>`,
+		},
+		"native histograms rate mapping with a classic counter mapped twice": {
+			config:        Config{QueryResultResponseFormat: formatJSON, NativeHistogramsRateMapping: []string{"b_total:b_native", "b_total:c_native"}},
+			expectedError: `invalid query-frontend native histograms rate mapping: the classic histogram "b_total" is mapped more than once`,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := test.config.Validate()
+			if test.expectedError == "" {
+				require.NoError(t, err)
+			} else {
+				require.EqualError(t, err, test.expectedError)
+			}
+		})
+	}
+}
+
 type singleHostRoundTripper struct {
 	host string
 	next http.RoundTripper
@@ -175,11 +175,13 @@ func (s *splitAndCacheMiddleware) Do(ctx context.Context, req Request) (Response
 
 		// Lookup all keys from cache.
 		fetchedExtents := s.fetchCacheExtents(ctx, s.currentTime(), tenantIDs, lookupKeys)
+		lookups := resultsCacheLookupsFromContext(ctx)
 
 		for lookupIdx, extents := range fetchedExtents {
 			if len(extents) == 0 {
 				// We just need to run the request as is because no part of it has been cached yet.
 				lookupReqs[lookupIdx].downstreamRequests = []Request{lookupReqs[lookupIdx].orig}
+				lookups.addMiss()
 				continue
 			}
 
@@ -198,9 +200,11 @@ func (s *splitAndCacheMiddleware) Do(ctx context.Context, req Request) (Response
 				}
 
 				lookupReqs[lookupIdx].cachedResponses = []Response{response}
+				lookups.addHit()
 				continue
 			}
 
+			lookups.addMiss()
 			lookupReqs[lookupIdx].downstreamRequests = requests
 			lookupReqs[lookupIdx].cachedResponses = responses
 			lookupReqs[lookupIdx].cachedExtents = extents
@@ -4,26 +4,338 @@ package querymiddleware
 
 import (
 	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/grafana/dskit/tenant"
+	lru "github.com/hashicorp/golang-lru/simplelru"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/prometheus/promql/parser"
+	"golang.org/x/exp/slices"
+
+	"github.com/grafana/mimir/pkg/frontend/querymiddleware/astmapper"
+	"github.com/grafana/mimir/pkg/util"
+	"github.com/grafana/mimir/pkg/util/spanlogger"
+	"github.com/grafana/mimir/pkg/util/validation"
 )
 
+// sortFunctions are the PromQL functions sorting the query result. Sorting is only useful
+// for display purposes. sort_by_label is tracked too, even if it's not supported by
+// the PromQL engine yet, so that it's counted as soon as it gets supported.
+var sortFunctions = []string{"sort", "sort_desc", "sort_by_label"}
+
+// clampFunctions are the PromQL functions clamping the sample values, which is mostly useful
+// for display purposes too.
+var clampFunctions = []string{"clamp", "clamp_min", "clamp_max"}
+
+// holtWintersFunctions are the names of the PromQL function computing the double exponential smoothing
+// of a gauge. The function has been renamed double_exponential_smoothing in newer Prometheus versions,
+// which is tracked too, even if it's not supported by the PromQL engine yet.
+var holtWintersFunctions = []string{"holt_winters", "double_exponential_smoothing"}
+
+// counterRateFunctions are the PromQL functions computing the rate of increase of a counter.
+// shardableQueriesCacheSize is the max number of queries whose shardability is cached by the
+// query stats middleware.
+const shardableQueriesCacheSize = 1000
+
+var counterRateFunctions = []string{"rate", "increase", "irate"}
+
+// earliestDataTimeFunc returns the time of the earliest data available for the input tenant,
+// or the zero time if it's unknown.
+type earliestDataTimeFunc func(tenantID string) time.Time
+
+// newBlocksRetentionEarliestDataTime returns an earliestDataTimeFunc based on the tenant blocks
+// retention period, relative to the current time returned by now. The earliest data time is unknown
+// for tenants without a retention period.
+func newBlocksRetentionEarliestDataTime(limits Limits, now func() time.Time) earliestDataTimeFunc {
+	return func(tenantID string) time.Time {
+		retention := limits.CompactorBlocksRetentionPeriod(tenantID)
+		if retention <= 0 {
+			return time.Time{}
+		}
+		return now().Add(-retention)
+	}
+}
+
+// assumedScrapeIntervalFunc returns the scrape interval assumed for the series of the input
+// tenant, or 0 if it's unknown.
+type assumedScrapeIntervalFunc func(tenantID string) time.Duration
+
+// totalShardsFunc returns the number of shards queries of the input tenant are sharded into.
+// Query sharding is disabled for the tenant if it's 1 or less.
+type totalShardsFunc func(tenantID string) int
+
 type queryStatsMiddleware struct {
-	nonAlignedQueries prometheus.Counter
-	next              Handler
+	nonAlignedQueries         prometheus.Counter
+	boolComparisonQueries     prometheus.Counter
+	beforeEarliestDataQueries prometheus.Counter
+	atOutOfRangeQueries       prometheus.Counter
+	nestedAggregationQueries  prometheus.Counter
+	aggregationNestingDepth   prometheus.Histogram
+	functionNestingDepth      prometheus.Histogram
+	queryParseDuration        prometheus.Histogram
+	astNodeCount              prometheus.Histogram
+	metricFamilies            prometheus.Histogram
+	rangeToStepRatio          prometheus.Histogram
+	sortFunctionQueries       *prometheus.CounterVec
+	clampFunctionQueries      *prometheus.CounterVec
+	timestampFunctionQueries  prometheus.Counter
+	changesFunctionQueries    prometheus.Counter
+	resetsFunctionQueries     prometheus.Counter
+	predictLinearQueries      prometheus.Counter
+	derivFunctionQueries      prometheus.Counter
+	quantileQueries           prometheus.Counter
+	quantileOverTimeQueries   prometheus.Counter
+	holtWintersQueries        prometheus.Counter
+	stddevQueries             prometheus.Counter
+	stdvarQueries             prometheus.Counter
+	setAndQueries             prometheus.Counter
+	setOrQueries              prometheus.Counter
+	setUnlessQueries          prometheus.Counter
+	groupLeftQueries          prometheus.Counter
+	groupRightQueries         prometheus.Counter
+	overResolvedQueries       prometheus.Counter
+	rawCounterQueries         prometheus.Counter
+	shortRangeRateQueries     prometheus.Counter
+	mixedSelectorsQueries     prometheus.Counter
+	atAndOffsetQueries        prometheus.Counter
+	unshardedQueries          prometheus.Counter
+	cacheableQueries          *prometheus.CounterVec
+	logger                    log.Logger
+	earliestDataTime          earliestDataTimeFunc
+	atOutOfRangeDelta         time.Duration
+	slowParseThreshold        time.Duration
+	overResolvedPoints        int
+	assumedScrapeInterval     assumedScrapeIntervalFunc
+	totalShards               totalShardsFunc
+	shardableQueries          *shardableQueriesCache
+	next                      Handler
+
+	// Can be set from tests.
+	now func() time.Time
 }
 
-func newQueryStatsMiddleware(reg prometheus.Registerer) Middleware {
+func newQueryStatsMiddleware(reg prometheus.Registerer, logger log.Logger, earliestDataTime earliestDataTimeFunc, atOutOfRangeDelta, slowParseThreshold time.Duration, overResolvedPoints int, assumedScrapeInterval assumedScrapeIntervalFunc, totalShards totalShardsFunc) Middleware {
 	nonAlignedQueries := promauto.With(reg).NewCounter(prometheus.CounterOpts{
 		Name: "cortex_query_frontend_non_step_aligned_queries_total",
 		Help: "Total queries sent that are not step aligned.",
 	})
+	boolComparisonQueries := promauto.With(reg).NewCounter(prometheus.CounterOpts{
+		Name: "cortex_query_frontend_bool_comparison_total",
+		Help: "Total queries sent that use a comparison operator with the bool modifier.",
+	})
+	beforeEarliestDataQueries := promauto.With(reg).NewCounter(prometheus.CounterOpts{
+		Name: "cortex_query_frontend_before_earliest_data_queries_total",
+		Help: "Total queries sent whose time range ends before the earliest data available for the tenant.",
+	})
+	atOutOfRangeQueries := promauto.With(reg).NewCounter(prometheus.CounterOpts{
+		Name: "cortex_query_frontend_at_modifier_out_of_range_queries_total",
+		Help: "Total queries sent that use the @ modifier with a timestamp far outside the query time range.",
+	})
+	nestedAggregationQueries := promauto.With(reg).NewCounter(prometheus.CounterOpts{
+		Name: "cortex_query_frontend_nested_aggregation_total",
+		Help: "Total queries sent that contain an aggregation nested in another aggregation.",
+	})
+	aggregationNestingDepth := promauto.With(reg).NewHistogram(prometheus.HistogramOpts{
+		Name:    "cortex_query_frontend_aggregation_nesting_depth",
+		Help:    "Max nesting depth of the aggregations in the queries sent that contain at least one aggregation.",
+		Buckets: prometheus.LinearBuckets(1, 1, 5),
+	})
+	functionNestingDepth := promauto.With(reg).NewHistogram(prometheus.HistogramOpts{
+		Name:    "cortex_query_frontend_function_nesting_depth",
+		Help:    "Max nesting depth of the function calls in the queries sent that contain at least one function call. Deeply nested function calls are rare, and may be a sign of generated queries.",
+		Buckets: prometheus.LinearBuckets(1, 1, 5),
+	})
+	rangeToStepRatio := promauto.With(reg).NewHistogram(prometheus.HistogramOpts{
+		Name:    "cortex_query_frontend_range_to_step_ratio",
+		Help:    "Ratio between the largest range selector range and the step of the queries sent with at least one range selector. A high ratio means the result is heavily smoothed, a ratio below 1 means some samples are skipped between steps.",
+		Buckets: prometheus.ExponentialBuckets(0.25, 2, 10),
+	})
+	queryParseDuration := promauto.With(reg).NewHistogram(prometheus.HistogramOpts{
+		Name:    "cortex_query_frontend_query_parse_seconds",
+		Help:    "Time spent parsing the queries sent.",
+		Buckets: prometheus.ExponentialBuckets(0.0001, 4, 8),
+	})
+	astNodeCount := promauto.With(reg).NewHistogram(prometheus.HistogramOpts{
+		Name:    "cortex_query_frontend_ast_node_count",
+		Help:    "Number of nodes in the abstract syntax tree of the queries sent.",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 10),
+	})
+	metricFamilies := promauto.With(reg).NewHistogram(prometheus.HistogramOpts{
+		Name:    "cortex_query_frontend_metric_families",
+		Help:    "Number of distinct metric families referenced by the queries sent that select at least one metric by name. The metric family is the part of the metric name before the first underscore.",
+		Buckets: prometheus.LinearBuckets(1, 1, 5),
+	})
+	sortFunctionQueries := promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+		Name: "cortex_query_frontend_sort_function_total",
+		Help: "Total queries sent that use a sort function, by function.",
+	}, []string{"function"})
+	clampFunctionQueries := promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+		Name: "cortex_query_frontend_clamp_function_total",
+		Help: "Total queries sent that use a clamp function, by function.",
+	}, []string{"function"})
+
+	timestampFunctionQueries := promauto.With(reg).NewCounter(prometheus.CounterOpts{
+		Name: "cortex_query_frontend_timestamp_function_total",
+		Help: "Total queries sent that use the timestamp() function.",
+	})
+
+	changesFunctionQueries := promauto.With(reg).NewCounter(prometheus.CounterOpts{
+		Name: "cortex_query_frontend_changes_function_total",
+		Help: "Total queries sent that use the changes() function.",
+	})
+	resetsFunctionQueries := promauto.With(reg).NewCounter(prometheus.CounterOpts{
+		Name: "cortex_query_frontend_resets_function_total",
+		Help: "Total queries sent that use the resets() function.",
+	})
+	predictLinearQueries := promauto.With(reg).NewCounter(prometheus.CounterOpts{
+		Name: "cortex_query_frontend_predict_linear_function_total",
+		Help: "Total queries sent that use the predict_linear() function.",
+	})
+	derivFunctionQueries := promauto.With(reg).NewCounter(prometheus.CounterOpts{
+		Name: "cortex_query_frontend_deriv_function_total",
+		Help: "Total queries sent that use the deriv() function.",
+	})
+	quantileQueries := promauto.With(reg).NewCounter(prometheus.CounterOpts{
+		Name: "cortex_query_frontend_quantile_aggregation_total",
+		Help: "Total queries sent that use the quantile aggregation.",
+	})
+	quantileOverTimeQueries := promauto.With(reg).NewCounter(prometheus.CounterOpts{
+		Name: "cortex_query_frontend_quantile_over_time_function_total",
+		Help: "Total queries sent that use the quantile_over_time() function.",
+	})
+	holtWintersQueries := promauto.With(reg).NewCounter(prometheus.CounterOpts{
+		Name: "cortex_query_frontend_holt_winters_function_total",
+		Help: "Total queries sent that use the holt_winters() function, also known as double_exponential_smoothing().",
+	})
+	stddevQueries := promauto.With(reg).NewCounter(prometheus.CounterOpts{
+		Name: "cortex_query_frontend_stddev_total",
+		Help: "Total queries sent that use the stddev aggregation.",
+	})
+	stdvarQueries := promauto.With(reg).NewCounter(prometheus.CounterOpts{
+		Name: "cortex_query_frontend_stdvar_total",
+		Help: "Total queries sent that use the stdvar aggregation.",
+	})
+	setAndQueries := promauto.With(reg).NewCounter(prometheus.CounterOpts{
+		Name: "cortex_query_frontend_set_and_total",
+		Help: "Total queries sent that use the and set operator.",
+	})
+	setOrQueries := promauto.With(reg).NewCounter(prometheus.CounterOpts{
+		Name: "cortex_query_frontend_set_or_total",
+		Help: "Total queries sent that use the or set operator.",
+	})
+	setUnlessQueries := promauto.With(reg).NewCounter(prometheus.CounterOpts{
+		Name: "cortex_query_frontend_set_unless_total",
+		Help: "Total queries sent that use the unless set operator.",
+	})
+
+	groupLeftQueries := promauto.With(reg).NewCounter(prometheus.CounterOpts{
+		Name: "cortex_query_frontend_group_left_total",
+		Help: "Total queries sent that use a many-to-one vector matching with the group_left modifier.",
+	})
+	groupRightQueries := promauto.With(reg).NewCounter(prometheus.CounterOpts{
+		Name: "cortex_query_frontend_group_right_total",
+		Help: "Total queries sent that use a one-to-many vector matching with the group_right modifier.",
+	})
+	overResolvedQueries := promauto.With(reg).NewCounter(prometheus.CounterOpts{
+		Name: "cortex_query_frontend_over_resolved_queries_total",
+		Help: "Total range queries sent whose step is finer than needed to return the number of points per series set by -query-frontend.over-resolved-queries-points.",
+	})
+
+	rawCounterQueries := promauto.With(reg).NewCounter(prometheus.CounterOpts{
+		Name: "cortex_query_frontend_raw_counter_queries_total",
+		Help: "Total queries sent that select a metric whose name has the _total suffix, typical of counters, not wrapped in a rate, increase or irate function.",
+	})
+
+	shortRangeRateQueries := promauto.With(reg).NewCounter(prometheus.CounterOpts{
+		Name: "cortex_query_frontend_short_range_rate_total",
+		Help: "Total queries sent that compute rate() or increase() over a range shorter than twice the scrape interval assumed for the tenant.",
+	})
+
+	mixedSelectorsQueries := promauto.With(reg).NewCounter(prometheus.CounterOpts{
+		Name: "cortex_query_frontend_mixed_instant_and_range_selectors_total",
+		Help: "Total queries sent that contain both an instant vector selector not wrapped in a function and a range vector selector passed to a function, which may be a sign of a confused query.",
+	})
+
+	atAndOffsetQueries := promauto.With(reg).NewCounter(prometheus.CounterOpts{
+		Name: "cortex_query_frontend_at_and_offset_total",
+		Help: "Total queries sent that contain a selector with both the @ and offset modifiers, whose combined semantics are a known source of confusion.",
+	})
+
+	unshardedQueries := promauto.With(reg).NewCounter(prometheus.CounterOpts{
+		Name: "cortex_query_frontend_shardable_but_unsharded_total",
+		Help: "Total queries sent that could be sharded, but are not because query sharding is disabled for the tenant.",
+	})
+
+	cacheableQueries := promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+		Name: "cortex_query_frontend_cacheable_queries_total",
+		Help: "Total queries sent, by whether their results could be cached by the results cache. Queries which are not step-aligned, have a negative offset, have an @ modifier after the query end or contain a subquery are considered not cacheable.",
+	}, []string{"cacheable"})
+
+	// Initialize known label values.
+	for _, function := range sortFunctions {
+		sortFunctionQueries.WithLabelValues(function)
+	}
+	for _, function := range clampFunctions {
+		clampFunctionQueries.WithLabelValues(function)
+	}
+	cacheableQueries.WithLabelValues("true")
+	cacheableQueries.WithLabelValues("false")
+
+	shardableQueries := newShardableQueriesCache(shardableQueriesCacheSize)
 
 	return MiddlewareFunc(func(next Handler) Handler {
 		return &queryStatsMiddleware{
-			nonAlignedQueries: nonAlignedQueries,
-			next:              next,
+			nonAlignedQueries:         nonAlignedQueries,
+			boolComparisonQueries:     boolComparisonQueries,
+			beforeEarliestDataQueries: beforeEarliestDataQueries,
+			atOutOfRangeQueries:       atOutOfRangeQueries,
+			nestedAggregationQueries:  nestedAggregationQueries,
+			aggregationNestingDepth:   aggregationNestingDepth,
+			functionNestingDepth:      functionNestingDepth,
+			queryParseDuration:        queryParseDuration,
+			astNodeCount:              astNodeCount,
+			metricFamilies:            metricFamilies,
+			rangeToStepRatio:          rangeToStepRatio,
+			sortFunctionQueries:       sortFunctionQueries,
+			clampFunctionQueries:      clampFunctionQueries,
+			timestampFunctionQueries:  timestampFunctionQueries,
+			changesFunctionQueries:    changesFunctionQueries,
+			resetsFunctionQueries:     resetsFunctionQueries,
+			predictLinearQueries:      predictLinearQueries,
+			derivFunctionQueries:      derivFunctionQueries,
+			quantileQueries:           quantileQueries,
+			quantileOverTimeQueries:   quantileOverTimeQueries,
+			holtWintersQueries:        holtWintersQueries,
+			stddevQueries:             stddevQueries,
+			stdvarQueries:             stdvarQueries,
+			setAndQueries:             setAndQueries,
+			setOrQueries:              setOrQueries,
+			setUnlessQueries:          setUnlessQueries,
+			groupLeftQueries:          groupLeftQueries,
+			groupRightQueries:         groupRightQueries,
+			overResolvedQueries:       overResolvedQueries,
+			rawCounterQueries:         rawCounterQueries,
+			shortRangeRateQueries:     shortRangeRateQueries,
+			mixedSelectorsQueries:     mixedSelectorsQueries,
+			atAndOffsetQueries:        atAndOffsetQueries,
+			unshardedQueries:          unshardedQueries,
+			cacheableQueries:          cacheableQueries,
+			logger:                    logger,
+			earliestDataTime:          earliestDataTime,
+			atOutOfRangeDelta:         atOutOfRangeDelta,
+			slowParseThreshold:        slowParseThreshold,
+			overResolvedPoints:        overResolvedPoints,
+			assumedScrapeInterval:     assumedScrapeInterval,
+			totalShards:               totalShards,
+			shardableQueries:          shardableQueries,
+			next:                      next,
+			now:                       time.Now,
 		}
 	})
 }
@@ -33,5 +345,413 @@ func (s queryStatsMiddleware) Do(ctx context.Context, req Request) (Response, er
 		s.nonAlignedQueries.Inc()
 	}
 
+	if s.isQueryBeforeEarliestData(ctx, req) {
+		s.beforeEarliestDataQueries.Inc()
+	}
+
+	// A query is over-resolved if the max resolution middleware would increase its step.
+	if s.overResolvedPoints > 0 && maxResolutionStep(req, s.overResolvedPoints) != req.GetStep() {
+		s.overResolvedQueries.Inc()
+	}
+
+	s.trackQueryExpression(ctx, req)
+
 	return s.next.Do(ctx, req)
 }
+
+// trackQueryExpression tracks statistics about the query expression. Queries which fail
+// to parse are not tracked, because they will be rejected later on.
+func (s queryStatsMiddleware) trackQueryExpression(ctx context.Context, req Request) {
+	// This middleware is the first one parsing the query, so the parse duration is measured here and
+	// the downstream middlewares reuse the parsed expression.
+	start := s.now()
+	expr, err := parseQuery(ctx, req.GetQuery())
+	elapsed := s.now().Sub(start)
+
+	s.queryParseDuration.Observe(elapsed.Seconds())
+	if s.slowParseThreshold > 0 && elapsed > s.slowParseThreshold {
+		level.Warn(spanlogger.FromContext(ctx, s.logger)).Log("msg", "slow query parsing", "query", req.GetQuery(), "duration", elapsed, "threshold", s.slowParseThreshold)
+	}
+
+	if err != nil {
+		return
+	}
+
+	boolComparison := false
+	atOutOfRange := false
+	aggregationDepth := 0
+	functionDepth := 0
+	aggregationOperators := map[parser.ItemType]struct{}{}
+	calledFunctions := map[string]struct{}{}
+	setOperators := map[parser.ItemType]struct{}{}
+	rawCounter := false
+	groupLeft := false
+	groupRight := false
+	nodeCount := 0
+	metricFamilies := map[string]struct{}{}
+	shortRangeRate := false
+	bareVectorSelector := false
+	rangeSelectorInFunction := false
+	maxRange := time.Duration(0)
+	hasSubquery := false
+	atAndOffset := false
+	scrapeInterval := s.tenantsScrapeInterval(ctx)
+
+	parser.Inspect(expr, func(node parser.Node, path []parser.Node) error {
+		// Expressions is just a list of nodes, like function arguments, so the list itself isn't counted.
+		if _, ok := node.(parser.Expressions); node != nil && !ok {
+			nodeCount++
+		}
+
+		switch n := node.(type) {
+		case *parser.Call:
+			calledFunctions[n.Func.Name] = struct{}{}
+			// The depth of a function call is the number of function calls from the root down to it.
+			depth := 1
+			for _, ancestor := range path {
+				if _, ok := ancestor.(*parser.Call); ok {
+					depth++
+				}
+			}
+			if depth > functionDepth {
+				functionDepth = depth
+			}
+			if isShortRangeRate(n, scrapeInterval) {
+				shortRangeRate = true
+			}
+		case *parser.AggregateExpr:
+			aggregationOperators[n.Op] = struct{}{}
+			// The depth of an aggregation is the number of aggregations from the root down to it.
+			depth := 1
+			for _, ancestor := range path {
+				if _, ok := ancestor.(*parser.AggregateExpr); ok {
+					depth++
+				}
+			}
+			if depth > aggregationDepth {
+				aggregationDepth = depth
+			}
+		case *parser.BinaryExpr:
+			if n.ReturnBool {
+				boolComparison = true
+			}
+			if n.Op.IsSetOperator() {
+				setOperators[n.Op] = struct{}{}
+			}
+			if n.VectorMatching != nil {
+				switch n.VectorMatching.Card {
+				case parser.CardManyToOne:
+					groupLeft = true
+				case parser.CardOneToMany:
+					groupRight = true
+				}
+			}
+		case *parser.VectorSelector:
+			if s.isAtModifierOutOfRange(req, n.Timestamp) {
+				atOutOfRange = true
+			}
+			if isRawCounterSelector(n, path) {
+				rawCounter = true
+			}
+			if n.Name != "" {
+				metricFamilies[metricFamily(n.Name)] = struct{}{}
+			}
+			if !hasAncestor[*parser.Call](path) && !hasAncestor[*parser.MatrixSelector](path) {
+				bareVectorSelector = true
+			}
+			if (n.Timestamp != nil || n.StartOrEnd != 0) && n.OriginalOffset != 0 {
+				atAndOffset = true
+			}
+		case *parser.MatrixSelector:
+			if n.Range > maxRange {
+				maxRange = n.Range
+			}
+			if hasAncestor[*parser.Call](path) {
+				rangeSelectorInFunction = true
+			}
+		case *parser.SubqueryExpr:
+			if s.isAtModifierOutOfRange(req, n.Timestamp) {
+				atOutOfRange = true
+			}
+			hasSubquery = true
+		}
+		return nil
+	})
+
+	s.astNodeCount.Observe(float64(nodeCount))
+	if len(metricFamilies) > 0 {
+		s.metricFamilies.Observe(float64(len(metricFamilies)))
+	}
+	s.cacheableQueries.WithLabelValues(strconv.FormatBool(s.isCacheable(req, hasSubquery))).Inc()
+	if maxRange > 0 && req.GetStep() > 0 {
+		s.rangeToStepRatio.Observe(float64(maxRange.Milliseconds()) / float64(req.GetStep()))
+	}
+	if boolComparison {
+		s.boolComparisonQueries.Inc()
+	}
+	if atOutOfRange {
+		s.atOutOfRangeQueries.Inc()
+	}
+	if aggregationDepth > 0 {
+		s.aggregationNestingDepth.Observe(float64(aggregationDepth))
+	}
+	if aggregationDepth > 1 {
+		s.nestedAggregationQueries.Inc()
+	}
+	if functionDepth > 0 {
+		s.functionNestingDepth.Observe(float64(functionDepth))
+	}
+	for _, function := range sortFunctions {
+		if _, ok := calledFunctions[function]; ok {
+			s.sortFunctionQueries.WithLabelValues(function).Inc()
+		}
+	}
+	for _, function := range clampFunctions {
+		if _, ok := calledFunctions[function]; ok {
+			s.clampFunctionQueries.WithLabelValues(function).Inc()
+		}
+	}
+	if _, ok := calledFunctions["timestamp"]; ok {
+		s.timestampFunctionQueries.Inc()
+	}
+	if _, ok := calledFunctions["changes"]; ok {
+		s.changesFunctionQueries.Inc()
+	}
+	if _, ok := calledFunctions["resets"]; ok {
+		s.resetsFunctionQueries.Inc()
+	}
+	if _, ok := calledFunctions["predict_linear"]; ok {
+		s.predictLinearQueries.Inc()
+	}
+	if _, ok := calledFunctions["deriv"]; ok {
+		s.derivFunctionQueries.Inc()
+	}
+	if _, ok := aggregationOperators[parser.QUANTILE]; ok {
+		s.quantileQueries.Inc()
+	}
+	if _, ok := calledFunctions["quantile_over_time"]; ok {
+		s.quantileOverTimeQueries.Inc()
+	}
+	for _, function := range holtWintersFunctions {
+		if _, ok := calledFunctions[function]; ok {
+			s.holtWintersQueries.Inc()
+			break
+		}
+	}
+	if _, ok := aggregationOperators[parser.STDDEV]; ok {
+		s.stddevQueries.Inc()
+	}
+	if _, ok := aggregationOperators[parser.STDVAR]; ok {
+		s.stdvarQueries.Inc()
+	}
+	if rawCounter {
+		s.rawCounterQueries.Inc()
+	}
+	if shortRangeRate {
+		s.shortRangeRateQueries.Inc()
+	}
+	if bareVectorSelector && rangeSelectorInFunction {
+		s.mixedSelectorsQueries.Inc()
+	}
+	if atAndOffset {
+		s.atAndOffsetQueries.Inc()
+	}
+	if groupLeft {
+		s.groupLeftQueries.Inc()
+	}
+	if groupRight {
+		s.groupRightQueries.Inc()
+	}
+	if _, ok := setOperators[parser.LAND]; ok {
+		s.setAndQueries.Inc()
+	}
+	if _, ok := setOperators[parser.LOR]; ok {
+		s.setOrQueries.Inc()
+	}
+	if _, ok := setOperators[parser.LUNLESS]; ok {
+		s.setUnlessQueries.Inc()
+	}
+
+	if s.isShardingDisabled(ctx) && s.isShardable(ctx, req.GetQuery()) {
+		s.unshardedQueries.Inc()
+	}
+}
+
+// metricFamily returns the family of the input metric name, as the part of the name before the
+// first underscore. This is a rough heuristic: for example, http_requests_total and
+// http_request_duration_seconds belong to the same family.
+func metricFamily(metricName string) string {
+	family, _, _ := strings.Cut(metricName, "_")
+	return family
+}
+
+// isRawCounterSelector returns whether the input selector selects a counter, which is not wrapped
+// in a function computing its rate of increase. This is a heuristic: counters are detected by the
+// _total suffix of the metric name, so metrics with the suffix which are not counters are reported
+// too, and so are counters wrapped in other functions which make sense for counters, like resets().
+func isRawCounterSelector(selector *parser.VectorSelector, path []parser.Node) bool {
+	if !strings.HasSuffix(selector.Name, "_total") {
+		return false
+	}
+
+	for _, ancestor := range path {
+		if call, ok := ancestor.(*parser.Call); ok && slices.Contains(counterRateFunctions, call.Func.Name) {
+			return false
+		}
+	}
+	return true
+}
+
+// hasAncestor returns whether any of the nodes in the input path is of type T.
+func hasAncestor[T parser.Node](path []parser.Node) bool {
+	for _, ancestor := range path {
+		if _, ok := ancestor.(T); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// tenantsScrapeInterval returns the scrape interval assumed for the series of the queried tenants,
+// as the smallest of the tenants' ones, or 0 if it's unknown.
+func (s queryStatsMiddleware) tenantsScrapeInterval(ctx context.Context) time.Duration {
+	if s.assumedScrapeInterval == nil {
+		return 0
+	}
+
+	tenantIDs, err := tenant.TenantIDs(ctx)
+	if err != nil {
+		return 0
+	}
+	return validation.SmallestPositiveNonZeroDurationPerTenant(tenantIDs, s.assumedScrapeInterval)
+}
+
+// isCacheable returns whether the results of the input query could be cached by the results cache.
+// This is a conservative verdict, which doesn't depend on the results cache configuration: a query is
+// not cacheable if it's not step-aligned, if it has a negative offset or an @ modifier after the query
+// end or the current time, as checked by the results cache, or if it contains a subquery.
+func (s queryStatsMiddleware) isCacheable(req Request, hasSubquery bool) bool {
+	if !isRequestStepAligned(req) || hasSubquery {
+		return false
+	}
+	return areEvaluationTimeModifiersCachable(req, s.now().UnixMilli(), s.logger)
+}
+
+// isShardingDisabled returns whether query sharding is disabled for the queried tenants. Sharding
+// is never reported as disabled if the number of shards is unknown.
+func (s queryStatsMiddleware) isShardingDisabled(ctx context.Context) bool {
+	if s.totalShards == nil {
+		return false
+	}
+
+	tenantIDs, err := tenant.TenantIDs(ctx)
+	if err != nil {
+		return false
+	}
+	return validation.SmallestPositiveIntPerTenant(tenantIDs, s.totalShards) <= 1
+}
+
+// isShardable returns whether the query sharding middleware would shard the input query if
+// query sharding was enabled. Mapping the query is as expensive as sharding it, so the result is
+// cached per query. The sharding mapper modifies the expression in-place, so it maps its own copy
+// of the query instead of the expression inspected by the other checks.
+func (s queryStatsMiddleware) isShardable(ctx context.Context, query string) bool {
+	if shardable, ok := s.shardableQueries.get(query); ok {
+		return shardable
+	}
+
+	expr, err := parser.ParseExpr(query)
+	if err != nil {
+		return false
+	}
+
+	stats := astmapper.NewMapperStats()
+	mapper, err := astmapper.NewSharding(ctx, 2, s.logger, stats)
+	if err != nil {
+		return false
+	}
+
+	if _, err := mapper.Map(expr); err != nil {
+		return false
+	}
+
+	shardable := stats.GetShardedQueries() > 0
+	s.shardableQueries.add(query, shardable)
+	return shardable
+}
+
+// shardableQueriesCache is a concurrency-safe LRU cache of whether queries are shardable.
+type shardableQueriesCache struct {
+	mtx     sync.Mutex
+	queries *lru.LRU
+}
+
+func newShardableQueriesCache(size int) *shardableQueriesCache {
+	// The cache can't fail to be created with a positive size.
+	queries, _ := lru.NewLRU(size, nil)
+	return &shardableQueriesCache{queries: queries}
+}
+
+func (c *shardableQueriesCache) get(query string) (shardable, ok bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	value, ok := c.queries.Get(query)
+	if !ok {
+		return false, false
+	}
+	return value.(bool), true
+}
+
+func (c *shardableQueriesCache) add(query string, shardable bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.queries.Add(query, shardable)
+}
+
+// isShortRangeRate returns whether the input call computes rate() or increase() over a range shorter
+// than twice the scrape interval, in which case the range may contain less than the two samples
+// required to compute the result. This is a heuristic, because the actual scrape interval is unknown.
+func isShortRangeRate(call *parser.Call, scrapeInterval time.Duration) bool {
+	if scrapeInterval <= 0 || (call.Func.Name != "rate" && call.Func.Name != "increase") || len(call.Args) == 0 {
+		return false
+	}
+
+	matrix, ok := call.Args[0].(*parser.MatrixSelector)
+	return ok && matrix.Range < 2*scrapeInterval
+}
+
+// isAtModifierOutOfRange returns whether the input numeric @ modifier timestamp, in milliseconds,
+// is more than the configured delta outside the query time range. The start() and end() @ modifiers
+// are always within the query time range, so they're not checked.
+func (s queryStatsMiddleware) isAtModifierOutOfRange(req Request, ts *int64) bool {
+	if ts == nil {
+		return false
+	}
+
+	delta := s.atOutOfRangeDelta.Milliseconds()
+	return *ts < req.GetStart()-delta || *ts > req.GetEnd()+delta
+}
+
+// isQueryBeforeEarliestData returns whether the query time range ends before the earliest data
+// available for all the queried tenants, in which case the query can't return any data. This is
+// best-effort: false is returned whenever the earliest data time of any tenant is unknown.
+func (s queryStatsMiddleware) isQueryBeforeEarliestData(ctx context.Context, req Request) bool {
+	if s.earliestDataTime == nil {
+		return false
+	}
+
+	tenantIDs, err := tenant.TenantIDs(ctx)
+	if err != nil {
+		return false
+	}
+
+	for _, tenantID := range tenantIDs {
+		earliest := s.earliestDataTime(tenantID)
+		if earliest.IsZero() || req.GetEnd() >= util.TimeToMillis(earliest) {
+			return false
+		}
+	}
+	return len(tenantIDs) > 0
+}
@@ -0,0 +1,1404 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package querymiddleware
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/grafana/dskit/concurrency"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/common/user"
+
+	"github.com/grafana/mimir/pkg/util"
+)
+
+func TestQueryStatsMiddleware_BoolComparison(t *testing.T) {
+	tests := map[string]struct {
+		query         string
+		expectedCount int
+	}{
+		"comparison with the bool modifier": {
+			query:         "up > bool 0",
+			expectedCount: 1,
+		},
+		"comparison without the bool modifier": {
+			query:         "up > 0",
+			expectedCount: 0,
+		},
+		"multiple comparisons with the bool modifier are counted once": {
+			query:         "(up > bool 0) + (up < bool 1)",
+			expectedCount: 1,
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			reg := prometheus.NewPedanticRegistry()
+			runQueryStatsMiddleware(t, newQueryStatsMiddleware(reg, log.NewNopLogger(), nil, 0, 0, 0, nil, nil), &PrometheusRangeQueryRequest{Query: testData.query, Start: 0, End: 3600_000, Step: 60_000})
+
+			assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(fmt.Sprintf(`
+				# HELP cortex_query_frontend_bool_comparison_total Total queries sent that use a comparison operator with the bool modifier.
+				# TYPE cortex_query_frontend_bool_comparison_total counter
+				cortex_query_frontend_bool_comparison_total %d
+			`, testData.expectedCount)), "cortex_query_frontend_bool_comparison_total"))
+		})
+	}
+}
+
+func TestQueryStatsMiddleware_BeforeEarliestData(t *testing.T) {
+	earliest := time.Unix(10000, 0)
+
+	tests := map[string]struct {
+		earliestDataTime earliestDataTimeFunc
+		start, end       time.Time
+		expectedCount    int
+	}{
+		"query entirely before the earliest data": {
+			earliestDataTime: func(string) time.Time { return earliest },
+			start:            earliest.Add(-2 * time.Hour),
+			end:              earliest.Add(-time.Hour),
+			expectedCount:    1,
+		},
+		"query overlapping the earliest data": {
+			earliestDataTime: func(string) time.Time { return earliest },
+			start:            earliest.Add(-time.Hour),
+			end:              earliest.Add(time.Hour),
+			expectedCount:    0,
+		},
+		"query ending at the earliest data": {
+			earliestDataTime: func(string) time.Time { return earliest },
+			start:            earliest.Add(-time.Hour),
+			end:              earliest,
+			expectedCount:    0,
+		},
+		"earliest data time unknown": {
+			earliestDataTime: func(string) time.Time { return time.Time{} },
+			start:            earliest.Add(-2 * time.Hour),
+			end:              earliest.Add(-time.Hour),
+			expectedCount:    0,
+		},
+		"no earliest data time source": {
+			start:         earliest.Add(-2 * time.Hour),
+			end:           earliest.Add(-time.Hour),
+			expectedCount: 0,
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			reg := prometheus.NewPedanticRegistry()
+			runQueryStatsMiddleware(t, newQueryStatsMiddleware(reg, log.NewNopLogger(), testData.earliestDataTime, 0, 0, 0, nil, nil), &PrometheusRangeQueryRequest{
+				Query: "up",
+				Start: util.TimeToMillis(testData.start),
+				End:   util.TimeToMillis(testData.end),
+				Step:  60_000,
+			})
+
+			assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(fmt.Sprintf(`
+				# HELP cortex_query_frontend_before_earliest_data_queries_total Total queries sent whose time range ends before the earliest data available for the tenant.
+				# TYPE cortex_query_frontend_before_earliest_data_queries_total counter
+				cortex_query_frontend_before_earliest_data_queries_total %d
+			`, testData.expectedCount)), "cortex_query_frontend_before_earliest_data_queries_total"))
+		})
+	}
+}
+
+func TestQueryStatsMiddleware_AtModifierOutOfRange(t *testing.T) {
+	// The query time range is [1h, 2h].
+	tests := map[string]struct {
+		query         string
+		expectedCount int
+	}{
+		"no @ modifier": {
+			query:         "up",
+			expectedCount: 0,
+		},
+		"@ modifier within the query time range": {
+			query:         "up @ 5400",
+			expectedCount: 0,
+		},
+		"@ modifier outside the query time range within the delta": {
+			query:         "up @ 7300",
+			expectedCount: 0,
+		},
+		"@ modifier far in the future": {
+			query:         "up @ 100000",
+			expectedCount: 1,
+		},
+		"@ modifier far in the past on a range selector": {
+			query:         "rate(up[5m] @ 0)",
+			expectedCount: 1,
+		},
+		"@ modifier far in the future on a subquery": {
+			query:         "max_over_time(rate(up[5m])[30m:1m] @ 100000)",
+			expectedCount: 1,
+		},
+		"@ start() and end() modifiers": {
+			query:         "up @ start() + up @ end()",
+			expectedCount: 0,
+		},
+		"multiple @ modifiers out of range are counted once": {
+			query:         "up @ 0 + up @ 100000",
+			expectedCount: 1,
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			reg := prometheus.NewPedanticRegistry()
+			runQueryStatsMiddleware(t, newQueryStatsMiddleware(reg, log.NewNopLogger(), nil, 10*time.Minute, 0, 0, nil, nil), &PrometheusRangeQueryRequest{Query: testData.query, Start: 3600_000, End: 7200_000, Step: 60_000})
+
+			assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(fmt.Sprintf(`
+				# HELP cortex_query_frontend_at_modifier_out_of_range_queries_total Total queries sent that use the @ modifier with a timestamp far outside the query time range.
+				# TYPE cortex_query_frontend_at_modifier_out_of_range_queries_total counter
+				cortex_query_frontend_at_modifier_out_of_range_queries_total %d
+			`, testData.expectedCount)), "cortex_query_frontend_at_modifier_out_of_range_queries_total"))
+		})
+	}
+}
+
+func TestQueryStatsMiddleware_NestedAggregation(t *testing.T) {
+	tests := map[string]struct {
+		query           string
+		expectedMetrics string
+	}{
+		"no aggregation": {
+			query: "rate(up[5m])",
+			expectedMetrics: `
+				# HELP cortex_query_frontend_nested_aggregation_total Total queries sent that contain an aggregation nested in another aggregation.
+				# TYPE cortex_query_frontend_nested_aggregation_total counter
+				cortex_query_frontend_nested_aggregation_total 0
+				# HELP cortex_query_frontend_aggregation_nesting_depth Max nesting depth of the aggregations in the queries sent that contain at least one aggregation.
+				# TYPE cortex_query_frontend_aggregation_nesting_depth histogram
+				cortex_query_frontend_aggregation_nesting_depth_bucket{le="1"} 0
+				cortex_query_frontend_aggregation_nesting_depth_bucket{le="2"} 0
+				cortex_query_frontend_aggregation_nesting_depth_bucket{le="3"} 0
+				cortex_query_frontend_aggregation_nesting_depth_bucket{le="4"} 0
+				cortex_query_frontend_aggregation_nesting_depth_bucket{le="5"} 0
+				cortex_query_frontend_aggregation_nesting_depth_bucket{le="+Inf"} 0
+				cortex_query_frontend_aggregation_nesting_depth_sum 0
+				cortex_query_frontend_aggregation_nesting_depth_count 0
+			`,
+		},
+		"single aggregation": {
+			query: "sum by (x) (rate(y[5m]))",
+			expectedMetrics: `
+				# HELP cortex_query_frontend_nested_aggregation_total Total queries sent that contain an aggregation nested in another aggregation.
+				# TYPE cortex_query_frontend_nested_aggregation_total counter
+				cortex_query_frontend_nested_aggregation_total 0
+				# HELP cortex_query_frontend_aggregation_nesting_depth Max nesting depth of the aggregations in the queries sent that contain at least one aggregation.
+				# TYPE cortex_query_frontend_aggregation_nesting_depth histogram
+				cortex_query_frontend_aggregation_nesting_depth_bucket{le="1"} 1
+				cortex_query_frontend_aggregation_nesting_depth_bucket{le="2"} 1
+				cortex_query_frontend_aggregation_nesting_depth_bucket{le="3"} 1
+				cortex_query_frontend_aggregation_nesting_depth_bucket{le="4"} 1
+				cortex_query_frontend_aggregation_nesting_depth_bucket{le="5"} 1
+				cortex_query_frontend_aggregation_nesting_depth_bucket{le="+Inf"} 1
+				cortex_query_frontend_aggregation_nesting_depth_sum 1
+				cortex_query_frontend_aggregation_nesting_depth_count 1
+			`,
+		},
+		"sibling aggregations are not nested": {
+			query: "sum(rate(y[5m])) / count(y)",
+			expectedMetrics: `
+				# HELP cortex_query_frontend_nested_aggregation_total Total queries sent that contain an aggregation nested in another aggregation.
+				# TYPE cortex_query_frontend_nested_aggregation_total counter
+				cortex_query_frontend_nested_aggregation_total 0
+				# HELP cortex_query_frontend_aggregation_nesting_depth Max nesting depth of the aggregations in the queries sent that contain at least one aggregation.
+				# TYPE cortex_query_frontend_aggregation_nesting_depth histogram
+				cortex_query_frontend_aggregation_nesting_depth_bucket{le="1"} 1
+				cortex_query_frontend_aggregation_nesting_depth_bucket{le="2"} 1
+				cortex_query_frontend_aggregation_nesting_depth_bucket{le="3"} 1
+				cortex_query_frontend_aggregation_nesting_depth_bucket{le="4"} 1
+				cortex_query_frontend_aggregation_nesting_depth_bucket{le="5"} 1
+				cortex_query_frontend_aggregation_nesting_depth_bucket{le="+Inf"} 1
+				cortex_query_frontend_aggregation_nesting_depth_sum 1
+				cortex_query_frontend_aggregation_nesting_depth_count 1
+			`,
+		},
+		"nested aggregation": {
+			query: "max(sum by (x) (rate(y[5m])))",
+			expectedMetrics: `
+				# HELP cortex_query_frontend_nested_aggregation_total Total queries sent that contain an aggregation nested in another aggregation.
+				# TYPE cortex_query_frontend_nested_aggregation_total counter
+				cortex_query_frontend_nested_aggregation_total 1
+				# HELP cortex_query_frontend_aggregation_nesting_depth Max nesting depth of the aggregations in the queries sent that contain at least one aggregation.
+				# TYPE cortex_query_frontend_aggregation_nesting_depth histogram
+				cortex_query_frontend_aggregation_nesting_depth_bucket{le="1"} 0
+				cortex_query_frontend_aggregation_nesting_depth_bucket{le="2"} 1
+				cortex_query_frontend_aggregation_nesting_depth_bucket{le="3"} 1
+				cortex_query_frontend_aggregation_nesting_depth_bucket{le="4"} 1
+				cortex_query_frontend_aggregation_nesting_depth_bucket{le="5"} 1
+				cortex_query_frontend_aggregation_nesting_depth_bucket{le="+Inf"} 1
+				cortex_query_frontend_aggregation_nesting_depth_sum 2
+				cortex_query_frontend_aggregation_nesting_depth_count 1
+			`,
+		},
+		"double-nested aggregation": {
+			query: "count(max by (x) (sum by (x, z) (rate(y[5m]))) > 1)",
+			expectedMetrics: `
+				# HELP cortex_query_frontend_nested_aggregation_total Total queries sent that contain an aggregation nested in another aggregation.
+				# TYPE cortex_query_frontend_nested_aggregation_total counter
+				cortex_query_frontend_nested_aggregation_total 1
+				# HELP cortex_query_frontend_aggregation_nesting_depth Max nesting depth of the aggregations in the queries sent that contain at least one aggregation.
+				# TYPE cortex_query_frontend_aggregation_nesting_depth histogram
+				cortex_query_frontend_aggregation_nesting_depth_bucket{le="1"} 0
+				cortex_query_frontend_aggregation_nesting_depth_bucket{le="2"} 0
+				cortex_query_frontend_aggregation_nesting_depth_bucket{le="3"} 1
+				cortex_query_frontend_aggregation_nesting_depth_bucket{le="4"} 1
+				cortex_query_frontend_aggregation_nesting_depth_bucket{le="5"} 1
+				cortex_query_frontend_aggregation_nesting_depth_bucket{le="+Inf"} 1
+				cortex_query_frontend_aggregation_nesting_depth_sum 3
+				cortex_query_frontend_aggregation_nesting_depth_count 1
+			`,
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			reg := prometheus.NewPedanticRegistry()
+			runQueryStatsMiddleware(t, newQueryStatsMiddleware(reg, log.NewNopLogger(), nil, 0, 0, 0, nil, nil), &PrometheusRangeQueryRequest{Query: testData.query, Start: 0, End: 3600_000, Step: 60_000})
+
+			assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(testData.expectedMetrics),
+				"cortex_query_frontend_nested_aggregation_total", "cortex_query_frontend_aggregation_nesting_depth"))
+		})
+	}
+}
+
+func TestQueryStatsMiddleware_FunctionNestingDepth(t *testing.T) {
+	tests := map[string]struct {
+		query           string
+		expectedMetrics string
+	}{
+		"no function call": {
+			query: `sum(up)`,
+			expectedMetrics: `
+				# HELP cortex_query_frontend_function_nesting_depth Max nesting depth of the function calls in the queries sent that contain at least one function call. Deeply nested function calls are rare, and may be a sign of generated queries.
+				# TYPE cortex_query_frontend_function_nesting_depth histogram
+				cortex_query_frontend_function_nesting_depth_bucket{le="1"} 0
+				cortex_query_frontend_function_nesting_depth_bucket{le="2"} 0
+				cortex_query_frontend_function_nesting_depth_bucket{le="3"} 0
+				cortex_query_frontend_function_nesting_depth_bucket{le="4"} 0
+				cortex_query_frontend_function_nesting_depth_bucket{le="5"} 0
+				cortex_query_frontend_function_nesting_depth_bucket{le="+Inf"} 0
+				cortex_query_frontend_function_nesting_depth_sum 0
+				cortex_query_frontend_function_nesting_depth_count 0
+			`,
+		},
+		"single function call": {
+			query: `rate(up[5m])`,
+			expectedMetrics: `
+				# HELP cortex_query_frontend_function_nesting_depth Max nesting depth of the function calls in the queries sent that contain at least one function call. Deeply nested function calls are rare, and may be a sign of generated queries.
+				# TYPE cortex_query_frontend_function_nesting_depth histogram
+				cortex_query_frontend_function_nesting_depth_bucket{le="1"} 1
+				cortex_query_frontend_function_nesting_depth_bucket{le="2"} 1
+				cortex_query_frontend_function_nesting_depth_bucket{le="3"} 1
+				cortex_query_frontend_function_nesting_depth_bucket{le="4"} 1
+				cortex_query_frontend_function_nesting_depth_bucket{le="5"} 1
+				cortex_query_frontend_function_nesting_depth_bucket{le="+Inf"} 1
+				cortex_query_frontend_function_nesting_depth_sum 1
+				cortex_query_frontend_function_nesting_depth_count 1
+			`,
+		},
+		"sibling function calls are not nested": {
+			query: `abs(x) + ceil(y)`,
+			expectedMetrics: `
+				# HELP cortex_query_frontend_function_nesting_depth Max nesting depth of the function calls in the queries sent that contain at least one function call. Deeply nested function calls are rare, and may be a sign of generated queries.
+				# TYPE cortex_query_frontend_function_nesting_depth histogram
+				cortex_query_frontend_function_nesting_depth_bucket{le="1"} 1
+				cortex_query_frontend_function_nesting_depth_bucket{le="2"} 1
+				cortex_query_frontend_function_nesting_depth_bucket{le="3"} 1
+				cortex_query_frontend_function_nesting_depth_bucket{le="4"} 1
+				cortex_query_frontend_function_nesting_depth_bucket{le="5"} 1
+				cortex_query_frontend_function_nesting_depth_bucket{le="+Inf"} 1
+				cortex_query_frontend_function_nesting_depth_sum 1
+				cortex_query_frontend_function_nesting_depth_count 1
+			`,
+		},
+		"three-deep nesting": {
+			query: `abs(ceil(floor(x)))`,
+			expectedMetrics: `
+				# HELP cortex_query_frontend_function_nesting_depth Max nesting depth of the function calls in the queries sent that contain at least one function call. Deeply nested function calls are rare, and may be a sign of generated queries.
+				# TYPE cortex_query_frontend_function_nesting_depth histogram
+				cortex_query_frontend_function_nesting_depth_bucket{le="1"} 0
+				cortex_query_frontend_function_nesting_depth_bucket{le="2"} 0
+				cortex_query_frontend_function_nesting_depth_bucket{le="3"} 1
+				cortex_query_frontend_function_nesting_depth_bucket{le="4"} 1
+				cortex_query_frontend_function_nesting_depth_bucket{le="5"} 1
+				cortex_query_frontend_function_nesting_depth_bucket{le="+Inf"} 1
+				cortex_query_frontend_function_nesting_depth_sum 3
+				cortex_query_frontend_function_nesting_depth_count 1
+			`,
+		},
+		"function calls nested through an aggregation": {
+			query: `abs(sum(rate(x[5m])))`,
+			expectedMetrics: `
+				# HELP cortex_query_frontend_function_nesting_depth Max nesting depth of the function calls in the queries sent that contain at least one function call. Deeply nested function calls are rare, and may be a sign of generated queries.
+				# TYPE cortex_query_frontend_function_nesting_depth histogram
+				cortex_query_frontend_function_nesting_depth_bucket{le="1"} 0
+				cortex_query_frontend_function_nesting_depth_bucket{le="2"} 1
+				cortex_query_frontend_function_nesting_depth_bucket{le="3"} 1
+				cortex_query_frontend_function_nesting_depth_bucket{le="4"} 1
+				cortex_query_frontend_function_nesting_depth_bucket{le="5"} 1
+				cortex_query_frontend_function_nesting_depth_bucket{le="+Inf"} 1
+				cortex_query_frontend_function_nesting_depth_sum 2
+				cortex_query_frontend_function_nesting_depth_count 1
+			`,
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			reg := prometheus.NewPedanticRegistry()
+			runQueryStatsMiddleware(t, newQueryStatsMiddleware(reg, log.NewNopLogger(), nil, 0, 0, 0, nil, nil), &PrometheusRangeQueryRequest{Query: testData.query, Start: 0, End: 3600_000, Step: 60_000})
+
+			assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(testData.expectedMetrics), "cortex_query_frontend_function_nesting_depth"))
+		})
+	}
+}
+
+func TestQueryStatsMiddleware_SortFunctions(t *testing.T) {
+	tests := map[string]struct {
+		query           string
+		expectedMetrics string
+	}{
+		"no sort function": {
+			query: "up",
+			expectedMetrics: `
+				# HELP cortex_query_frontend_sort_function_total Total queries sent that use a sort function, by function.
+				# TYPE cortex_query_frontend_sort_function_total counter
+				cortex_query_frontend_sort_function_total{function="sort"} 0
+				cortex_query_frontend_sort_function_total{function="sort_by_label"} 0
+				cortex_query_frontend_sort_function_total{function="sort_desc"} 0
+			`,
+		},
+		"sort": {
+			query: "sort(x)",
+			expectedMetrics: `
+				# HELP cortex_query_frontend_sort_function_total Total queries sent that use a sort function, by function.
+				# TYPE cortex_query_frontend_sort_function_total counter
+				cortex_query_frontend_sort_function_total{function="sort"} 1
+				cortex_query_frontend_sort_function_total{function="sort_by_label"} 0
+				cortex_query_frontend_sort_function_total{function="sort_desc"} 0
+			`,
+		},
+		"sort_desc": {
+			query: "sort_desc(x)",
+			expectedMetrics: `
+				# HELP cortex_query_frontend_sort_function_total Total queries sent that use a sort function, by function.
+				# TYPE cortex_query_frontend_sort_function_total counter
+				cortex_query_frontend_sort_function_total{function="sort"} 0
+				cortex_query_frontend_sort_function_total{function="sort_by_label"} 0
+				cortex_query_frontend_sort_function_total{function="sort_desc"} 1
+			`,
+		},
+		"sort_by_label is not counted because it's not supported by the PromQL engine": {
+			query: `sort_by_label(x, "a")`,
+			expectedMetrics: `
+				# HELP cortex_query_frontend_sort_function_total Total queries sent that use a sort function, by function.
+				# TYPE cortex_query_frontend_sort_function_total counter
+				cortex_query_frontend_sort_function_total{function="sort"} 0
+				cortex_query_frontend_sort_function_total{function="sort_by_label"} 0
+				cortex_query_frontend_sort_function_total{function="sort_desc"} 0
+			`,
+		},
+		"multiple sort functions": {
+			query: "sort(x) + sort_desc(x) + sort(y)",
+			expectedMetrics: `
+				# HELP cortex_query_frontend_sort_function_total Total queries sent that use a sort function, by function.
+				# TYPE cortex_query_frontend_sort_function_total counter
+				cortex_query_frontend_sort_function_total{function="sort"} 1
+				cortex_query_frontend_sort_function_total{function="sort_by_label"} 0
+				cortex_query_frontend_sort_function_total{function="sort_desc"} 1
+			`,
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			reg := prometheus.NewPedanticRegistry()
+			runQueryStatsMiddleware(t, newQueryStatsMiddleware(reg, log.NewNopLogger(), nil, 0, 0, 0, nil, nil), &PrometheusRangeQueryRequest{Query: testData.query, Start: 0, End: 3600_000, Step: 60_000})
+
+			assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(testData.expectedMetrics), "cortex_query_frontend_sort_function_total"))
+		})
+	}
+}
+
+func TestQueryStatsMiddleware_ClampFunctions(t *testing.T) {
+	tests := map[string]struct {
+		query           string
+		expectedMetrics string
+	}{
+		"no clamp function": {
+			query: `up`,
+			expectedMetrics: `
+				# HELP cortex_query_frontend_clamp_function_total Total queries sent that use a clamp function, by function.
+				# TYPE cortex_query_frontend_clamp_function_total counter
+				cortex_query_frontend_clamp_function_total{function="clamp"} 0
+				cortex_query_frontend_clamp_function_total{function="clamp_max"} 0
+				cortex_query_frontend_clamp_function_total{function="clamp_min"} 0
+			`,
+		},
+		"clamp": {
+			query: `clamp(x, 0, 1)`,
+			expectedMetrics: `
+				# HELP cortex_query_frontend_clamp_function_total Total queries sent that use a clamp function, by function.
+				# TYPE cortex_query_frontend_clamp_function_total counter
+				cortex_query_frontend_clamp_function_total{function="clamp"} 1
+				cortex_query_frontend_clamp_function_total{function="clamp_max"} 0
+				cortex_query_frontend_clamp_function_total{function="clamp_min"} 0
+			`,
+		},
+		"clamp_min": {
+			query: `clamp_min(x, 0)`,
+			expectedMetrics: `
+				# HELP cortex_query_frontend_clamp_function_total Total queries sent that use a clamp function, by function.
+				# TYPE cortex_query_frontend_clamp_function_total counter
+				cortex_query_frontend_clamp_function_total{function="clamp"} 0
+				cortex_query_frontend_clamp_function_total{function="clamp_max"} 0
+				cortex_query_frontend_clamp_function_total{function="clamp_min"} 1
+			`,
+		},
+		"clamp_max": {
+			query: `clamp_max(x, 1)`,
+			expectedMetrics: `
+				# HELP cortex_query_frontend_clamp_function_total Total queries sent that use a clamp function, by function.
+				# TYPE cortex_query_frontend_clamp_function_total counter
+				cortex_query_frontend_clamp_function_total{function="clamp"} 0
+				cortex_query_frontend_clamp_function_total{function="clamp_max"} 1
+				cortex_query_frontend_clamp_function_total{function="clamp_min"} 0
+			`,
+		},
+		"multiple clamp functions": {
+			query: `clamp_min(x, 0) + clamp_max(x, 1) + clamp_min(y, 0)`,
+			expectedMetrics: `
+				# HELP cortex_query_frontend_clamp_function_total Total queries sent that use a clamp function, by function.
+				# TYPE cortex_query_frontend_clamp_function_total counter
+				cortex_query_frontend_clamp_function_total{function="clamp"} 0
+				cortex_query_frontend_clamp_function_total{function="clamp_max"} 1
+				cortex_query_frontend_clamp_function_total{function="clamp_min"} 1
+			`,
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			reg := prometheus.NewPedanticRegistry()
+			runQueryStatsMiddleware(t, newQueryStatsMiddleware(reg, log.NewNopLogger(), nil, 0, 0, 0, nil, nil), &PrometheusRangeQueryRequest{Query: testData.query, Start: 0, End: 3600_000, Step: 60_000})
+
+			assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(testData.expectedMetrics), "cortex_query_frontend_clamp_function_total"))
+		})
+	}
+}
+
+func TestQueryStatsMiddleware_TimestampFunction(t *testing.T) {
+	tests := map[string]struct {
+		query         string
+		expectedCount int
+	}{
+		"query using the timestamp function": {
+			query:         "timestamp(up)",
+			expectedCount: 1,
+		},
+		"query using the timestamp function nested in another function": {
+			query:         "time() - max(timestamp(up))",
+			expectedCount: 1,
+		},
+		"query not using the timestamp function": {
+			query:         "time() - up",
+			expectedCount: 0,
+		},
+		"multiple calls to the timestamp function are counted once": {
+			query:         "timestamp(up) - timestamp(down)",
+			expectedCount: 1,
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			reg := prometheus.NewPedanticRegistry()
+			runQueryStatsMiddleware(t, newQueryStatsMiddleware(reg, log.NewNopLogger(), nil, 0, 0, 0, nil, nil), &PrometheusRangeQueryRequest{Query: testData.query, Start: 0, End: 3600_000, Step: 60_000})
+
+			assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(fmt.Sprintf(`
+				# HELP cortex_query_frontend_timestamp_function_total Total queries sent that use the timestamp() function.
+				# TYPE cortex_query_frontend_timestamp_function_total counter
+				cortex_query_frontend_timestamp_function_total %d
+			`, testData.expectedCount)), "cortex_query_frontend_timestamp_function_total"))
+		})
+	}
+}
+
+func TestQueryStatsMiddleware_ChangesAndResetsFunctions(t *testing.T) {
+	tests := map[string]struct {
+		query           string
+		expectedChanges int
+		expectedResets  int
+	}{
+		"query using the changes function": {
+			query:           "changes(x[1h])",
+			expectedChanges: 1,
+		},
+		"query using the resets function": {
+			query:          "resets(x[1h])",
+			expectedResets: 1,
+		},
+		"query using both functions": {
+			query:           "sum(changes(x[1h])) + sum(resets(x[1h]))",
+			expectedChanges: 1,
+			expectedResets:  1,
+		},
+		"query using neither function": {
+			query: "rate(x[1h])",
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			reg := prometheus.NewPedanticRegistry()
+			runQueryStatsMiddleware(t, newQueryStatsMiddleware(reg, log.NewNopLogger(), nil, 0, 0, 0, nil, nil), &PrometheusRangeQueryRequest{Query: testData.query, Start: 0, End: 3600_000, Step: 60_000})
+
+			assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(fmt.Sprintf(`
+				# HELP cortex_query_frontend_changes_function_total Total queries sent that use the changes() function.
+				# TYPE cortex_query_frontend_changes_function_total counter
+				cortex_query_frontend_changes_function_total %d
+				# HELP cortex_query_frontend_resets_function_total Total queries sent that use the resets() function.
+				# TYPE cortex_query_frontend_resets_function_total counter
+				cortex_query_frontend_resets_function_total %d
+			`, testData.expectedChanges, testData.expectedResets)),
+				"cortex_query_frontend_changes_function_total", "cortex_query_frontend_resets_function_total"))
+		})
+	}
+}
+
+func TestQueryStatsMiddleware_PredictLinearAndDerivFunctions(t *testing.T) {
+	tests := map[string]struct {
+		query                 string
+		expectedPredictLinear int
+		expectedDeriv         int
+	}{
+		"query using the predict_linear function": {
+			query:                 "predict_linear(x[1h], 3600)",
+			expectedPredictLinear: 1,
+		},
+		"query using the deriv function": {
+			query:         "deriv(x[1h])",
+			expectedDeriv: 1,
+		},
+		"query using both functions": {
+			query:                 "predict_linear(x[1h], 3600) > 0 and deriv(x[1h]) > 0",
+			expectedPredictLinear: 1,
+			expectedDeriv:         1,
+		},
+		"query using neither function": {
+			query: "rate(x[1h])",
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			reg := prometheus.NewPedanticRegistry()
+			runQueryStatsMiddleware(t, newQueryStatsMiddleware(reg, log.NewNopLogger(), nil, 0, 0, 0, nil, nil), &PrometheusRangeQueryRequest{Query: testData.query, Start: 0, End: 3600_000, Step: 60_000})
+
+			assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(fmt.Sprintf(`
+				# HELP cortex_query_frontend_deriv_function_total Total queries sent that use the deriv() function.
+				# TYPE cortex_query_frontend_deriv_function_total counter
+				cortex_query_frontend_deriv_function_total %d
+				# HELP cortex_query_frontend_predict_linear_function_total Total queries sent that use the predict_linear() function.
+				# TYPE cortex_query_frontend_predict_linear_function_total counter
+				cortex_query_frontend_predict_linear_function_total %d
+			`, testData.expectedDeriv, testData.expectedPredictLinear)),
+				"cortex_query_frontend_predict_linear_function_total", "cortex_query_frontend_deriv_function_total"))
+		})
+	}
+}
+
+func TestQueryStatsMiddleware_QuantileAggregationAndFunction(t *testing.T) {
+	tests := map[string]struct {
+		query                    string
+		expectedQuantile         int
+		expectedQuantileOverTime int
+	}{
+		"query using the quantile aggregation": {
+			query:            "quantile(0.9, x)",
+			expectedQuantile: 1,
+		},
+		"query using the quantile_over_time function": {
+			query:                    "quantile_over_time(0.9, x[5m])",
+			expectedQuantileOverTime: 1,
+		},
+		"query using both": {
+			query:                    "quantile by (job) (0.9, quantile_over_time(0.5, x[5m]))",
+			expectedQuantile:         1,
+			expectedQuantileOverTime: 1,
+		},
+		"query using neither": {
+			query: "histogram_quantile(0.9, rate(x_bucket[5m]))",
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			reg := prometheus.NewPedanticRegistry()
+			runQueryStatsMiddleware(t, newQueryStatsMiddleware(reg, log.NewNopLogger(), nil, 0, 0, 0, nil, nil), &PrometheusRangeQueryRequest{Query: testData.query, Start: 0, End: 3600_000, Step: 60_000})
+
+			assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(fmt.Sprintf(`
+				# HELP cortex_query_frontend_quantile_aggregation_total Total queries sent that use the quantile aggregation.
+				# TYPE cortex_query_frontend_quantile_aggregation_total counter
+				cortex_query_frontend_quantile_aggregation_total %d
+				# HELP cortex_query_frontend_quantile_over_time_function_total Total queries sent that use the quantile_over_time() function.
+				# TYPE cortex_query_frontend_quantile_over_time_function_total counter
+				cortex_query_frontend_quantile_over_time_function_total %d
+			`, testData.expectedQuantile, testData.expectedQuantileOverTime)),
+				"cortex_query_frontend_quantile_aggregation_total", "cortex_query_frontend_quantile_over_time_function_total"))
+		})
+	}
+}
+
+func TestQueryStatsMiddleware_HoltWintersFunction(t *testing.T) {
+	tests := map[string]struct {
+		query         string
+		expectedCount int
+	}{
+		"query using the holt_winters function": {
+			query:         "holt_winters(x[1h], 0.5, 0.5)",
+			expectedCount: 1,
+		},
+		"query using the holt_winters function more than once": {
+			query:         "holt_winters(x[1h], 0.5, 0.5) - holt_winters(x[1h], 0.1, 0.9)",
+			expectedCount: 1,
+		},
+		"query not using the holt_winters function": {
+			query: "deriv(x[1h])",
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			reg := prometheus.NewPedanticRegistry()
+			runQueryStatsMiddleware(t, newQueryStatsMiddleware(reg, log.NewNopLogger(), nil, 0, 0, 0, nil, nil), &PrometheusRangeQueryRequest{Query: testData.query, Start: 0, End: 3600_000, Step: 60_000})
+
+			assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(fmt.Sprintf(`
+				# HELP cortex_query_frontend_holt_winters_function_total Total queries sent that use the holt_winters() function, also known as double_exponential_smoothing().
+				# TYPE cortex_query_frontend_holt_winters_function_total counter
+				cortex_query_frontend_holt_winters_function_total %d
+			`, testData.expectedCount)), "cortex_query_frontend_holt_winters_function_total"))
+		})
+	}
+}
+
+func TestQueryStatsMiddleware_StddevAndStdvarAggregations(t *testing.T) {
+	tests := map[string]struct {
+		query          string
+		expectedStddev int
+		expectedStdvar int
+	}{
+		"query using the stddev aggregation": {
+			query:          "stddev by (x) (y)",
+			expectedStddev: 1,
+		},
+		"query using the stdvar aggregation": {
+			query:          "stdvar(y)",
+			expectedStdvar: 1,
+		},
+		"query using both aggregations": {
+			query:          "stddev(y) / sqrt(stdvar(y))",
+			expectedStddev: 1,
+			expectedStdvar: 1,
+		},
+		"query using neither aggregation": {
+			query: "stddev_over_time(y[5m])",
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			reg := prometheus.NewPedanticRegistry()
+			runQueryStatsMiddleware(t, newQueryStatsMiddleware(reg, log.NewNopLogger(), nil, 0, 0, 0, nil, nil), &PrometheusRangeQueryRequest{Query: testData.query, Start: 0, End: 3600_000, Step: 60_000})
+
+			assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(fmt.Sprintf(`
+				# HELP cortex_query_frontend_stddev_total Total queries sent that use the stddev aggregation.
+				# TYPE cortex_query_frontend_stddev_total counter
+				cortex_query_frontend_stddev_total %d
+				# HELP cortex_query_frontend_stdvar_total Total queries sent that use the stdvar aggregation.
+				# TYPE cortex_query_frontend_stdvar_total counter
+				cortex_query_frontend_stdvar_total %d
+			`, testData.expectedStddev, testData.expectedStdvar)),
+				"cortex_query_frontend_stddev_total", "cortex_query_frontend_stdvar_total"))
+		})
+	}
+}
+
+func TestQueryStatsMiddleware_SetOperators(t *testing.T) {
+	tests := map[string]struct {
+		query          string
+		expectedAnd    int
+		expectedOr     int
+		expectedUnless int
+	}{
+		"and operator": {
+			query:       "a and b",
+			expectedAnd: 1,
+		},
+		"or operator": {
+			query:      "a or b",
+			expectedOr: 1,
+		},
+		"unless operator": {
+			query:          "a unless b",
+			expectedUnless: 1,
+		},
+		"multiple set operators": {
+			query:       "(a and b) or (c and d)",
+			expectedAnd: 1,
+			expectedOr:  1,
+		},
+		"arithmetic and comparison operators are not set operators": {
+			query: "(a + b) > c",
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			reg := prometheus.NewPedanticRegistry()
+			runQueryStatsMiddleware(t, newQueryStatsMiddleware(reg, log.NewNopLogger(), nil, 0, 0, 0, nil, nil), &PrometheusRangeQueryRequest{Query: testData.query, Start: 0, End: 3600_000, Step: 60_000})
+
+			assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(fmt.Sprintf(`
+				# HELP cortex_query_frontend_set_and_total Total queries sent that use the and set operator.
+				# TYPE cortex_query_frontend_set_and_total counter
+				cortex_query_frontend_set_and_total %d
+				# HELP cortex_query_frontend_set_or_total Total queries sent that use the or set operator.
+				# TYPE cortex_query_frontend_set_or_total counter
+				cortex_query_frontend_set_or_total %d
+				# HELP cortex_query_frontend_set_unless_total Total queries sent that use the unless set operator.
+				# TYPE cortex_query_frontend_set_unless_total counter
+				cortex_query_frontend_set_unless_total %d
+			`, testData.expectedAnd, testData.expectedOr, testData.expectedUnless)),
+				"cortex_query_frontend_set_and_total", "cortex_query_frontend_set_or_total", "cortex_query_frontend_set_unless_total"))
+		})
+	}
+}
+
+func TestQueryStatsMiddleware_OverResolvedQueries(t *testing.T) {
+	tests := map[string]struct {
+		query              Request
+		overResolvedPoints int
+		expectedCount      int
+	}{
+		"range query returning more points than the limit": {
+			// 3600s / 1s + 1 = 3601 points.
+			query:              &PrometheusRangeQueryRequest{Query: "up", Start: 0, End: 3600_000, Step: 1000},
+			overResolvedPoints: 1000,
+			expectedCount:      1,
+		},
+		"range query returning fewer points than the limit": {
+			// 3600s / 60s + 1 = 61 points.
+			query:              &PrometheusRangeQueryRequest{Query: "up", Start: 0, End: 3600_000, Step: 60_000},
+			overResolvedPoints: 1000,
+			expectedCount:      0,
+		},
+		"range query returning exactly the limit of points": {
+			query:              &PrometheusRangeQueryRequest{Query: "up", Start: 0, End: 3600_000, Step: 60_000},
+			overResolvedPoints: 61,
+			expectedCount:      0,
+		},
+		"instant query": {
+			query:              &PrometheusInstantQueryRequest{Query: "up", Time: 3600_000},
+			overResolvedPoints: 1,
+			expectedCount:      0,
+		},
+		"tracking disabled": {
+			query:              &PrometheusRangeQueryRequest{Query: "up", Start: 0, End: 3600_000, Step: 1000},
+			overResolvedPoints: 0,
+			expectedCount:      0,
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			reg := prometheus.NewPedanticRegistry()
+			runQueryStatsMiddleware(t, newQueryStatsMiddleware(reg, log.NewNopLogger(), nil, 0, 0, testData.overResolvedPoints, nil, nil), testData.query)
+
+			assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(fmt.Sprintf(`
+				# HELP cortex_query_frontend_over_resolved_queries_total Total range queries sent whose step is finer than needed to return the number of points per series set by -query-frontend.over-resolved-queries-points.
+				# TYPE cortex_query_frontend_over_resolved_queries_total counter
+				cortex_query_frontend_over_resolved_queries_total %d
+			`, testData.expectedCount)), "cortex_query_frontend_over_resolved_queries_total"))
+		})
+	}
+}
+
+func TestQueryStatsMiddleware_GroupModifiers(t *testing.T) {
+	tests := map[string]struct {
+		query              string
+		expectedGroupLeft  int
+		expectedGroupRight int
+	}{
+		"group_left join": {
+			query:             `rate(http_requests_total[5m]) * on(instance) group_left(version) build_info`,
+			expectedGroupLeft: 1,
+		},
+		"group_right join": {
+			query:              `build_info * on(instance) group_right(version) rate(http_requests_total[5m])`,
+			expectedGroupRight: 1,
+		},
+		"one-to-one join": {
+			query: `a * on(instance) b`,
+		},
+		"set operator": {
+			query: `a and on(instance) b`,
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			reg := prometheus.NewPedanticRegistry()
+			runQueryStatsMiddleware(t, newQueryStatsMiddleware(reg, log.NewNopLogger(), nil, 0, 0, 0, nil, nil), &PrometheusRangeQueryRequest{Query: testData.query, Start: 0, End: 3600_000, Step: 60_000})
+
+			assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(fmt.Sprintf(`
+				# HELP cortex_query_frontend_group_left_total Total queries sent that use a many-to-one vector matching with the group_left modifier.
+				# TYPE cortex_query_frontend_group_left_total counter
+				cortex_query_frontend_group_left_total %d
+				# HELP cortex_query_frontend_group_right_total Total queries sent that use a one-to-many vector matching with the group_right modifier.
+				# TYPE cortex_query_frontend_group_right_total counter
+				cortex_query_frontend_group_right_total %d
+			`, testData.expectedGroupLeft, testData.expectedGroupRight)),
+				"cortex_query_frontend_group_left_total", "cortex_query_frontend_group_right_total"))
+		})
+	}
+}
+
+func TestQueryStatsMiddleware_RawCounters(t *testing.T) {
+	tests := map[string]struct {
+		query         string
+		expectedCount int
+	}{
+		"raw counter": {
+			query:         "http_requests_total",
+			expectedCount: 1,
+		},
+		"raw counter with matchers in an aggregation": {
+			query:         `sum(http_requests_total{job="test"})`,
+			expectedCount: 1,
+		},
+		"counter wrapped in rate": {
+			query:         "rate(http_requests_total[5m])",
+			expectedCount: 0,
+		},
+		"counter wrapped in increase in an aggregation": {
+			query:         "sum(increase(http_requests_total[1h]))",
+			expectedCount: 0,
+		},
+		"counter wrapped in irate in a subquery": {
+			query:         "max_over_time(irate(http_requests_total[1m])[1h:])",
+			expectedCount: 0,
+		},
+		"raw counter in a binary expression with a counter wrapped in rate": {
+			query:         "rate(http_requests_total[5m]) / http_requests_total",
+			expectedCount: 1,
+		},
+		"metric without the _total suffix": {
+			query:         "up",
+			expectedCount: 0,
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			reg := prometheus.NewPedanticRegistry()
+			runQueryStatsMiddleware(t, newQueryStatsMiddleware(reg, log.NewNopLogger(), nil, 0, 0, 0, nil, nil), &PrometheusRangeQueryRequest{Query: testData.query, Start: 0, End: 3600_000, Step: 60_000})
+
+			assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(fmt.Sprintf(`
+				# HELP cortex_query_frontend_raw_counter_queries_total Total queries sent that select a metric whose name has the _total suffix, typical of counters, not wrapped in a rate, increase or irate function.
+				# TYPE cortex_query_frontend_raw_counter_queries_total counter
+				cortex_query_frontend_raw_counter_queries_total %d
+			`, testData.expectedCount)), "cortex_query_frontend_raw_counter_queries_total"))
+		})
+	}
+}
+
+func TestQueryStatsMiddleware_ShortRangeRate(t *testing.T) {
+	tests := map[string]struct {
+		query          string
+		scrapeInterval time.Duration
+		expectedCount  int
+	}{
+		"rate over a range shorter than twice the scrape interval": {
+			query:          "rate(http_requests_total[45s])",
+			scrapeInterval: 30 * time.Second,
+			expectedCount:  1,
+		},
+		"increase over a range shorter than twice the scrape interval": {
+			query:          "sum(increase(http_requests_total[1m])) / 2",
+			scrapeInterval: time.Minute,
+			expectedCount:  1,
+		},
+		"rate over a range at least twice the scrape interval": {
+			query:          "rate(http_requests_total[1m])",
+			scrapeInterval: 30 * time.Second,
+			expectedCount:  0,
+		},
+		"other function over a range shorter than twice the scrape interval": {
+			query:          "irate(http_requests_total[45s])",
+			scrapeInterval: 30 * time.Second,
+			expectedCount:  0,
+		},
+		"unknown scrape interval": {
+			query:          "rate(http_requests_total[15s])",
+			scrapeInterval: 0,
+			expectedCount:  0,
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			limits := mockLimits{assumedScrapeInterval: testData.scrapeInterval}
+
+			reg := prometheus.NewPedanticRegistry()
+			runQueryStatsMiddleware(t, newQueryStatsMiddleware(reg, log.NewNopLogger(), nil, 0, 0, 0, limits.AssumedScrapeInterval, nil), &PrometheusRangeQueryRequest{Query: testData.query, Start: 0, End: 3600_000, Step: 60_000})
+
+			assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(fmt.Sprintf(`
+				# HELP cortex_query_frontend_short_range_rate_total Total queries sent that compute rate() or increase() over a range shorter than twice the scrape interval assumed for the tenant.
+				# TYPE cortex_query_frontend_short_range_rate_total counter
+				cortex_query_frontend_short_range_rate_total %d
+			`, testData.expectedCount)), "cortex_query_frontend_short_range_rate_total"))
+		})
+	}
+}
+
+func TestQueryStatsMiddleware_MixedInstantAndRangeSelectors(t *testing.T) {
+	tests := map[string]struct {
+		query         string
+		expectedCount int
+	}{
+		"instant selector and range selector in a function": {
+			query:         "up + rate(up[5m])",
+			expectedCount: 1,
+		},
+		"aggregated instant selector and range selector in a function": {
+			query:         "sum(up) / sum(increase(http_requests_total[1h]))",
+			expectedCount: 1,
+		},
+		"only instant selectors": {
+			query:         "up + abs(up)",
+			expectedCount: 0,
+		},
+		"only range selectors in functions": {
+			query:         "rate(up[5m]) + irate(up[5m])",
+			expectedCount: 0,
+		},
+		"instant selector only in functions": {
+			query:         "abs(up) + rate(up[5m])",
+			expectedCount: 0,
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			reg := prometheus.NewPedanticRegistry()
+			runQueryStatsMiddleware(t, newQueryStatsMiddleware(reg, log.NewNopLogger(), nil, 0, 0, 0, nil, nil), &PrometheusRangeQueryRequest{Query: testData.query, Start: 0, End: 3600_000, Step: 60_000})
+
+			assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(fmt.Sprintf(`
+				# HELP cortex_query_frontend_mixed_instant_and_range_selectors_total Total queries sent that contain both an instant vector selector not wrapped in a function and a range vector selector passed to a function, which may be a sign of a confused query.
+				# TYPE cortex_query_frontend_mixed_instant_and_range_selectors_total counter
+				cortex_query_frontend_mixed_instant_and_range_selectors_total %d
+			`, testData.expectedCount)), "cortex_query_frontend_mixed_instant_and_range_selectors_total"))
+		})
+	}
+}
+
+func TestQueryStatsMiddleware_AtAndOffset(t *testing.T) {
+	tests := map[string]struct {
+		query         string
+		expectedCount int
+	}{
+		"selector with both @ and offset modifiers": {
+			query:         "x @ 1000 offset 5m",
+			expectedCount: 1,
+		},
+		"range selector with both @ end() and offset modifiers": {
+			query:         "rate(x[5m] @ end() offset 1h)",
+			expectedCount: 1,
+		},
+		"selectors with either the @ or offset modifier": {
+			query: "x @ 1000 + x offset 5m",
+		},
+		"selector without modifiers": {
+			query: "x",
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			reg := prometheus.NewPedanticRegistry()
+			runQueryStatsMiddleware(t, newQueryStatsMiddleware(reg, log.NewNopLogger(), nil, 0, 0, 0, nil, nil), &PrometheusRangeQueryRequest{Query: testData.query, Start: 0, End: 3600_000, Step: 60_000})
+
+			assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(fmt.Sprintf(`
+				# HELP cortex_query_frontend_at_and_offset_total Total queries sent that contain a selector with both the @ and offset modifiers, whose combined semantics are a known source of confusion.
+				# TYPE cortex_query_frontend_at_and_offset_total counter
+				cortex_query_frontend_at_and_offset_total %d
+			`, testData.expectedCount)), "cortex_query_frontend_at_and_offset_total"))
+		})
+	}
+}
+
+func TestQueryStatsMiddleware_ShardableButUnsharded(t *testing.T) {
+	tests := map[string]struct {
+		query         string
+		totalShards   int
+		expectedCount int
+	}{
+		"shardable query with sharding disabled": {
+			query:         "sum(rate(http_requests_total[5m]))",
+			totalShards:   0,
+			expectedCount: 1,
+		},
+		"shardable query with sharding disabled by a single shard": {
+			query:         "count by(job) (up)",
+			totalShards:   1,
+			expectedCount: 1,
+		},
+		"shardable query with sharding enabled": {
+			query:         "sum(rate(http_requests_total[5m]))",
+			totalShards:   16,
+			expectedCount: 0,
+		},
+		"non shardable query with sharding disabled": {
+			query:         "rate(http_requests_total[5m])",
+			totalShards:   0,
+			expectedCount: 0,
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			limits := mockLimits{totalShards: testData.totalShards}
+
+			reg := prometheus.NewPedanticRegistry()
+			runQueryStatsMiddleware(t, newQueryStatsMiddleware(reg, log.NewNopLogger(), nil, 0, 0, 0, nil, limits.QueryShardingTotalShards), &PrometheusRangeQueryRequest{Query: testData.query, Start: 0, End: 3600_000, Step: 60_000})
+
+			assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(fmt.Sprintf(`
+				# HELP cortex_query_frontend_shardable_but_unsharded_total Total queries sent that could be sharded, but are not because query sharding is disabled for the tenant.
+				# TYPE cortex_query_frontend_shardable_but_unsharded_total counter
+				cortex_query_frontend_shardable_but_unsharded_total %d
+			`, testData.expectedCount)), "cortex_query_frontend_shardable_but_unsharded_total"))
+		})
+	}
+}
+
+func TestQueryStatsMiddleware_ShardableButUnsharded_ShouldCacheTheResultPerQuery(t *testing.T) {
+	limits := mockLimits{totalShards: 0}
+	reg := prometheus.NewPedanticRegistry()
+	handler := newQueryStatsMiddleware(reg, log.NewNopLogger(), nil, 0, 0, 0, nil, limits.QueryShardingTotalShards).Wrap(HandlerFunc(func(_ context.Context, _ Request) (Response, error) {
+		return &PrometheusResponse{Status: statusSuccess}, nil
+	})).(*queryStatsMiddleware)
+
+	for _, query := range []string{"sum(rate(http_requests_total[5m]))", "sum(rate(http_requests_total[5m]))", "rate(http_requests_total[5m])"} {
+		_, err := handler.Do(user.InjectOrgID(context.Background(), "test"), &PrometheusRangeQueryRequest{Query: query, Start: 0, End: 3600_000, Step: 60_000})
+		require.NoError(t, err)
+	}
+
+	// The cached result is counted for the repeated query.
+	assert.Equal(t, 2, handler.shardableQueries.queries.Len())
+	shardable, ok := handler.shardableQueries.get("sum(rate(http_requests_total[5m]))")
+	require.True(t, ok)
+	assert.True(t, shardable)
+	assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+		# HELP cortex_query_frontend_shardable_but_unsharded_total Total queries sent that could be sharded, but are not because query sharding is disabled for the tenant.
+		# TYPE cortex_query_frontend_shardable_but_unsharded_total counter
+		cortex_query_frontend_shardable_but_unsharded_total 2
+	`), "cortex_query_frontend_shardable_but_unsharded_total"))
+}
+
+func TestQueryStatsMiddleware_RangeToStepRatio(t *testing.T) {
+	tests := map[string]struct {
+		query         string
+		step          int64
+		expectedRatio float64
+	}{
+		"range selector five times the step": {
+			query:         "rate(x[5m])",
+			step:          60_000,
+			expectedRatio: 5,
+		},
+		"largest of multiple range selectors": {
+			query:         "rate(x[1m]) / rate(y[10m])",
+			step:          120_000,
+			expectedRatio: 5,
+		},
+		"range selector shorter than the step": {
+			query:         "increase(x[30s])",
+			step:          120_000,
+			expectedRatio: 0.25,
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			reg := prometheus.NewPedanticRegistry()
+			runQueryStatsMiddleware(t, newQueryStatsMiddleware(reg, log.NewNopLogger(), nil, 0, 0, 0, nil, nil), &PrometheusRangeQueryRequest{Query: testData.query, Start: 0, End: 3600_000, Step: testData.step})
+
+			metrics, err := reg.Gather()
+			require.NoError(t, err)
+
+			for _, metric := range metrics {
+				if metric.GetName() == "cortex_query_frontend_range_to_step_ratio" {
+					require.Len(t, metric.GetMetric(), 1)
+					assert.Equal(t, uint64(1), metric.GetMetric()[0].GetHistogram().GetSampleCount())
+					assert.Equal(t, testData.expectedRatio, metric.GetMetric()[0].GetHistogram().GetSampleSum())
+					return
+				}
+			}
+			require.Fail(t, "cortex_query_frontend_range_to_step_ratio metric not found")
+		})
+	}
+
+	t.Run("query without range selectors", func(t *testing.T) {
+		reg := prometheus.NewPedanticRegistry()
+		runQueryStatsMiddleware(t, newQueryStatsMiddleware(reg, log.NewNopLogger(), nil, 0, 0, 0, nil, nil), &PrometheusRangeQueryRequest{Query: "sum(up)", Start: 0, End: 3600_000, Step: 60_000})
+
+		metrics, err := reg.Gather()
+		require.NoError(t, err)
+
+		for _, metric := range metrics {
+			if metric.GetName() == "cortex_query_frontend_range_to_step_ratio" {
+				assert.Equal(t, uint64(0), metric.GetMetric()[0].GetHistogram().GetSampleCount())
+			}
+		}
+	})
+}
+
+func TestQueryStatsMiddleware_Cacheable(t *testing.T) {
+	tests := map[string]struct {
+		query             string
+		start             int64
+		expectedCacheable bool
+	}{
+		"aligned query": {
+			query:             "sum(rate(up[5m]))",
+			expectedCacheable: true,
+		},
+		"@ modifier within the query time range": {
+			query:             "up @ 1800",
+			expectedCacheable: true,
+		},
+		"not step-aligned query": {
+			query: "sum(rate(up[5m]))",
+			start: 1,
+		},
+		"@ modifier after the query end": {
+			query: "up @ 7200",
+		},
+		"negative offset": {
+			query: "up offset -5m",
+		},
+		"subquery": {
+			query: "max_over_time(rate(up[5m])[1h:5m])",
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			reg := prometheus.NewPedanticRegistry()
+			runQueryStatsMiddleware(t, newQueryStatsMiddleware(reg, log.NewNopLogger(), nil, 0, 0, 0, nil, nil), &PrometheusRangeQueryRequest{Query: testData.query, Start: testData.start, End: 3600_000, Step: 60_000})
+
+			expectedCacheable, expectedNotCacheable := 0, 1
+			if testData.expectedCacheable {
+				expectedCacheable, expectedNotCacheable = 1, 0
+			}
+			assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(fmt.Sprintf(`
+				# HELP cortex_query_frontend_cacheable_queries_total Total queries sent, by whether their results could be cached by the results cache. Queries which are not step-aligned, have a negative offset, have an @ modifier after the query end or contain a subquery are considered not cacheable.
+				# TYPE cortex_query_frontend_cacheable_queries_total counter
+				cortex_query_frontend_cacheable_queries_total{cacheable="false"} %d
+				cortex_query_frontend_cacheable_queries_total{cacheable="true"} %d
+			`, expectedNotCacheable, expectedCacheable)), "cortex_query_frontend_cacheable_queries_total"))
+		})
+	}
+}
+
+func TestQueryStatsMiddleware_SlowParse(t *testing.T) {
+	tests := map[string]struct {
+		parseDuration time.Duration
+		expectedLog   bool
+	}{
+		"fast parse": {
+			parseDuration: 10 * time.Millisecond,
+			expectedLog:   false,
+		},
+		"slow parse": {
+			parseDuration: 2 * time.Second,
+			expectedLog:   true,
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			reg := prometheus.NewPedanticRegistry()
+			logs := &concurrency.SyncBuffer{}
+
+			next := HandlerFunc(func(_ context.Context, _ Request) (Response, error) {
+				return &PrometheusResponse{Status: statusSuccess}, nil
+			})
+			handler := newQueryStatsMiddleware(reg, log.NewLogfmtLogger(logs), nil, 0, time.Second, 0, nil, nil).Wrap(next).(*queryStatsMiddleware)
+
+			// Stub the clock so that parsing the query takes the configured duration.
+			start := time.Now()
+			calls := 0
+			handler.now = func() time.Time {
+				calls++
+				if calls == 1 {
+					return start
+				}
+				return start.Add(testData.parseDuration)
+			}
+
+			_, err := handler.Do(user.InjectOrgID(context.Background(), "test"), &PrometheusRangeQueryRequest{Query: "up", Start: 0, End: 3600_000, Step: 60_000})
+			require.NoError(t, err)
+
+			if testData.expectedLog {
+				assert.Contains(t, logs.String(), "level=warn")
+				assert.Contains(t, logs.String(), `msg="slow query parsing" query=up duration=2s threshold=1s`)
+			} else {
+				assert.Empty(t, logs.String())
+			}
+
+			metrics, err := reg.Gather()
+			require.NoError(t, err)
+
+			for _, metric := range metrics {
+				if metric.GetName() == "cortex_query_frontend_query_parse_seconds" {
+					require.Len(t, metric.GetMetric(), 1)
+					assert.Equal(t, uint64(1), metric.GetMetric()[0].GetHistogram().GetSampleCount())
+					assert.Equal(t, testData.parseDuration.Seconds(), metric.GetMetric()[0].GetHistogram().GetSampleSum())
+					return
+				}
+			}
+			require.Fail(t, "cortex_query_frontend_query_parse_seconds metric not found")
+		})
+	}
+}
+
+func TestQueryStatsMiddleware_ASTNodeCount(t *testing.T) {
+	tests := map[string]struct {
+		query         string
+		expectedCount int
+	}{
+		"vector selector": {
+			query:         "up",
+			expectedCount: 1,
+		},
+		"binary expression": {
+			// Binary expression, vector selector and number literal.
+			query:         "up + 1",
+			expectedCount: 3,
+		},
+		"aggregation of a function call": {
+			// Aggregation, function call, matrix selector and vector selector.
+			query:         "sum(rate(up[5m]))",
+			expectedCount: 4,
+		},
+		"function call with multiple arguments": {
+			// Function call, matrix selector, vector selector and number literal.
+			query:         "predict_linear(up[1h], 3600)",
+			expectedCount: 4,
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			reg := prometheus.NewPedanticRegistry()
+			runQueryStatsMiddleware(t, newQueryStatsMiddleware(reg, log.NewNopLogger(), nil, 0, 0, 0, nil, nil), &PrometheusRangeQueryRequest{Query: testData.query, Start: 0, End: 3600_000, Step: 60_000})
+
+			metrics, err := reg.Gather()
+			require.NoError(t, err)
+
+			for _, metric := range metrics {
+				if metric.GetName() == "cortex_query_frontend_ast_node_count" {
+					require.Len(t, metric.GetMetric(), 1)
+					assert.Equal(t, uint64(1), metric.GetMetric()[0].GetHistogram().GetSampleCount())
+					assert.Equal(t, float64(testData.expectedCount), metric.GetMetric()[0].GetHistogram().GetSampleSum())
+					return
+				}
+			}
+			require.Fail(t, "cortex_query_frontend_ast_node_count metric not found")
+		})
+	}
+}
+
+func TestQueryStatsMiddleware_MetricFamilies(t *testing.T) {
+	tests := map[string]struct {
+		query            string
+		expectedFamilies int
+	}{
+		"single metric": {
+			query:            "http_requests_total",
+			expectedFamilies: 1,
+		},
+		"metrics of the same family": {
+			query:            "http_requests_total / http_request_duration_seconds_count",
+			expectedFamilies: 1,
+		},
+		"metrics of different families": {
+			query:            "http_requests_total * on() group_left() node_cpu_seconds_total",
+			expectedFamilies: 2,
+		},
+		"metric without underscores": {
+			query:            "sum(up) + sum(rate(node_cpu_seconds_total[5m]))",
+			expectedFamilies: 2,
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			reg := prometheus.NewPedanticRegistry()
+			runQueryStatsMiddleware(t, newQueryStatsMiddleware(reg, log.NewNopLogger(), nil, 0, 0, 0, nil, nil), &PrometheusRangeQueryRequest{Query: testData.query, Start: 0, End: 3600_000, Step: 60_000})
+
+			metrics, err := reg.Gather()
+			require.NoError(t, err)
+
+			for _, metric := range metrics {
+				if metric.GetName() == "cortex_query_frontend_metric_families" {
+					require.Len(t, metric.GetMetric(), 1)
+					assert.Equal(t, uint64(1), metric.GetMetric()[0].GetHistogram().GetSampleCount())
+					assert.Equal(t, float64(testData.expectedFamilies), metric.GetMetric()[0].GetHistogram().GetSampleSum())
+					return
+				}
+			}
+			require.Fail(t, "cortex_query_frontend_metric_families metric not found")
+		})
+	}
+
+	t.Run("query without metric names", func(t *testing.T) {
+		reg := prometheus.NewPedanticRegistry()
+		runQueryStatsMiddleware(t, newQueryStatsMiddleware(reg, log.NewNopLogger(), nil, 0, 0, 0, nil, nil), &PrometheusRangeQueryRequest{Query: "vector(1)", Start: 0, End: 3600_000, Step: 60_000})
+
+		assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+			# HELP cortex_query_frontend_metric_families Number of distinct metric families referenced by the queries sent that select at least one metric by name. The metric family is the part of the metric name before the first underscore.
+			# TYPE cortex_query_frontend_metric_families histogram
+			cortex_query_frontend_metric_families_bucket{le="1"} 0
+			cortex_query_frontend_metric_families_bucket{le="2"} 0
+			cortex_query_frontend_metric_families_bucket{le="3"} 0
+			cortex_query_frontend_metric_families_bucket{le="4"} 0
+			cortex_query_frontend_metric_families_bucket{le="5"} 0
+			cortex_query_frontend_metric_families_bucket{le="+Inf"} 0
+			cortex_query_frontend_metric_families_sum 0
+			cortex_query_frontend_metric_families_count 0
+		`), "cortex_query_frontend_metric_families"))
+	})
+}
+
+func runQueryStatsMiddleware(t *testing.T, middleware Middleware, req Request) {
+	next := HandlerFunc(func(_ context.Context, _ Request) (Response, error) {
+		return &PrometheusResponse{Status: statusSuccess}, nil
+	})
+
+	_, err := middleware.Wrap(next).Do(user.InjectOrgID(context.Background(), "test"), req)
+	require.NoError(t, err)
+}
@@ -0,0 +1,52 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package querymiddleware
+
+import (
+	"context"
+	"time"
+
+	"github.com/grafana/dskit/tenant"
+
+	apierror "github.com/grafana/mimir/pkg/api/error"
+	"github.com/grafana/mimir/pkg/util"
+)
+
+type storeRetentionMiddleware struct {
+	next   Handler
+	limits Limits
+
+	// Can be set from tests.
+	now func() time.Time
+}
+
+// newStoreRetentionMiddleware creates a middleware that rejects queries whose time range ends before
+// the per-tenant blocks retention period, because the blocks have been deleted by the compactor and
+// an empty result would be confusing. Queries for multiple tenants are rejected only if the time range
+// ends before the retention period of all the tenants.
+func newStoreRetentionMiddleware(limits Limits) Middleware {
+	return MiddlewareFunc(func(next Handler) Handler {
+		return storeRetentionMiddleware{
+			next:   next,
+			limits: limits,
+			now:    time.Now,
+		}
+	})
+}
+
+func (m storeRetentionMiddleware) Do(ctx context.Context, r Request) (Response, error) {
+	tenantIDs, err := tenant.TenantIDs(ctx)
+	if err != nil {
+		return nil, apierror.New(apierror.TypeBadData, err.Error())
+	}
+
+	earliestDataTime := newBlocksRetentionEarliestDataTime(m.limits, m.now)
+	for _, tenantID := range tenantIDs {
+		earliest := earliestDataTime(tenantID)
+		if earliest.IsZero() || r.GetEnd() >= util.TimeToMillis(earliest) {
+			return m.next.Do(ctx, r)
+		}
+	}
+
+	return nil, apierror.New(apierror.TypeBadData, "the query time range ends before the blocks retention period, so the queried data has been deleted: query a more recent time range")
+}
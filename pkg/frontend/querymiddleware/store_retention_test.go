@@ -0,0 +1,124 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package querymiddleware
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/grafana/dskit/tenant"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/common/user"
+
+	apierror "github.com/grafana/mimir/pkg/api/error"
+	"github.com/grafana/mimir/pkg/util"
+)
+
+func TestStoreRetentionMiddleware(t *testing.T) {
+	const retention = 7 * 24 * time.Hour
+
+	// The clock is stubbed, so that the boundary of the retention period is deterministic.
+	now := time.UnixMilli(1_700_000_000_000)
+
+	tests := map[string]struct {
+		orgID         string
+		limits        Limits
+		reqStart      time.Time
+		reqEnd        time.Time
+		expectedError bool
+	}{
+		"should fail if the time range is entirely before the retention period": {
+			orgID:         "test1",
+			limits:        mockLimits{compactorBlocksRetentionPeriod: retention},
+			reqStart:      now.Add(-retention).Add(-2 * time.Hour),
+			reqEnd:        now.Add(-retention).Add(-time.Hour),
+			expectedError: true,
+		},
+		"should fail if the time range ends 1ms before the retention period": {
+			orgID:         "test1",
+			limits:        mockLimits{compactorBlocksRetentionPeriod: retention},
+			reqStart:      now.Add(-retention).Add(-time.Hour),
+			reqEnd:        now.Add(-retention).Add(-time.Millisecond),
+			expectedError: true,
+		},
+		"should succeed if the time range ends exactly at the start of the retention period": {
+			orgID:    "test1",
+			limits:   mockLimits{compactorBlocksRetentionPeriod: retention},
+			reqStart: now.Add(-retention).Add(-time.Hour),
+			reqEnd:   now.Add(-retention),
+		},
+		"should succeed if the time range partially overlaps the retention period": {
+			orgID:    "test1",
+			limits:   mockLimits{compactorBlocksRetentionPeriod: retention},
+			reqStart: now.Add(-retention).Add(-time.Hour),
+			reqEnd:   now.Add(-retention).Add(time.Hour),
+		},
+		"should succeed if the time range is within the retention period": {
+			orgID:    "test1",
+			limits:   mockLimits{compactorBlocksRetentionPeriod: retention},
+			reqStart: now.Add(-time.Hour),
+			reqEnd:   now,
+		},
+		"should succeed if the retention period is disabled": {
+			orgID:    "test1",
+			limits:   mockLimits{},
+			reqStart: now.Add(-365 * 24 * time.Hour),
+			reqEnd:   now.Add(-364 * 24 * time.Hour),
+		},
+		"should fail if the time range is before the retention period of all tenants": {
+			orgID: "test1|test2",
+			limits: multiTenantMockLimits{byTenant: map[string]mockLimits{
+				"test1": {compactorBlocksRetentionPeriod: retention},
+				"test2": {compactorBlocksRetentionPeriod: 2 * retention},
+			}},
+			reqStart:      now.Add(-3 * retention),
+			reqEnd:        now.Add(-2 * retention).Add(-time.Hour),
+			expectedError: true,
+		},
+		"should succeed if the time range is within the retention period of at least one tenant": {
+			orgID: "test1|test2",
+			limits: multiTenantMockLimits{byTenant: map[string]mockLimits{
+				"test1": {compactorBlocksRetentionPeriod: retention},
+				"test2": {compactorBlocksRetentionPeriod: 2 * retention},
+			}},
+			reqStart: now.Add(-retention).Add(-2 * time.Hour),
+			reqEnd:   now.Add(-retention).Add(-time.Hour),
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			tenant.WithDefaultResolver(tenant.NewMultiResolver())
+
+			nextCalled := false
+			next := HandlerFunc(func(_ context.Context, _ Request) (Response, error) {
+				nextCalled = true
+				return &PrometheusResponse{Status: statusSuccess}, nil
+			})
+
+			req := &PrometheusRangeQueryRequest{
+				Query: "up",
+				Start: util.TimeToMillis(testData.reqStart),
+				End:   util.TimeToMillis(testData.reqEnd),
+				Step:  60_000,
+			}
+
+			ctx := user.InjectOrgID(context.Background(), testData.orgID)
+			handler := newStoreRetentionMiddleware(testData.limits).Wrap(next).(storeRetentionMiddleware)
+			handler.now = func() time.Time { return now }
+			_, err := handler.Do(ctx, req)
+
+			if testData.expectedError {
+				require.Error(t, err)
+				assert.True(t, apierror.IsAPIError(err))
+				assert.Contains(t, err.Error(), "blocks retention period")
+				assert.False(t, nextCalled)
+			} else {
+				require.NoError(t, err)
+				assert.True(t, nextCalled)
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package querymiddleware
+
+import (
+	"context"
+
+	"github.com/grafana/dskit/tenant"
+	"github.com/prometheus/prometheus/promql/parser"
+
+	apierror "github.com/grafana/mimir/pkg/api/error"
+	"github.com/grafana/mimir/pkg/util/validation"
+)
+
+type subqueryStepMiddleware struct {
+	next   Handler
+	limits Limits
+}
+
+// newSubqueryStepMiddleware creates a middleware that, for tenants enabling it, rejects queries with a
+// subquery whose step doesn't evenly divide its range, like x[1h:7m]. This is a heuristic: such subqueries
+// are valid, but they're likely a mistake, because the number of steps evaluated in each range varies.
+// Subqueries without an explicit step are not checked, because they use the default evaluation interval.
+func newSubqueryStepMiddleware(limits Limits) Middleware {
+	return MiddlewareFunc(func(next Handler) Handler {
+		return subqueryStepMiddleware{
+			next:   next,
+			limits: limits,
+		}
+	})
+}
+
+func (m subqueryStepMiddleware) Do(ctx context.Context, r Request) (Response, error) {
+	tenantIDs, err := tenant.TenantIDs(ctx)
+	if err != nil {
+		return nil, apierror.New(apierror.TypeBadData, err.Error())
+	}
+
+	if !validation.AllTrueBooleansPerTenant(tenantIDs, m.limits.RejectSubqueriesWithUnevenStep) {
+		return m.next.Do(ctx, r)
+	}
+
+	expr, err := parseQuery(ctx, r.GetQuery())
+	if err != nil {
+		// Let the downstream handlers report the parsing error.
+		return m.next.Do(ctx, r)
+	}
+
+	if subquery := unevenStepSubquery(expr); subquery != nil {
+		return nil, apierror.New(apierror.TypeBadData, validation.NewSubqueryUnevenStepError(subquery.String(), subquery.Range, subquery.Step).Error())
+	}
+
+	return m.next.Do(ctx, r)
+}
+
+// unevenStepSubquery returns the first subquery of the input expression whose explicit step doesn't
+// evenly divide its range, or nil if there's none.
+func unevenStepSubquery(expr parser.Expr) *parser.SubqueryExpr {
+	var found *parser.SubqueryExpr
+
+	parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+		subquery, ok := node.(*parser.SubqueryExpr)
+		if !ok || found != nil {
+			return nil
+		}
+
+		if subquery.Step > 0 && subquery.Range%subquery.Step != 0 {
+			found = subquery
+		}
+		return nil
+	})
+
+	return found
+}
@@ -0,0 +1,87 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package querymiddleware
+
+import (
+	"context"
+	"testing"
+
+	"github.com/grafana/dskit/tenant"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/common/user"
+
+	apierror "github.com/grafana/mimir/pkg/api/error"
+)
+
+func TestSubqueryStepMiddleware(t *testing.T) {
+	enabled := map[string]mockLimits{"test1": {rejectSubqueriesWithUnevenStep: true}, "test2": {rejectSubqueriesWithUnevenStep: true}}
+
+	tests := map[string]struct {
+		query         string
+		limits        map[string]mockLimits
+		expectedError bool
+	}{
+		"should fail for a subquery whose step doesn't divide the range when enabled": {
+			query:         `max_over_time(x[1h:7m])`,
+			limits:        enabled,
+			expectedError: true,
+		},
+		"should fail for a nested subquery whose step doesn't divide the range when enabled": {
+			query:         `max_over_time(rate(x[5m])[1h:5m]) + min_over_time(x[10m:3m])`,
+			limits:        enabled,
+			expectedError: true,
+		},
+		"should work for a subquery whose step divides the range when enabled": {
+			query:  `max_over_time(x[1h:5m])`,
+			limits: enabled,
+		},
+		"should work for a subquery without an explicit step when enabled": {
+			query:  `max_over_time(x[1h:])`,
+			limits: enabled,
+		},
+		"should work for a subquery whose step doesn't divide the range when disabled": {
+			query:  `max_over_time(x[1h:7m])`,
+			limits: map[string]mockLimits{"test1": {}, "test2": {}},
+		},
+		"should work for a subquery whose step doesn't divide the range when disabled for any of the tenants": {
+			query:  `max_over_time(x[1h:7m])`,
+			limits: map[string]mockLimits{"test1": {rejectSubqueriesWithUnevenStep: true}, "test2": {}},
+		},
+		"should let invalid queries through to the downstream handlers": {
+			query:  `max_over_time(x[1h:7m]`,
+			limits: enabled,
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			for _, req := range []Request{
+				&PrometheusRangeQueryRequest{Query: testData.query, Start: 0, End: 3600_000, Step: 60_000},
+				&PrometheusInstantQueryRequest{Query: testData.query, Time: 3600_000},
+			} {
+				tenant.WithDefaultResolver(tenant.NewMultiResolver())
+				limits := multiTenantMockLimits{byTenant: testData.limits}
+
+				var nextCalled bool
+				next := HandlerFunc(func(_ context.Context, _ Request) (Response, error) {
+					nextCalled = true
+					return &PrometheusResponse{Status: statusSuccess}, nil
+				})
+
+				ctx := user.InjectOrgID(context.Background(), "test1|test2")
+				_, err := newSubqueryStepMiddleware(limits).Wrap(next).Do(ctx, req)
+
+				if testData.expectedError {
+					require.Error(t, err)
+					assert.True(t, apierror.IsAPIError(err))
+					assert.Contains(t, err.Error(), "err-mimir-subquery-uneven-step")
+					assert.False(t, nextCalled)
+				} else {
+					require.NoError(t, err)
+					assert.True(t, nextCalled)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,57 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package querymiddleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+
+	"github.com/prometheus/prometheus/promql/parser"
+
+	apierror "github.com/grafana/mimir/pkg/api/error"
+)
+
+// unknownFunctionRegexp matches the error returned by the PromQL parser when a query
+// references a function which doesn't exist or is not enabled.
+var unknownFunctionRegexp = regexp.MustCompile(`^unknown function with name "(.+)"$`)
+
+// newUnknownFunctionMiddleware creates a middleware that rejects queries referencing an unknown
+// function with an error naming the function, instead of the cryptic parser error. Queries which
+// fail to parse for any other reason are left to the downstream handlers.
+func newUnknownFunctionMiddleware() Middleware {
+	return MiddlewareFunc(func(next Handler) Handler {
+		return HandlerFunc(func(ctx context.Context, r Request) (Response, error) {
+			_, err := parseQuery(ctx, r.GetQuery())
+			if err == nil {
+				return next.Do(ctx, r)
+			}
+
+			if name, ok := unknownFunctionName(err); ok {
+				return nil, apierror.New(apierror.TypeBadData, fmt.Sprintf("the query references the function %q, which is unknown: check the function name is spelled correctly, and if it's an experimental function, that experimental functions are enabled", name))
+			}
+
+			return next.Do(ctx, r)
+		})
+	})
+}
+
+// unknownFunctionName returns the name of the unknown function referenced by the query
+// if the input parsing error is caused by an unknown function.
+func unknownFunctionName(err error) (string, bool) {
+	var parseErrs parser.ParseErrors
+	if !errors.As(err, &parseErrs) {
+		return "", false
+	}
+
+	for _, parseErr := range parseErrs {
+		if parseErr.Err == nil {
+			continue
+		}
+		if matches := unknownFunctionRegexp.FindStringSubmatch(parseErr.Err.Error()); matches != nil {
+			return matches[1], true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,57 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package querymiddleware
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	apierror "github.com/grafana/mimir/pkg/api/error"
+)
+
+func TestUnknownFunctionMiddleware(t *testing.T) {
+	tests := map[string]struct {
+		query         string
+		expectedError string
+	}{
+		"known function": {
+			query: "rate(up[5m])",
+		},
+		"unknown function": {
+			query:         "sort_by_label(up, \"job\")",
+			expectedError: `the query references the function "sort_by_label", which is unknown: check the function name is spelled correctly, and if it's an experimental function, that experimental functions are enabled`,
+		},
+		"unknown function nested in a valid expression": {
+			query:         "sum(non_existent_function(up))",
+			expectedError: `the query references the function "non_existent_function", which is unknown`,
+		},
+		"other parsing error": {
+			query: "sum(up",
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			nextCalled := false
+			next := HandlerFunc(func(_ context.Context, _ Request) (Response, error) {
+				nextCalled = true
+				return &PrometheusResponse{Status: statusSuccess}, nil
+			})
+
+			_, err := newUnknownFunctionMiddleware().Wrap(next).Do(context.Background(), &PrometheusInstantQueryRequest{Query: testData.query})
+
+			if testData.expectedError != "" {
+				require.Error(t, err)
+				assert.True(t, apierror.IsAPIError(err))
+				assert.Contains(t, err.Error(), testData.expectedError)
+				assert.False(t, nextCalled)
+			} else {
+				require.NoError(t, err)
+				assert.True(t, nextCalled)
+			}
+		})
+	}
+}
@@ -0,0 +1,100 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package querymiddleware
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/prometheus/prometheus/promql/parser"
+
+	apierror "github.com/grafana/mimir/pkg/api/error"
+)
+
+// withoutAggregationAssumedSeriesLabels is the number of labels, other than the metric name, assumed
+// for the series aggregated by an aggregation using the without clause, when they can't be inferred
+// from the query.
+const withoutAggregationAssumedSeriesLabels = 10
+
+// newWithoutAggregationMiddleware creates a middleware that rejects queries with an aggregation
+// using the without clause which keeps more than maxKeptLabels labels.
+//
+// This is a heuristic: the labels kept by a without aggregation depend on the labels of the
+// aggregated series, which are unknown when the query is received. The number of labels kept is
+// approximated as the number of labels of the aggregated series minus the ones removed by the without
+// clause, assuming the aggregated series have withoutAggregationAssumedSeriesLabels labels unless
+// they're the output of an aggregation using the by clause. An aggregation keeping many labels is
+// assumed to not reduce the number of output series much compared to the number of input series.
+func newWithoutAggregationMiddleware(maxKeptLabels int) Middleware {
+	return MiddlewareFunc(func(next Handler) Handler {
+		return HandlerFunc(func(ctx context.Context, r Request) (Response, error) {
+			expr, err := parseQuery(ctx, r.GetQuery())
+			if err != nil {
+				// Let the downstream handlers report the parsing error.
+				return next.Do(ctx, r)
+			}
+
+			if kept, ok := maxWithoutAggregationKeptLabels(expr); ok && kept > maxKeptLabels {
+				return nil, apierror.New(apierror.TypeBadData, fmt.Sprintf("the query contains an aggregation using the without clause which is estimated to keep %d labels, while at most %d are allowed (configured via -%s)", kept, maxKeptLabels, maxWithoutAggregationKeptLabelsFlag))
+			}
+
+			return next.Do(ctx, r)
+		})
+	})
+}
+
+// maxWithoutAggregationKeptLabels returns the largest estimated number of labels kept by an aggregation
+// using the without clause in the input expression, and false if there's no such aggregation.
+func maxWithoutAggregationKeptLabels(expr parser.Expr) (int, bool) {
+	maxKept, found := 0, false
+
+	parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+		aggr, ok := node.(*parser.AggregateExpr)
+		if !ok || !aggr.Without {
+			return nil
+		}
+
+		if kept := withoutAggregationKeptLabels(aggr); !found || kept > maxKept {
+			maxKept, found = kept, true
+		}
+		return nil
+	})
+
+	return maxKept, found
+}
+
+// withoutAggregationKeptLabels returns the estimated number of labels kept by the input aggregation
+// using the without clause. The labels of the aggregated series are known only if they're the output
+// of an aggregation using the by clause.
+func withoutAggregationKeptLabels(aggr *parser.AggregateExpr) int {
+	removed := make(map[string]struct{}, len(aggr.Grouping))
+	for _, label := range aggr.Grouping {
+		removed[label] = struct{}{}
+	}
+
+	if inner, ok := unwrapParenExpr(aggr.Expr).(*parser.AggregateExpr); ok && !inner.Without {
+		kept := 0
+		for _, label := range inner.Grouping {
+			if _, ok := removed[label]; !ok {
+				kept++
+			}
+		}
+		return kept
+	}
+
+	if kept := withoutAggregationAssumedSeriesLabels - len(removed); kept > 0 {
+		return kept
+	}
+	return 0
+}
+
+// unwrapParenExpr returns the expression within any number of parentheses.
+func unwrapParenExpr(expr parser.Expr) parser.Expr {
+	for {
+		paren, ok := expr.(*parser.ParenExpr)
+		if !ok {
+			return expr
+		}
+		expr = paren.Expr
+	}
+}
@@ -0,0 +1,96 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package querymiddleware
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	apierror "github.com/grafana/mimir/pkg/api/error"
+)
+
+func TestWithoutAggregationMiddleware(t *testing.T) {
+	tests := map[string]struct {
+		query         string
+		maxKeptLabels int
+		expectedError bool
+	}{
+		"without removing one label keeps 9 labels, with a threshold of 9 labels": {
+			query:         "sum without (instance) (x)",
+			maxKeptLabels: 9,
+		},
+		"without removing one label keeps 9 labels, with a threshold of 8 labels": {
+			query:         "sum without (instance) (x)",
+			maxKeptLabels: 8,
+			expectedError: true,
+		},
+		"without removing two labels keeps 8 labels, with a threshold of 8 labels": {
+			query:         "sum without (instance, pod) (x)",
+			maxKeptLabels: 8,
+		},
+		"without removing no labels keeps all the labels": {
+			query:         "sum without () (x)",
+			maxKeptLabels: 9,
+			expectedError: true,
+		},
+		"without removing a label repeated twice": {
+			query:         "sum without (instance, instance) (x)",
+			maxKeptLabels: 8,
+			expectedError: true,
+		},
+		"without removing more labels than assumed keeps no labels": {
+			query:         "sum without (a, b, c, d, e, f, g, h, i, j, k) (x)",
+			maxKeptLabels: 1,
+		},
+		"without over an aggregation using the by clause keeps the labels of the inner aggregation": {
+			query:         "sum without (instance) (sum by (job, instance, pod) (x))",
+			maxKeptLabels: 2,
+		},
+		"without over an aggregation using the by clause keeping too many labels": {
+			query:         "sum without (instance) ((sum by (job, instance, pod, namespace) (x)))",
+			maxKeptLabels: 2,
+			expectedError: true,
+		},
+		"nested without aggregation keeping too many labels": {
+			query:         "max by (job) (sum without (instance) (rate(x[5m])))",
+			maxKeptLabels: 8,
+			expectedError: true,
+		},
+		"aggregation using the by clause": {
+			query:         "sum by (job) (x)",
+			maxKeptLabels: 1,
+		},
+		"aggregation with no grouping": {
+			query:         "sum(x)",
+			maxKeptLabels: 1,
+		},
+		"invalid query": {
+			query:         "sum without (instance) (",
+			maxKeptLabels: 1,
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			nextCalled := false
+			next := HandlerFunc(func(_ context.Context, _ Request) (Response, error) {
+				nextCalled = true
+				return &PrometheusResponse{Status: statusSuccess}, nil
+			})
+
+			_, err := newWithoutAggregationMiddleware(testData.maxKeptLabels).Wrap(next).Do(context.Background(), &PrometheusInstantQueryRequest{Query: testData.query})
+
+			if testData.expectedError {
+				require.Error(t, err)
+				assert.True(t, apierror.IsAPIError(err))
+				assert.False(t, nextCalled)
+			} else {
+				require.NoError(t, err)
+				assert.True(t, nextCalled)
+			}
+		})
+	}
+}
@@ -52,6 +52,13 @@ const (
 	MaxQueryLength              ID = "max-query-length"
 	MaxTotalQueryLength         ID = "max-total-query-length"
 	MaxQueryExpressionSizeBytes ID = "max-query-expression-size-bytes"
+	MaxQueryBatchSizeBytes      ID = "max-query-batch-size-bytes"
+	MaxQueryMetricNames         ID = "max-query-metric-names"
+	MaxQueryOrOperands          ID = "max-query-or-operands"
+	QueryMetricNameNotAllowed   ID = "query-metric-name-not-allowed"
+	SubqueryUnevenStep          ID = "subquery-uneven-step"
+	MatchAllRegexpMatcher       ID = "match-all-regexp-matcher"
+	MaxConcurrentQueries        ID = "max-concurrent-queries-per-tenant"
 	RequestRateLimited          ID = "tenant-max-request-rate"
 	IngestionRateLimited        ID = "tenant-max-ingestion-rate"
 	TooManyHAClusters           ID = "tenant-too-many-ha-clusters"
@@ -264,6 +264,60 @@ func NewMaxQueryExpressionSizeBytesError(actualSizeBytes, maxQuerySizeBytes int)
 		maxQueryExpressionSizeBytesFlag))
 }
 
+func NewMaxQueryBatchSizeBytesError(actualSizeBytes, maxBatchSizeBytes int) LimitError {
+	return LimitError(globalerror.MaxQueryBatchSizeBytes.MessageWithPerTenantLimitConfig(
+		fmt.Sprintf("the total size in bytes of the selectors in the request exceeds the limit (total size: %d, limit: %d)", actualSizeBytes, maxBatchSizeBytes),
+		maxQueryBatchSizeBytesFlag))
+}
+
+func NewMaxQueryMetricNamesError(actualMetricNames, maxMetricNames int) LimitError {
+	return LimitError(globalerror.MaxQueryMetricNames.MessageWithPerTenantLimitConfig(
+		fmt.Sprintf("the query selects more metric names than the limit (metric names: %d, limit: %d)", actualMetricNames, maxMetricNames),
+		maxQueryMetricNamesFlag))
+}
+
+func NewMaxQueryMetricNamesRegexpError(maxMetricNames int) LimitError {
+	return LimitError(globalerror.MaxQueryMetricNames.MessageWithPerTenantLimitConfig(
+		fmt.Sprintf("the query selects metric names with a regular expression matcher, which is considered to exceed the limit of metric names (limit: %d)", maxMetricNames),
+		maxQueryMetricNamesFlag))
+}
+
+func NewMaxQueryOrOperandsError(actualOperands, maxOperands int) LimitError {
+	return LimitError(globalerror.MaxQueryOrOperands.MessageWithPerTenantLimitConfig(
+		fmt.Sprintf("the query has more operands in the top-level chain of 'or' operators than the limit (operands: %d, limit: %d)", actualOperands, maxOperands),
+		maxQueryOrOperandsFlag))
+}
+
+func NewQueryMetricNameNotAllowedError(metricName string) LimitError {
+	return LimitError(globalerror.QueryMetricNameNotAllowed.MessageWithPerTenantLimitConfig(
+		fmt.Sprintf("the query selects the metric name %q, which is not in the allowlist of queryable metric names", metricName),
+		queryMetricNamesAllowlistFlag))
+}
+
+func NewQueryMetricNameMatcherNotAllowedError(matcher string) LimitError {
+	return LimitError(globalerror.QueryMetricNameNotAllowed.MessageWithPerTenantLimitConfig(
+		fmt.Sprintf("the query selects metric names with the matcher %s, which may select metric names not in the allowlist of queryable metric names", matcher),
+		queryMetricNamesAllowlistFlag))
+}
+
+func NewSubqueryUnevenStepError(subquery string, subqueryRange, step time.Duration) LimitError {
+	return LimitError(globalerror.SubqueryUnevenStep.MessageWithPerTenantLimitConfig(
+		fmt.Sprintf("the query has the subquery %s whose step doesn't evenly divide its range (range: %s, step: %s)", subquery, model.Duration(subqueryRange), model.Duration(step)),
+		rejectSubqueriesWithUnevenStepFlag))
+}
+
+func NewMatchAllRegexpMatcherError(matcher string) LimitError {
+	return LimitError(globalerror.MatchAllRegexpMatcher.MessageWithPerTenantLimitConfig(
+		fmt.Sprintf("the query has the regular expression matcher %s, which matches any value of the label", matcher),
+		rejectMatchAllRegexpMatchersFlag))
+}
+
+func NewMaxConcurrentQueriesError(maxConcurrentQueries int) LimitError {
+	return LimitError(globalerror.MaxConcurrentQueries.MessageWithPerTenantLimitConfig(
+		fmt.Sprintf("the query has been rejected because the tenant exceeded the limit of queries run concurrently by the query-frontend (limit: %d)", maxConcurrentQueries),
+		maxConcurrentQueriesFlag))
+}
+
 func NewRequestRateLimitedError(limit float64, burst int) LimitError {
 	return LimitError(globalerror.RequestRateLimited.MessageWithPerTenantLimitConfig(
 		fmt.Sprintf("the request has been rejected because the tenant exceeded the request rate limit, set to %v requests/s across all distributors with a maximum allowed burst of %d", limit, burst),
@@ -12,6 +12,7 @@ import (
 	"fmt"
 	"math"
 	"reflect"
+	"regexp"
 	"strings"
 	"time"
 
@@ -42,6 +43,14 @@ const (
 	maxPartialQueryLengthFlag              = "querier.max-partial-query-length"
 	maxTotalQueryLengthFlag                = "query-frontend.max-total-query-length"
 	maxQueryExpressionSizeBytesFlag        = "query-frontend.max-query-expression-size-bytes"
+	maxQueryBatchSizeBytesFlag             = "query-frontend.max-query-batch-size-bytes"
+	maxQueryMetricNamesFlag                = "query-frontend.max-query-metric-names"
+	maxQueryOrOperandsFlag                 = "query-frontend.max-query-or-operands"
+	queryMetricNamesAllowlistFlag          = "query-frontend.query-metric-names-allowlist"
+	defaultMetricNameRegexpFlag            = "query-frontend.default-metric-name-regexp"
+	rejectSubqueriesWithUnevenStepFlag     = "query-frontend.reject-subqueries-with-uneven-step"
+	rejectMatchAllRegexpMatchersFlag       = "query-frontend.reject-match-all-regexp-matchers"
+	maxConcurrentQueriesFlag               = "query-frontend.max-concurrent-queries-per-tenant"
 	requestRateFlag                        = "distributor.request-rate-limit"
 	requestBurstSizeFlag                   = "distributor.request-burst-size"
 	ingestionRateFlag                      = "distributor.ingestion-rate-limit"
@@ -128,10 +137,21 @@ type Limits struct {
 	SplitInstantQueriesByInterval   model.Duration `yaml:"split_instant_queries_by_interval" json:"split_instant_queries_by_interval" category:"experimental"`
 
 	// Query-frontend limits.
-	MaxTotalQueryLength                    model.Duration `yaml:"max_total_query_length" json:"max_total_query_length"`
-	ResultsCacheTTL                        model.Duration `yaml:"results_cache_ttl" json:"results_cache_ttl" category:"experimental"`
-	ResultsCacheTTLForOutOfOrderTimeWindow model.Duration `yaml:"results_cache_ttl_for_out_of_order_time_window" json:"results_cache_ttl_for_out_of_order_time_window" category:"experimental"`
-	MaxQueryExpressionSizeBytes            int            `yaml:"max_query_expression_size_bytes" json:"max_query_expression_size_bytes" category:"experimental"`
+	MaxTotalQueryLength                    model.Duration         `yaml:"max_total_query_length" json:"max_total_query_length"`
+	ResultsCacheTTL                        model.Duration         `yaml:"results_cache_ttl" json:"results_cache_ttl" category:"experimental"`
+	ResultsCacheTTLForOutOfOrderTimeWindow model.Duration         `yaml:"results_cache_ttl_for_out_of_order_time_window" json:"results_cache_ttl_for_out_of_order_time_window" category:"experimental"`
+	MaxQueryExpressionSizeBytes            int                    `yaml:"max_query_expression_size_bytes" json:"max_query_expression_size_bytes" category:"experimental"`
+	MaxQueryBatchSizeBytes                 int                    `yaml:"max_query_batch_size_bytes" json:"max_query_batch_size_bytes" category:"experimental"`
+	MaxQueryMetricNames                    int                    `yaml:"max_query_metric_names" json:"max_query_metric_names" category:"experimental"`
+	MaxQueryMetricNamesIgnoreRegexp        bool                   `yaml:"max_query_metric_names_ignore_regexp" json:"max_query_metric_names_ignore_regexp" category:"experimental"`
+	MaxQueryOrOperands                     int                    `yaml:"max_query_or_operands" json:"max_query_or_operands" category:"experimental"`
+	QueryMetricNamesAllowlist              flagext.StringSliceCSV `yaml:"query_metric_names_allowlist" json:"query_metric_names_allowlist" category:"experimental"`
+	MaxConcurrentQueries                   int                    `yaml:"max_concurrent_queries_per_tenant" json:"max_concurrent_queries_per_tenant" category:"experimental"`
+	CaseInsensitiveMetricNames             bool                   `yaml:"case_insensitive_metric_names" json:"case_insensitive_metric_names" category:"experimental"`
+	AssumedScrapeInterval                  model.Duration         `yaml:"assumed_scrape_interval" json:"assumed_scrape_interval" category:"experimental"`
+	DefaultMetricNameRegexp                string                 `yaml:"default_metric_name_regexp" json:"default_metric_name_regexp" category:"experimental"`
+	RejectSubqueriesWithUnevenStep         bool                   `yaml:"reject_subqueries_with_uneven_step" json:"reject_subqueries_with_uneven_step" category:"experimental"`
+	RejectMatchAllRegexpMatchers           bool                   `yaml:"reject_match_all_regexp_matchers" json:"reject_match_all_regexp_matchers" category:"experimental"`
 
 	// Cardinality
 	CardinalityAnalysisEnabled                    bool `yaml:"cardinality_analysis_enabled" json:"cardinality_analysis_enabled"`
@@ -264,6 +284,18 @@ func (l *Limits) RegisterFlags(f *flag.FlagSet) {
 	_ = l.ResultsCacheTTLForOutOfOrderTimeWindow.Set("10m")
 	f.Var(&l.ResultsCacheTTLForOutOfOrderTimeWindow, resultsCacheTTLForOutOfOrderWindowFlag, fmt.Sprintf("Time to live duration for cached query results if query falls into out-of-order time window. This is lower than -%s so that incoming out-of-order samples are returned in the query results sooner.", resultsCacheTTLFlag))
 	f.IntVar(&l.MaxQueryExpressionSizeBytes, maxQueryExpressionSizeBytesFlag, 0, "Max size of the raw query, in bytes. 0 to not apply a limit to the size of the query.")
+	f.IntVar(&l.MaxQueryBatchSizeBytes, maxQueryBatchSizeBytesFlag, 0, "Max total size, in bytes, of the selectors of a request carrying a batch of them, like the match[] selectors of a series request or the label matchers of the queries of a remote read request. 0 to not apply a limit to the total size of the selectors.")
+	f.IntVar(&l.MaxQueryMetricNames, maxQueryMetricNamesFlag, 0, "Max number of distinct metric names a query can select with equality matchers on the metric name. Queries selecting metric names with a regular expression matcher are considered to exceed the limit, unless -query-frontend.max-query-metric-names-ignore-regexp is enabled. 0 to not apply a limit.")
+	f.BoolVar(&l.MaxQueryMetricNamesIgnoreRegexp, "query-frontend.max-query-metric-names-ignore-regexp", false, fmt.Sprintf("If enabled, regular expression matchers on the metric name are ignored when enforcing -%s.", maxQueryMetricNamesFlag))
+	f.IntVar(&l.MaxQueryOrOperands, maxQueryOrOperandsFlag, 0, "Max number of operands of the chain of 'or' operators at the top level of a query, like in 'a or b or c'. 0 to not apply a limit.")
+	f.Var(&l.QueryMetricNamesAllowlist, queryMetricNamesAllowlistFlag, "Comma-separated list of metric names a query can select. Queries selecting other metric names, or selecting metric names with matchers other than equality matchers and regular expression matchers of alternated literal metric names, are rejected. Empty to allow any metric name.")
+	f.IntVar(&l.MaxConcurrentQueries, maxConcurrentQueriesFlag, 0, "Maximum number of range and instant queries of a tenant that the query-frontend runs concurrently. Queries exceeding the limit wait for a while and then are rejected if the tenant is still over the limit. 0 to disable.")
+
+	f.BoolVar(&l.CaseInsensitiveMetricNames, "query-frontend.case-insensitive-metric-names", false, "If enabled, equality matchers on the metric name are rewritten to regular expression matchers matching the metric name case-insensitively. This changes the semantics of queries, which may select more series than requested, and is meant to be used only temporarily, for example while migrating metric names to a different case.")
+	f.Var(&l.AssumedScrapeInterval, "query-frontend.assumed-scrape-interval", "The scrape interval assumed for the tenant's series. Queries computing rate() or increase() over a range shorter than twice the interval are tracked in the cortex_query_frontend_short_range_rate_total metric, because they may return no data. 0 to disable.")
+	f.StringVar(&l.DefaultMetricNameRegexp, defaultMetricNameRegexpFlag, "", "Regular expression matcher on the metric name added to the selectors of a query without a matcher on the metric name, like {job=\"test\"}, to bound the series selected by them, for example to the tenant's most queried metrics. This changes the semantics of queries. Empty to disable.")
+	f.BoolVar(&l.RejectSubqueriesWithUnevenStep, rejectSubqueriesWithUnevenStepFlag, false, "If enabled, queries with a subquery whose step doesn't evenly divide its range, like x[1h:7m], are rejected. Such subqueries are likely a mistake, because the number of steps evaluated in the range isn't constant.")
+	f.BoolVar(&l.RejectMatchAllRegexpMatchers, rejectMatchAllRegexpMatchersFlag, false, "If enabled, queries with a regular expression matcher matching any value of a label other than the metric name, like pod=~\".*\", are rejected. Such matchers don't filter any series, so they're likely a mistake.")
 
 	// Store-gateway.
 	f.IntVar(&l.StoreGatewayTenantShardSize, "store-gateway.tenant-shard-size", 0, "The tenant's shard size, used when store-gateway sharding is enabled. Value of 0 disables shuffle sharding for the tenant, that is all tenant blocks are sharded across all store-gateway replicas.")
@@ -338,6 +370,10 @@ func (l *Limits) validate() error {
 		}
 	}
 
+	if _, err := regexp.Compile(l.DefaultMetricNameRegexp); err != nil {
+		return fmt.Errorf("invalid %s: %w", defaultMetricNameRegexpFlag, err)
+	}
+
 	return nil
 }
 
@@ -526,6 +562,66 @@ func (o *Overrides) MaxQueryExpressionSizeBytes(userID string) int {
 	return o.getOverridesForUser(userID).MaxQueryExpressionSizeBytes
 }
 
+// MaxQueryBatchSizeBytes returns the limit of the total size of the selectors of a batched request, in bytes.
+func (o *Overrides) MaxQueryBatchSizeBytes(userID string) int {
+	return o.getOverridesForUser(userID).MaxQueryBatchSizeBytes
+}
+
+// MaxQueryMetricNames returns the limit of the number of distinct metric names selected by a query.
+func (o *Overrides) MaxQueryMetricNames(userID string) int {
+	return o.getOverridesForUser(userID).MaxQueryMetricNames
+}
+
+// MaxQueryMetricNamesIgnoreRegexp returns whether regexp matchers on the metric name are ignored
+// when enforcing the max number of metric names selected by a query.
+func (o *Overrides) MaxQueryMetricNamesIgnoreRegexp(userID string) bool {
+	return o.getOverridesForUser(userID).MaxQueryMetricNamesIgnoreRegexp
+}
+
+// MaxQueryOrOperands returns the limit of the number of operands of the 'or' chain at the top level of a query.
+func (o *Overrides) MaxQueryOrOperands(userID string) int {
+	return o.getOverridesForUser(userID).MaxQueryOrOperands
+}
+
+// QueryMetricNamesAllowlist returns the list of metric names a query can select. An empty list allows any metric name.
+func (o *Overrides) QueryMetricNamesAllowlist(userID string) []string {
+	return o.getOverridesForUser(userID).QueryMetricNamesAllowlist
+}
+
+// MaxConcurrentQueries returns the limit of the number of queries of a tenant the query-frontend runs concurrently.
+func (o *Overrides) MaxConcurrentQueries(userID string) int {
+	return o.getOverridesForUser(userID).MaxConcurrentQueries
+}
+
+// CaseInsensitiveMetricNames returns whether equality matchers on the metric name are rewritten
+// to match the metric name case-insensitively.
+func (o *Overrides) CaseInsensitiveMetricNames(userID string) bool {
+	return o.getOverridesForUser(userID).CaseInsensitiveMetricNames
+}
+
+// AssumedScrapeInterval returns the scrape interval assumed for the tenant's series.
+func (o *Overrides) AssumedScrapeInterval(userID string) time.Duration {
+	return time.Duration(o.getOverridesForUser(userID).AssumedScrapeInterval)
+}
+
+// DefaultMetricNameRegexp returns the regular expression matcher on the metric name added to the
+// selectors without a matcher on the metric name. An empty regular expression disables it.
+func (o *Overrides) DefaultMetricNameRegexp(userID string) string {
+	return o.getOverridesForUser(userID).DefaultMetricNameRegexp
+}
+
+// RejectSubqueriesWithUnevenStep returns whether queries with a subquery whose step doesn't evenly
+// divide its range are rejected.
+func (o *Overrides) RejectSubqueriesWithUnevenStep(userID string) bool {
+	return o.getOverridesForUser(userID).RejectSubqueriesWithUnevenStep
+}
+
+// RejectMatchAllRegexpMatchers returns whether queries with a regular expression matcher matching
+// any value of a label other than the metric name are rejected.
+func (o *Overrides) RejectMatchAllRegexpMatchers(userID string) bool {
+	return o.getOverridesForUser(userID).RejectMatchAllRegexpMatchers
+}
+
 // MaxLabelsQueryLength returns the limit of the length (in time) of a label names or values request.
 func (o *Overrides) MaxLabelsQueryLength(userID string) time.Duration {
 	return time.Duration(o.getOverridesForUser(userID).MaxLabelsQueryLength)
@@ -928,6 +1024,18 @@ func MaxDurationPerTenant(tenantIDs []string, f func(string) time.Duration) time
 	return result
 }
 
+// AllTrueBooleansPerTenant returns true only if the supplied limit function
+// returns true for all given tenants. It returns false if an empty tenant list
+// is given.
+func AllTrueBooleansPerTenant(tenantIDs []string, f func(string) bool) bool {
+	for _, tenantID := range tenantIDs {
+		if !f(tenantID) {
+			return false
+		}
+	}
+	return len(tenantIDs) > 0
+}
+
 // MustRegisterExtension registers the extensions type with given name
 // and returns a function to get the extensions value from a *Limits instance.
 //
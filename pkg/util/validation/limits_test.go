@@ -825,3 +825,35 @@ func TestExtensionMarshalling(t *testing.T) {
 		require.Contains(t, string(val), `{"user":{"test_extension_struct":{"foo":42},"test_extension_string":"default string extension value","request_rate":0,"request_burst_size":0,`)
 	})
 }
+
+func TestAllTrueBooleansPerTenant(t *testing.T) {
+	tenantLimits := map[string]*Limits{
+		"tenant-a": {
+			MaxQueryMetricNamesIgnoreRegexp: true,
+		},
+		"tenant-b": {
+			MaxQueryMetricNamesIgnoreRegexp: false,
+		},
+	}
+
+	defaults := Limits{
+		MaxQueryMetricNamesIgnoreRegexp: true,
+	}
+	ov, err := NewOverrides(defaults, NewMockTenantLimits(tenantLimits))
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		tenantIDs []string
+		expLimit  bool
+	}{
+		{tenantIDs: []string{}, expLimit: false},
+		{tenantIDs: []string{"tenant-a"}, expLimit: true},
+		{tenantIDs: []string{"tenant-b"}, expLimit: false},
+		{tenantIDs: []string{"tenant-c"}, expLimit: true},
+		{tenantIDs: []string{"tenant-a", "tenant-c"}, expLimit: true},
+		{tenantIDs: []string{"tenant-a", "tenant-b"}, expLimit: false},
+		{tenantIDs: []string{"tenant-a", "tenant-b", "tenant-c"}, expLimit: false},
+	} {
+		assert.Equal(t, tc.expLimit, AllTrueBooleansPerTenant(tc.tenantIDs, ov.MaxQueryMetricNamesIgnoreRegexp))
+	}
+}